@@ -0,0 +1,292 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "time"
+)
+
+/* rider is warned if expected at control later than this before close */
+const BrevetRiskMargin = 15 * time.Minute
+
+/* stopped rider is warned if control closes sooner than this */
+const BrevetStopMargin = time.Hour
+
+/* state of control in rider's card */
+const (
+    CONTROL_PENDING = "pending"
+    CONTROL_OK = "ok"
+    CONTROL_EARLY = "early"
+    CONTROL_LATE = "late"
+    CONTROL_MISSING = "missing"
+)
+
+/*
+ * ACP/RUSA table: minimum and maximum speeds (km/h) for
+ * control distances up to the given one
+ */
+var acp_table = []struct {
+    upto      float64
+    min       float64
+    max       float64
+} {
+    { 200, 15, 34 },
+    { 400, 15, 32 },
+    { 600, 15, 30 },
+    { 1000, 11.428, 28 },
+    { 1300, 13.333, 26 },
+}
+
+/* overall time limits (hours) of standard brevets */
+var acp_limits = map[float64]float64 {
+    200: 13.5,
+    300: 20,
+    400: 27,
+    600: 40,
+    1000: 75,
+    1200: 90,
+}
+
+/* Distance is nominal distance, km; Start is official start */
+type Brevet struct {
+    Distance  float64
+    Start     time.Time
+}
+
+/*
+ * control of rider's card; times are absolute,
+ * CheckIn is nil if rider was not checked in
+ */
+type CardControl struct {
+    Name      string
+    Km        float64
+    Finish    bool         `json:",omitempty"`
+    Open      time.Time
+    Close     time.Time
+    CheckIn  *time.Time    `json:",omitempty"`
+    State     string
+}
+
+type ControlCard struct {
+    UserID    int64
+    UserName  string
+    Start     time.Time
+    Controls  []CardControl
+}
+
+/* nil if event is not a brevet or it has no start time */
+func brevet_from_config(conf *UserConfig) *Brevet {
+
+    if conf.BrevetDistance <= 0 {
+        return nil
+    }
+
+    if conf.StartTime.IsZero() {
+        log.Printf("brevet distance without StartTime, control times ignored")
+        return nil
+    }
+
+    return &Brevet{ Distance: conf.BrevetDistance, Start: conf.StartTime }
+}
+
+func hours(h float64) time.Duration {
+    return (time.Duration(h * float64(time.Hour))).Round(time.Minute)
+}
+
+/* time after start when control at given km opens */
+func acp_open(km float64, brevet float64) time.Duration {
+
+    km = math.Min(km, brevet)
+
+    var h, from float64
+
+    for _, b := range acp_table {
+        if km <= from {
+            break
+        }
+
+        h += (math.Min(km, b.upto) - from) / b.max
+        from = b.upto
+    }
+
+    return hours(h)
+}
+
+/* time after start when control at given km closes */
+func acp_close(km float64, brevet float64) time.Duration {
+
+    if km >= brevet {
+        if limit, ok := acp_limits[brevet]; ok {
+            return hours(limit)
+        }
+
+        km = brevet
+    }
+
+    /* neutralized start: an hour for the first 60 km at 20 km/h */
+    if km <= 60 {
+        return hours(km / 20 + 1)
+    }
+
+    var h, from float64
+
+    for _, b := range acp_table {
+        if km <= from {
+            break
+        }
+
+        h += (math.Min(km, b.upto) - from) / b.min
+        from = b.upto
+    }
+
+    return hours(h)
+}
+
+/* opening and closing times of control at given distance, meters */
+func (b *Brevet) control_times(offset float64) (time.Time, time.Time) {
+
+    km := math.Round(offset / 1000)
+
+    return b.Start.Add(acp_open(km, b.Distance)),
+           b.Start.Add(acp_close(km, b.Distance))
+}
+
+func (b *Brevet) control_state(cc *CardControl, passed bool,
+                               now time.Time) string {
+
+    switch {
+    case cc.CheckIn == nil && (passed || now.After(cc.Close)):
+        return CONTROL_MISSING
+
+    case cc.CheckIn == nil:
+        return CONTROL_PENDING
+
+    case cc.CheckIn.Before(cc.Open):
+        return CONTROL_EARLY
+
+    case cc.CheckIn.After(cc.Close):
+        return CONTROL_LATE
+    }
+
+    return CONTROL_OK
+}
+
+/* control card of user (snapshot): route checkpoints and finish */
+func (b *Brevet) card(ui *UserInfo, rt *Route, now time.Time) *ControlCard {
+
+    cc := &ControlCard{
+        UserID: ui.UserID,
+        UserName: ui.UserName,
+        Start: b.Start,
+    }
+
+    if rt == nil {
+        return cc
+    }
+
+    var pos float64
+    if ui.Route != nil {
+        pos = ui.Route.Position
+    }
+
+    for i, cp := range rt.Checkpoints {
+
+        c := CardControl{ Name: cp.Name, Km: math.Round(cp.Offset / 1000) }
+
+        c.Open, c.Close = b.control_times(cp.Offset)
+
+        for _, ci := range ui.CheckIns {
+            if ci.Checkpoint == i {
+                t := ci.Time
+                c.CheckIn = &t
+            }
+        }
+
+        passed := pos > cp.Offset + cp.Radius + CheckpointSlack
+
+        c.State = b.control_state(&c, passed, now)
+
+        cc.Controls = append(cc.Controls, c)
+    }
+
+    fin := CardControl{ Km: math.Round(rt.Length / 1000), Finish: true }
+
+    fin.Open, fin.Close = b.control_times(rt.Length)
+    fin.CheckIn = ui.Finish
+    fin.State = b.control_state(&fin, false, now)
+
+    cc.Controls = append(cc.Controls, fin)
+
+    return cc
+}
+
+/*
+ * next control the user (snapshot) is going to reach after its close
+ * (less BrevetRiskMargin) at recent pace: its index in card, and
+ * expected arrival; nil if there is no such control. Arrival of
+ * stopped rider is unknown, zero, control is at risk if it closes
+ * within BrevetStopMargin
+ */
+func (b *Brevet) at_risk(ui *UserInfo, rt *Route, climb_penalty float64,
+                         now time.Time) (*CardControl, int, time.Time) {
+
+    if ui.MovingState == STATUS_FINISHED || ui.MovingState == STATUS_DNF {
+        return nil, 0, time.Time{}
+    }
+
+    card := b.card(ui, rt, now)
+
+    for i := range card.Controls {
+        c := &card.Controls[i]
+
+        if c.State != CONTROL_PENDING {
+            continue
+        }
+
+        /* controls of card follow route checkpoints */
+        offset := rt.Length
+        if !c.Finish {
+            offset = rt.Checkpoints[i].Offset
+        }
+
+        pace := ui.pace()
+
+        if pace == 0 {
+            if ui.Route != nil && c.Close.Sub(now) < BrevetStopMargin {
+                return c, i, time.Time{}
+            }
+            break
+        }
+
+        eta, ok := estimate_arrival(ui, rt, offset, pace, climb_penalty)
+
+        if ok && eta.After(c.Close.Add(-BrevetRiskMargin)) {
+            return c, i, *eta
+        }
+
+        /* only the next control matters */
+        break
+    }
+
+    return nil, 0, time.Time{}
+}
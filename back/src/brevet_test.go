@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+func hm(h int, m int) time.Duration {
+    return time.Duration(h) * time.Hour + time.Duration(m) * time.Minute
+}
+
+func TestAcpTimes(t *testing.T) {
+
+    /* values of RUSA/ACP calculator */
+    tests := []struct {
+        km      float64
+        brevet  float64
+        open    time.Duration
+        close   time.Duration
+    } {
+        { 0, 200, hm(0, 0), hm(1, 0) },
+        { 20, 200, hm(0, 35), hm(2, 0) },
+        { 60, 200, hm(1, 46), hm(4, 0) },
+        { 100, 200, hm(2, 56), hm(6, 40) },
+        { 200, 200, hm(5, 53), hm(13, 30) },
+        { 205, 200, hm(5, 53), hm(13, 30) },
+        { 300, 300, hm(9, 0), hm(20, 0) },
+        { 350, 400, hm(10, 34), hm(23, 20) },
+        { 550, 600, hm(17, 8), hm(36, 40) },
+        { 890, 1000, hm(29, 9), hm(65, 23) },
+        { 1000, 1000, hm(33, 5), hm(75, 0) },
+    }
+
+    for _, test := range tests {
+        open := acp_open(test.km, test.brevet)
+        close := acp_close(test.km, test.brevet)
+
+        if open != test.open || close != test.close {
+            t.Fatalf("%v km of %v: open %v, close %v; expected %v, %v",
+                     test.km, test.brevet, open, close, test.open, test.close)
+        }
+    }
+}
+
+/* 100 km route, controls at 20, 50 and 80 km */
+func test_brevet_route() *Route {
+
+    rt := new(Route)
+
+    /* ~11 km per 0.1 degree */
+    for i := 0; i <= 90; i++ {
+        rt.add(55 + float64(i) / 100, 37, 0, i == 0)
+    }
+
+    rt.build_index()
+
+    for _, km := range []float64{ 20, 50, 80 } {
+        lat, lon := rt.point_at(km * 1000)
+        rt.add_checkpoint("", lat, lon, 100)
+    }
+
+    rt.Checkpoints[0].Name = "first"
+    rt.Checkpoints[1].Name = "second"
+    rt.Checkpoints[2].Name = "third"
+
+    return rt
+}
+
+func TestBrevetConfig(t *testing.T) {
+
+    conf := UserConfig{ BrevetDistance: 200 }
+
+    if brevet_from_config(&conf) != nil {
+        t.Fatalf("brevet without start time is accepted")
+    }
+
+    conf.StartTime = time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC)
+
+    b := brevet_from_config(&conf)
+    if b == nil || b.Distance != 200 || !b.Start.Equal(conf.StartTime) {
+        t.Fatalf("wrong brevet: %+v", b)
+    }
+}
+
+func TestControlCard(t *testing.T) {
+
+    rt := test_brevet_route()
+    start := time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC)
+
+    b := &Brevet{ Distance: 100, Start: start }
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: start })
+    ui.UserID = 1
+
+    /* first control: before it opens, second: in time, then rider is at 60 km */
+    ui.AddCheckIns([]CheckIn{
+        { Checkpoint: 0, Time: start.Add(hm(0, 20)) },
+        { Checkpoint: 1, Time: start.Add(hm(2, 0)) },
+    })
+    ui.Route = &RouteProgress{ Position: 60000 }
+
+    card := b.card(ui.snapshot(), rt, start.Add(hm(3, 0)))
+
+    if len(card.Controls) != 4 || !card.Controls[3].Finish {
+        t.Fatalf("wrong controls: %+v", card.Controls)
+    }
+
+    expect := []string{ CONTROL_EARLY, CONTROL_OK, CONTROL_PENDING, CONTROL_PENDING }
+
+    for i, state := range expect {
+        if card.Controls[i].State != state {
+            t.Fatalf("control %d: %s, expected %s", i, card.Controls[i].State, state)
+        }
+    }
+
+    /* not a standard brevet, no fixed limit: 100 km at 15 km/h */
+    fin := card.Controls[3]
+    if fin.Km != 100 || fin.Close.Sub(start) != hm(6, 40) {
+        t.Fatalf("wrong finish: %+v", fin)
+    }
+
+    /* third control closed long ago */
+    card = b.card(ui.snapshot(), rt, start.Add(hm(9, 0)))
+    if card.Controls[2].State != CONTROL_MISSING {
+        t.Fatalf("closed control is not missing: %+v", card.Controls[2])
+    }
+
+    /* rode by third control without check-in */
+    ui.Route = &RouteProgress{ Position: 85000 }
+
+    card = b.card(ui.snapshot(), rt, start.Add(hm(3, 0)))
+    if card.Controls[2].State != CONTROL_MISSING {
+        t.Fatalf("skipped control is not missing: %+v", card.Controls[2])
+    }
+
+    /* late check-in */
+    ui.AddCheckIns([]CheckIn{ { Checkpoint: 2, Time: start.Add(hm(9, 0)) } })
+
+    card = b.card(ui.snapshot(), rt, start.Add(hm(9, 0)))
+    if card.Controls[2].State != CONTROL_LATE {
+        t.Fatalf("late check-in is not flagged: %+v", card.Controls[2])
+    }
+}
+
+func TestControlRisk(t *testing.T) {
+
+    rt := test_brevet_route()
+    start := time.Unix(0, 0)
+
+    b := &Brevet{ Distance: 100, Start: start }
+
+    /* 20 km control closes at 2:00, rider does 2 m/s (7.2 km/h) */
+    ui := test_rider(1, STATUS_MOVING, 2, 10)
+    ui.UpdateRoutePosition(rt)
+
+    c, idx, eta := b.at_risk(ui.snapshot(), rt, 0, start.Add(10 * time.Minute))
+    if c == nil || idx != 0 || c.Name != "first" {
+        t.Fatalf("risk is not detected: %+v", c)
+    }
+
+    if !eta.After(c.Close) {
+        t.Fatalf("wrong eta %v, control closes at %v", eta, c.Close)
+    }
+
+    /* 10 m/s: 36 km/h, well in time */
+    fast := test_rider(2, STATUS_MOVING, 10, 10)
+    fast.UpdateRoutePosition(rt)
+
+    if c, _, _ := b.at_risk(fast.snapshot(), rt, 0, start.Add(10 * time.Minute)); c != nil {
+        t.Fatalf("risk for fast rider: %+v", c)
+    }
+
+    /* stopped rider has no pace, risk only when control closes soon */
+    stopped := test_rider(3, STATUS_MOVING, 0, 10)
+    stopped.UpdateRoutePosition(rt)
+
+    if c, _, _ := b.at_risk(stopped.snapshot(), rt, 0, start.Add(10 * time.Minute)); c != nil {
+        t.Fatalf("risk long before close: %+v", c)
+    }
+
+    c, idx, eta = b.at_risk(stopped.snapshot(), rt, 0, start.Add(hm(1, 30)))
+    if c == nil || idx != 0 || !eta.IsZero() {
+        t.Fatalf("risk for stopped rider is not detected: %+v, %v", c, eta)
+    }
+
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_DNF })
+
+    if c, _, _ := b.at_risk(ui.snapshot(), rt, 0, start); c != nil {
+        t.Fatalf("risk for rider out of race: %+v", c)
+    }
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "sync"
+)
+
+/* messages a subscriber may lag behind before publisher waits */
+const BusQueue = 1024
+
+/* update passed from bot to webmap running in the same process */
+type BusMessage struct {
+    Position  *UserPosition
+    Status    *UserStatus
+    Incident  *Incident
+}
+
+/* every subscriber gets every message, in order of publishing */
+type Bus struct {
+    mu        sync.Mutex
+    subs      []chan BusMessage
+}
+
+func CreateBus() *Bus {
+    return new(Bus)
+}
+
+/* only messages published after subscription are received */
+func (b *Bus) subscribe() <-chan BusMessage {
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    ch := make(chan BusMessage, BusQueue)
+    b.subs = append(b.subs, ch)
+
+    return ch
+}
+
+/* updates are never dropped: slow subscriber delays publisher */
+func (b *Bus) publish(m BusMessage) {
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    for _, ch := range b.subs {
+        ch <- m
+    }
+}
+
+/* subscribers see closed channel once pending messages are read */
+func (b *Bus) close() {
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    for _, ch := range b.subs {
+        close(ch)
+    }
+
+    b.subs = nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "testing"
+)
+
+func TestBus(t *testing.T) {
+
+    b := CreateBus()
+
+    /* nobody listens yet */
+    b.publish(BusMessage{ Status: &UserStatus{ UserID: 1 } })
+
+    first := b.subscribe()
+    second := b.subscribe()
+
+    for i := int64(1); i <= 3; i++ {
+        b.publish(BusMessage{ Position: &UserPosition{ UserID: i } })
+    }
+
+    b.close()
+
+    for _, ch := range []<-chan BusMessage{ first, second } {
+        var got []int64
+
+        for m := range ch {
+            if m.Position == nil {
+                t.Fatalf("unexpected message %+v", m)
+            }
+            got = append(got, m.Position.UserID)
+        }
+
+        if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+            t.Fatalf("wrong messages: %v", got)
+        }
+    }
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "time"
+    "strings"
+)
+
+/*
+ * rider is checked in only when rider's route position is that close to
+ * checkpoint (plus radius and last leg), so a place passed twice on
+ * out-and-back course counts for the right pass only
+ */
+const CheckpointSlack = 500.0
+
+/* part of route to be covered before finish geofence counts */
+const FinishMinShare = 0.9
+
+/* finish geofence; MinShare is part of route length */
+type FinishZone struct {
+    Lat       float64
+    Lon       float64
+    Radius    float64
+    MinShare  float64
+}
+
+/* GPX waypoints and checkpoints from config, with their geofences */
+func setup_checkpoints(rt *Route, conf *UserConfig) {
+
+    if len(conf.Checkpoints) != 0 && rt == nil {
+        log.Printf("checkpoints are configured without route, ignored")
+        return
+    }
+
+    if rt == nil {
+        return
+    }
+
+    radius := conf.CheckpointRadius
+    if radius <= 0 {
+        radius = RouteCheckpointRadius
+    }
+
+    /* waypoints got default geofence when route was loaded */
+    for i := range rt.Checkpoints {
+        rt.Checkpoints[i].Radius = radius
+    }
+
+    for _, cp := range conf.Checkpoints {
+
+        r := cp.Radius
+        if r <= 0 {
+            r = radius
+        }
+
+        rt.add_checkpoint(cp.Name, cp.Lat, cp.Lon, r)
+    }
+
+    for i, cp := range rt.Checkpoints {
+        log.Printf("checkpoint %d '%s' at %.1f km, radius %.0f m",
+                   i, cp.Name, cp.Offset / 1000, cp.Radius)
+    }
+}
+
+/*
+ * finish geofence from config, by default at the end of route;
+ * nil without route, since there is no way to tell start from finish
+ * on a loop course then
+ */
+func finish_from_config(rt *Route, conf *UserConfig) *FinishZone {
+
+    if rt == nil || len(rt.points) == 0 {
+        if conf.Finish.Lat != 0 || conf.Finish.Lon != 0 {
+            log.Printf("finish is configured without route, ignored")
+        }
+        return nil
+    }
+
+    end := rt.points[len(rt.points) - 1]
+
+    fz := &FinishZone{
+        Lat: end.Lat,
+        Lon: end.Lon,
+        Radius: conf.Finish.Radius,
+        MinShare: conf.FinishMinShare,
+    }
+
+    if conf.Finish.Lat != 0 || conf.Finish.Lon != 0 {
+        fz.Lat = conf.Finish.Lat
+        fz.Lon = conf.Finish.Lon
+    }
+
+    if fz.Radius <= 0 {
+        fz.Radius = conf.CheckpointRadius
+    }
+
+    if fz.Radius <= 0 {
+        fz.Radius = RouteCheckpointRadius
+    }
+
+    if fz.MinShare <= 0 || fz.MinShare > 1 {
+        fz.MinShare = FinishMinShare
+    }
+
+    log.Printf("finish at %f,%f, radius %.0f m, after %.0f%% of route",
+               fz.Lat, fz.Lon, fz.Radius, fz.MinShare * 100)
+
+    return fz
+}
+
+/*
+ * closest approach of leg from a to b to point p:
+ * distance in meters and fraction of leg where it happens
+ */
+func leg_distance(alat float64, alon float64, blat float64, blon float64,
+                  plat float64, plon float64) (float64, float64) {
+
+    const rad = math.Pi / 180
+
+    /* small distances, plane around a is good enough */
+    ky := EarthRadius * rad
+    kx := ky * math.Cos(alat * rad)
+
+    bx := (blon - alon) * kx
+    by := (blat - alat) * ky
+    px := (plon - alon) * kx
+    py := (plat - alat) * ky
+
+    var f float64
+
+    if l2 := bx * bx + by * by; l2 > 0 {
+        f = math.Max(0, math.Min(1, (px * bx + py * by) / l2))
+    }
+
+    return math.Hypot(px - f * bx, py - f * by), f
+}
+
+func (ui *UserInfo) checked_in(cp int) bool {
+
+    for _, ci := range ui.CheckIns {
+        if ci.Checkpoint == cp {
+            return true
+        }
+    }
+
+    return false
+}
+
+/*
+ * Checks in user at checkpoints whose geofence was entered on the way
+ * from previous position to current one; returns new check-ins.
+ * The moment of check-in is interpolated along the leg.
+ */
+func (ui *UserInfo) UpdateCheckIns(rt *Route) []CheckIn {
+
+    if rt == nil || len(rt.Checkpoints) == 0 {
+        return nil
+    }
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    from := TrackPoint{ Lat: ui.Pos.Lat, Lon: ui.Pos.Lon, Last: ui.Last }
+
+    /* previous position, if any */
+    if track := ui.Track.extract(); len(track) != 0 {
+        from = track[len(track) - 1]
+    }
+
+    leg := geo_distance(from.Lat, from.Lon, ui.Pos.Lat, ui.Pos.Lon)
+
+    var out []CheckIn
+
+    for i := range rt.Checkpoints {
+        cp := &rt.Checkpoints[i]
+
+        if ui.checked_in(i) {
+            continue
+        }
+
+        if ui.Route != nil &&
+           math.Abs(ui.Route.Position - cp.Offset) >
+               cp.Radius + leg + CheckpointSlack {
+            continue
+        }
+
+        d, f := leg_distance(from.Lat, from.Lon, ui.Pos.Lat, ui.Pos.Lon,
+                             cp.Lat, cp.Lon)
+        if d > cp.Radius {
+            continue
+        }
+
+        dt := ui.Last.Sub(from.Last)
+
+        ci := CheckIn{
+            Checkpoint: i,
+            Name: cp.Name,
+            Time: from.Last.Add(time.Duration(f * float64(dt))),
+        }
+
+        ui.CheckIns = append(ui.CheckIns, ci)
+        out = append(out, ci)
+
+        log.Printf("user %s checked in at '%s'", ui.UserName, cp.Name)
+    }
+
+    return out
+}
+
+/* check-ins reported by bot; returns all check-ins of user */
+func (ui *UserInfo) AddCheckIns(cis []CheckIn) []CheckIn {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    for _, ci := range cis {
+        if !ui.checked_in(ci.Checkpoint) {
+            ui.CheckIns = append(ui.CheckIns, ci)
+        }
+    }
+
+    return append([]CheckIn(nil), ui.CheckIns...)
+}
+
+/*
+ * Finishes user who entered finish geofence on the way from previous
+ * position to current one, having covered most of route; returns
+ * interpolated time of finish or nil. Users who finished already or
+ * abandoned are left alone.
+ */
+func (ui *UserInfo) UpdateFinish(fz *FinishZone, rt *Route) *time.Time {
+
+    if fz == nil || rt == nil {
+        return nil
+    }
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    if ui.MovingState == STATUS_FINISHED || ui.MovingState == STATUS_DNF {
+        return nil
+    }
+
+    if ui.Route == nil || ui.Route.Position < rt.Length * fz.MinShare {
+        return nil
+    }
+
+    from := TrackPoint{ Lat: ui.Pos.Lat, Lon: ui.Pos.Lon, Last: ui.Last }
+
+    if track := ui.Track.extract(); len(track) != 0 {
+        from = track[len(track) - 1]
+    }
+
+    d, f := leg_distance(from.Lat, from.Lon, ui.Pos.Lat, ui.Pos.Lon,
+                         fz.Lat, fz.Lon)
+    if d > fz.Radius {
+        return nil
+    }
+
+    finish := from.Last.Add(time.Duration(f * float64(ui.Last.Sub(from.Last))))
+
+    ui.MovingState = STATUS_FINISHED
+    ui.Finish = &finish
+
+    log.Printf("user %s finished at %v", ui.UserName, finish)
+
+    t := finish
+
+    return &t
+}
+
+/*
+ * finish time set by organizer: "HH:MM" is today (local time),
+ * "YYYY-MM-DDTHH:MM" is full date; "-" cancels finish, nil is returned
+ */
+func parse_finish_time(s string, now time.Time) (*time.Time, error) {
+
+    s = strings.TrimSpace(s)
+
+    if s == "-" {
+        return nil, nil
+    }
+
+    if t, err := time.ParseInLocation("2006-01-02T15:04", s,
+                                      now.Location()); err == nil {
+        return &t, nil
+    }
+
+    t, err := time.ParseInLocation("15:04", s, now.Location())
+    if err != nil {
+        return nil, fmt.Errorf("bad finish time '%s'", s)
+    }
+
+    t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(),
+                  0, 0, now.Location())
+
+    return &t, nil
+}
+
+/*
+ * organizer sets finish of user, nil finish cancels it; state is saved
+ * at once, otherwise correction is lost if bot restarts before the next
+ * message of rider. Returns status to be sent to webmap
+ */
+func (db *UsersDb) set_finish(ui *UserInfo, finish *time.Time,
+                              tmpdir string) (UserStatus, error) {
+
+    snap := ui.snapshot()
+
+    var us UserStatus
+
+    us.UserID = snap.UserID
+    us.UserName = snap.UserName
+    us.MovingState = STATUS_FINISHED
+    us.Finish = finish
+
+    if finish == nil {
+        us.MovingState = STATUS_MOVING
+    }
+
+    ui.UpdateStatus(&us)
+
+    return us, db.save(tmpdir)
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "math"
+    "time"
+    "testing"
+    "path/filepath"
+)
+
+func TestLegDistance(t *testing.T) {
+
+    /* leg 1112 m to the north, point 100 m east of its middle */
+    d, f := leg_distance(55, 37, 55.01, 37, 55.005, 37.00157)
+    if math.Abs(d - 100) > 1 || math.Abs(f - 0.5) > 0.001 {
+        t.Fatalf("wrong approach: %v m at %v", d, f)
+    }
+
+    /* behind the start */
+    d, f = leg_distance(55, 37, 55.01, 37, 54.999, 37)
+    if math.Abs(d - 111) > 1 || f != 0 {
+        t.Fatalf("wrong approach before leg: %v m at %v", d, f)
+    }
+
+    /* no leg at all */
+    d, f = leg_distance(55, 37, 55, 37, 55.001, 37)
+    if math.Abs(d - 111) > 1 || f != 0 {
+        t.Fatalf("wrong approach to point: %v m at %v", d, f)
+    }
+}
+
+func TestSetupCheckpoints(t *testing.T) {
+
+    rt := test_line_route()
+    rt.add_checkpoint("gpx", 55.008, 37, RouteCheckpointRadius)
+
+    var conf UserConfig
+
+    conf.CheckpointRadius = 50
+    conf.Checkpoints = []CheckpointConfig{
+        { Name: "feed", Lat: 55.002, Lon: 37.0005, Radius: 200 },
+        { Name: "photo", Lat: 55.005, Lon: 37 },
+    }
+
+    setup_checkpoints(rt, &conf)
+
+    cps := rt.Checkpoints
+
+    if len(cps) != 3 || cps[0].Name != "feed" || cps[1].Name != "photo" ||
+       cps[2].Name != "gpx" {
+        t.Fatalf("wrong checkpoints: %+v", cps)
+    }
+
+    if cps[0].Radius != 200 || cps[1].Radius != 50 || cps[2].Radius != 50 {
+        t.Fatalf("wrong geofences: %+v", cps)
+    }
+
+    /* no route: nothing to attach checkpoints to */
+    setup_checkpoints(nil, &conf)
+}
+
+/* moves user and checks in */
+func ride_to(ui *UserInfo, rt *Route, lat float64, at int64) []CheckIn {
+
+    ui.UpdatePosition(&UserPosition{ Lat: lat, Lon: 37, Last: time.Unix(at, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    return ui.UpdateCheckIns(rt)
+}
+
+func TestCheckIn(t *testing.T) {
+
+    rt := test_line_route()
+
+    rt.add_checkpoint("first", 55.002, 37.0003, 30)
+    rt.add_checkpoint("second", 55.006, 37, 30)
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    if cis := ui.UpdateCheckIns(rt); len(cis) != 0 {
+        t.Fatalf("checked in at start: %+v", cis)
+    }
+
+    /* 20 meters from first, between fixes */
+    cis := ride_to(ui, rt, 55.003, 100)
+    if len(cis) != 1 || cis[0].Checkpoint != 0 || cis[0].Name != "first" {
+        t.Fatalf("first checkpoint missed: %+v", cis)
+    }
+
+    /* reached at 2/3 of leg */
+    if math.Abs(cis[0].Time.Sub(time.Unix(0, 0)).Seconds() - 66.7) > 1 {
+        t.Fatalf("wrong check-in time: %v", cis[0].Time)
+    }
+
+    if cis = ride_to(ui, rt, 55.004, 200); len(cis) != 0 {
+        t.Fatalf("checked in twice: %+v", cis)
+    }
+
+    if cis = ride_to(ui, rt, 55.006, 300); len(cis) != 1 || cis[0].Name != "second" {
+        t.Fatalf("second checkpoint missed: %+v", cis)
+    }
+
+    if snap := ui.snapshot(); len(snap.CheckIns) != 2 {
+        t.Fatalf("check-ins are not kept: %+v", snap.CheckIns)
+    }
+}
+
+func TestCheckInPass(t *testing.T) {
+
+    rt := test_out_and_back_route()
+
+    /* same place, on the way out and on the way back */
+    rt.add_checkpoint("out", 55.005, 37, 50)
+    rt.add_checkpoint("back", 55.005, 37, 50)
+    rt.Checkpoints[1].Offset = rt.Length - rt.Checkpoints[0].Offset
+
+    ui := createUser(nil, &UserPosition{ Lat: 55.004, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    cis := ride_to(ui, rt, 55.005, 10)
+    if len(cis) != 1 || cis[0].Name != "out" {
+        t.Fatalf("wrong check-in on the way out: %+v", cis)
+    }
+
+    for i, lat := range []float64{ 55.007, 55.009, 55.01, 55.008, 55.006 } {
+        if cis = ride_to(ui, rt, lat, int64(i + 2) * 10); len(cis) != 0 {
+            t.Fatalf("checked in at %v: %+v", lat, cis)
+        }
+    }
+
+    cis = ride_to(ui, rt, 55.005, 100)
+    if len(cis) != 1 || cis[0].Name != "back" {
+        t.Fatalf("wrong check-in on the way back: %+v", cis)
+    }
+}
+
+func TestCheckInState(t *testing.T) {
+
+    db := test_db(t)
+    tmpdir := filepath.Dir(db.StateFile)
+
+    ui := db.get(42, "rider", true)
+
+    at := time.Unix(1000, 0)
+
+    all := ui.AddCheckIns([]CheckIn{ { Checkpoint: 1, Name: "cp", Time: at } })
+    all = ui.AddCheckIns([]CheckIn{ { Checkpoint: 1, Name: "cp", Time: at },
+                                    { Checkpoint: 2, Name: "cp2", Time: at } })
+    if len(all) != 2 {
+        t.Fatalf("duplicate check-ins: %+v", all)
+    }
+
+    err := db.save(tmpdir)
+    if err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+
+    db2, err := CreateUsersDb(db.StateFile)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    cis := db2.get(42, "", false).snapshot().CheckIns
+    if len(cis) != 2 || cis[0].Checkpoint != 1 || !cis[0].Time.Equal(at) {
+        t.Fatalf("check-ins are not restored: %+v", cis)
+    }
+}
+
+func TestFinishFromConfig(t *testing.T) {
+
+    rt := test_line_route()
+
+    var conf UserConfig
+
+    conf.CheckpointRadius = 50
+
+    fz := finish_from_config(rt, &conf)
+    if fz == nil || fz.Lat != 55.01 || fz.Lon != 37 || fz.Radius != 50 ||
+       fz.MinShare != FinishMinShare {
+        t.Fatalf("wrong default finish: %+v", fz)
+    }
+
+    conf.Finish = CheckpointConfig{ Lat: 55.009, Lon: 37.001, Radius: 20 }
+    conf.FinishMinShare = 0.5
+
+    fz = finish_from_config(rt, &conf)
+    if fz.Lat != 55.009 || fz.Lon != 37.001 || fz.Radius != 20 ||
+       fz.MinShare != 0.5 {
+        t.Fatalf("wrong configured finish: %+v", fz)
+    }
+
+    if fz = finish_from_config(nil, &conf); fz != nil {
+        t.Fatalf("finish without route: %+v", fz)
+    }
+}
+
+func TestFinish(t *testing.T) {
+
+    /* loop course: start and finish at the same place */
+    rt := test_out_and_back_route()
+
+    var conf UserConfig
+
+    fz := finish_from_config(rt, &conf)
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    if f := ui.UpdateFinish(fz, rt); f != nil {
+        t.Fatalf("finished at start: %v", f)
+    }
+
+    for i, lat := range []float64{ 55.002, 55.005, 55.008, 55.01, 55.007,
+                                   55.004, 55.002 } {
+        ride_to(ui, rt, lat, int64(i + 1) * 100)
+
+        if f := ui.UpdateFinish(fz, rt); f != nil {
+            t.Fatalf("finished at %v: %v", lat, f)
+        }
+    }
+
+    /* finish line is crossed at 4/5 of the last leg */
+    ride_to(ui, rt, 54.9995, 900)
+
+    f := ui.UpdateFinish(fz, rt)
+    if f == nil || math.Abs(f.Sub(time.Unix(0, 0)).Seconds() - 860) > 1 {
+        t.Fatalf("wrong finish: %v", f)
+    }
+
+    snap := ui.snapshot()
+    if snap.MovingState != STATUS_FINISHED || !snap.Finish.Equal(*f) {
+        t.Fatalf("finish is not recorded: %v %v", snap.MovingState, snap.Finish)
+    }
+
+    ride_to(ui, rt, 55.0001, 1000)
+
+    if f = ui.UpdateFinish(fz, rt); f != nil {
+        t.Fatalf("finished twice: %v", f)
+    }
+
+    /* organizer corrects time, webmap gets the same */
+    at := time.Unix(800, 0)
+
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_FINISHED, Finish: &at })
+
+    if snap = ui.snapshot(); !snap.Finish.Equal(at) {
+        t.Fatalf("finish is not corrected: %v", snap.Finish)
+    }
+
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_MOVING })
+
+    if snap = ui.snapshot(); snap.Finish != nil {
+        t.Fatalf("finish is not cancelled: %v", snap.Finish)
+    }
+}
+
+func TestSetFinish(t *testing.T) {
+
+    db := test_db(t)
+    tmpdir := filepath.Dir(db.StateFile)
+
+    ui := db.get(42, "rider", true)
+    ui.UpdatePosition(&UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(100, 0) })
+
+    at := time.Unix(800, 0)
+
+    us, err := db.set_finish(ui, &at, tmpdir)
+    if err != nil || us.MovingState != STATUS_FINISHED || us.UserID != 42 {
+        t.Fatalf("wrong status: %+v, %v", us, err)
+    }
+
+    /* correction survives restart */
+    saved, err := CreateUsersDb(db.StateFile)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    snap := saved.get(42, "", false).snapshot()
+    if snap.MovingState != STATUS_FINISHED || snap.Finish == nil ||
+       !snap.Finish.Equal(at) {
+        t.Fatalf("finish is not saved: %v %v", snap.MovingState, snap.Finish)
+    }
+
+    db.set_finish(ui, nil, tmpdir)
+
+    saved, _ = CreateUsersDb(db.StateFile)
+
+    if snap = saved.get(42, "", false).snapshot(); snap.Finish != nil ||
+       snap.MovingState != STATUS_MOVING {
+        t.Fatalf("cancel is not saved: %v %v", snap.MovingState, snap.Finish)
+    }
+}
+
+func TestParseFinishTime(t *testing.T) {
+
+    now := time.Date(2024, 6, 1, 20, 0, 0, 0, time.UTC)
+
+    f, err := parse_finish_time("18:25", now)
+    if err != nil || !f.Equal(time.Date(2024, 6, 1, 18, 25, 0, 0, time.UTC)) {
+        t.Fatalf("wrong time today: %v %v", f, err)
+    }
+
+    f, err = parse_finish_time("2024-05-31T23:59", now)
+    if err != nil || !f.Equal(time.Date(2024, 5, 31, 23, 59, 0, 0, time.UTC)) {
+        t.Fatalf("wrong full time: %v %v", f, err)
+    }
+
+    if f, err = parse_finish_time("-", now); f != nil || err != nil {
+        t.Fatalf("finish is not cancelled: %v %v", f, err)
+    }
+
+    if _, err = parse_finish_time("soon", now); err == nil {
+        t.Fatalf("bad time accepted")
+    }
+}
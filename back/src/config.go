@@ -22,9 +22,26 @@ package main
 
 import (
     "os"
+    "time"
     "encoding/json"
 )
 
+/* checkpoint geofence; radius is meters, CheckpointRadius if zero */
+type CheckpointConfig struct {
+    Name              string
+    Lat               float64
+    Lon               float64
+    Radius            float64
+}
+
+/* webmap receiving updates; empty URL skips updates of that kind */
+type SinkConfig struct {
+    Name              string
+    PositionURL       string
+    StatusURL         string
+    IncidentURL       string
+}
+
 type UserConfig struct {
     Token             string
     WebmapListen      string
@@ -40,6 +57,32 @@ type UserConfig struct {
     StateFile         string
     RestrictChannelId int64
     TmpDir            string
+    RouteFile         string
+    ClimbPenalty      float64
+    CheckpointRadius  float64
+    Checkpoints       []CheckpointConfig
+    StartTime         time.Time
+    BrevetDistance    float64
+    Finish            CheckpointConfig
+    FinishMinShare    float64
+    Organizers        []int64
+    StaggeredStart    bool
+    Start             CheckpointConfig
+    OffCourseDistance float64
+    OffCourseTime     float64
+    OrganizerChatId   int64
+    WatchStallRadius  float64
+    WatchStallTime    float64
+    WatchSilenceTime  float64
+    WatchAnswerTime   float64
+    IncidentFile      string
+    UpdateIncidentURL string
+    SosNearbyRiders   int
+    SosNearbyDistance float64
+    OutboxFile        string
+    UpdateKeys        []string
+    UpdateSinks       []SinkConfig
+    RelayTo           []SinkConfig
 }
 
 
@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "strconv"
+)
+
+/* kinds of ETA targets */
+const (
+    ETA_KM = "km"
+    ETA_CHECKPOINT = "checkpoint"
+    ETA_FINISH = "finish"
+)
+
+/*
+ * place on route and when rider is expected there;
+ * Eta is nil if unknown: rider is not moving or the place is passed
+ */
+type EtaTarget struct {
+    Kind      string
+    Name      string       `json:",omitempty"`
+    Offset    float64
+    Distance  float64
+    Passed    bool         `json:",omitempty"`
+    Eta      *time.Time    `json:",omitempty"`
+}
+
+/* Pace is recent moving speed, m/s */
+type RiderEta struct {
+    UserID    int64
+    UserName  string
+    Position  float64
+    Pace      float64
+    Targets   []EtaTarget
+}
+
+/*
+ * Expected arrival of user (snapshot) to the given distance along route:
+ * remaining distance at recent pace, from the moment of last position,
+ * plus climb_penalty seconds per meter of climbing on the way
+ */
+func estimate_arrival(ui *UserInfo, rt *Route, offset float64, pace float64,
+                      climb_penalty float64) (*time.Time, bool) {
+
+    if rt == nil || ui.Route == nil || pace == 0 {
+        return nil, false
+    }
+
+    remaining := offset - ui.Route.Position
+    if remaining < 0 {
+        return nil, false
+    }
+
+    t := remaining / pace
+
+    if climb_penalty > 0 {
+        t += rt.ascent(ui.Route.Position, offset) * climb_penalty
+    }
+
+    eta := ui.Last.Add(time.Duration(t * float64(time.Second)))
+
+    return &eta, true
+}
+
+/*
+ * ETA of user (snapshot) to finish, every checkpoint and
+ * given distances (meters) along route
+ */
+func make_eta(ui *UserInfo, rt *Route, offsets []float64,
+              climb_penalty float64) *RiderEta {
+
+    re := &RiderEta{
+        UserID: ui.UserID,
+        UserName: ui.UserName,
+    }
+
+    if ui.Route != nil {
+        re.Position = ui.Route.Position
+    }
+
+    /* nobody is expected anywhere after finish */
+    if ui.MovingState != STATUS_FINISHED && ui.MovingState != STATUS_DNF {
+        re.Pace = ui.pace()
+    }
+
+    if rt == nil {
+        return re
+    }
+
+    add := func(kind string, name string, offset float64) {
+
+        t := EtaTarget{
+            Kind: kind,
+            Name: name,
+            Offset: offset,
+            Distance: offset - re.Position,
+            Passed: offset < re.Position,
+        }
+
+        if t.Passed {
+            t.Distance = 0
+        }
+
+        t.Eta, _ = estimate_arrival(ui, rt, offset, re.Pace, climb_penalty)
+
+        re.Targets = append(re.Targets, t)
+    }
+
+    for _, off := range offsets {
+        if off >= 0 && off <= rt.Length {
+            add(ETA_KM, "", off)
+        }
+    }
+
+    for _, cp := range rt.Checkpoints {
+        add(ETA_CHECKPOINT, cp.Name, cp.Offset)
+    }
+
+    add(ETA_FINISH, "", rt.Length)
+
+    return re
+}
+
+/*
+ * arguments of /eta: "[rider] [km]"; number alone is rider id, so
+ * it is km only after rider or with "km" suffix: "150km", "150 km".
+ * Returns rider query, empty for the asking user, and target offset
+ * in meters, negative if not given
+ */
+func parse_eta_args(args []string) (string, float64) {
+
+    n := len(args)
+    if n == 0 {
+        return "", -1
+    }
+
+    last := strings.ToLower(args[n - 1])
+
+    if (last == "km" || last == "км") && n > 1 {
+        n--
+        last = strings.ToLower(args[n - 1])
+        last += "km"
+    }
+
+    num := strings.TrimSuffix(strings.TrimSuffix(last, "km"), "км")
+    suffix := num != last
+
+    km, err := strconv.ParseFloat(num, 64)
+    if err != nil || km < 0 || (!suffix && n == 1) {
+        return strings.Join(args, " "), -1
+    }
+
+    return strings.Join(args[:n - 1], " "), km * 1000
+}
+
+/*
+ * user (snapshot) by numeric id or name: exact name is preferred,
+ * otherwise case-insensitive part of name must be unique
+ */
+func find_rider(users []*UserInfo, query string) (*UserInfo, error) {
+
+    query = strings.TrimSpace(query)
+
+    if len(query) == 0 {
+        return nil, fmt.Errorf("no rider specified")
+    }
+
+    if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+        for _, ui := range users {
+            if ui.UserID == id {
+                return ui, nil
+            }
+        }
+    }
+
+    var found []*UserInfo
+
+    q := strings.ToLower(query)
+
+    for _, ui := range users {
+        if ui.UserName == query {
+            return ui, nil
+        }
+
+        if strings.Contains(strings.ToLower(ui.UserName), q) {
+            found = append(found, ui)
+        }
+    }
+
+    switch len(found) {
+    case 0:
+        return nil, fmt.Errorf("rider '%s' not found", query)
+
+    case 1:
+        return found[0], nil
+    }
+
+    return nil, fmt.Errorf("rider '%s' is ambiguous, %d riders match",
+                           query, len(found))
+}
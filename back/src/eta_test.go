@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "os"
+    "math"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+/* straight route to the north, 1112 meters: up 50 meters and down 20 */
+func test_hill_route() *Route {
+
+    rt := new(Route)
+
+    ele := []float64{ 0, 10, 20, 30, 40, 50, 40, 30, 30, 30, 30 }
+
+    for i := 0; i <= 10; i++ {
+        rt.add(55 + float64(i) / 1000, 37, ele[i], i == 0)
+    }
+
+    rt.build_index()
+
+    return rt
+}
+
+func TestRouteAscent(t *testing.T) {
+
+    rt := test_hill_route()
+
+    if a := rt.ascent(0, rt.Length); math.Abs(a - 50) > 0.001 {
+        t.Fatalf("wrong total ascent: %v", a)
+    }
+
+    /* half of first segment */
+    if a := rt.ascent(0, rt.points[1].Offset / 2); math.Abs(a - 5) > 0.001 {
+        t.Fatalf("wrong partial ascent: %v", a)
+    }
+
+    if a := rt.ascent(rt.points[5].Offset, rt.Length); a != 0 {
+        t.Fatalf("ascent on descent: %v", a)
+    }
+}
+
+func TestRouteCheckpoints(t *testing.T) {
+
+    gpx := `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <wpt lat="55.008" lon="37.0001"><name>CP2</name></wpt>
+  <wpt lat="55.002" lon="37"><name>CP1</name></wpt>
+  <wpt lat="56" lon="37"><name>far away</name></wpt>
+  <trk><name>line</name>
+    <trkseg>
+      <trkpt lat="55.000" lon="37"/><trkpt lat="55.010" lon="37"/>
+    </trkseg>
+  </trk>
+</gpx>`
+
+    fn := filepath.Join(t.TempDir(), "route.gpx")
+
+    err := os.WriteFile(fn, []byte(gpx), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rt, err := LoadRoute(fn)
+    if err != nil {
+        t.Fatalf("failed to load route: %v", err)
+    }
+
+    if len(rt.Checkpoints) != 2 {
+        t.Fatalf("wrong checkpoints: %+v", rt.Checkpoints)
+    }
+
+    if rt.Checkpoints[0].Name != "CP1" ||
+       math.Abs(rt.Checkpoints[0].Offset - 222) > 1 ||
+       math.Abs(rt.Checkpoints[1].Offset - 890) > 1 {
+        t.Fatalf("checkpoints are not ordered along route: %+v", rt.Checkpoints)
+    }
+}
+
+func TestEta(t *testing.T) {
+
+    rt := test_hill_route()
+    rt.Checkpoints = []RouteCheckpoint{ { Name: "top", Offset: rt.points[5].Offset } }
+
+    /* 2 m/s for 5 minutes: 600 meters from start */
+    ui := test_rider(1, STATUS_MOVING, 2, 5)
+    ui.UpdateRoutePosition(rt)
+
+    snap := ui.snapshot()
+    pos := snap.Route.Position
+
+    re := make_eta(snap, rt, []float64{ 100, 1000, 5000 }, 0)
+
+    if math.Abs(re.Pace - 2) > 0.01 || re.Position != pos {
+        t.Fatalf("wrong rider state: %+v", re)
+    }
+
+    /* 100 m is passed, 5 km is beyond finish */
+    if len(re.Targets) != 4 {
+        t.Fatalf("wrong targets: %+v", re.Targets)
+    }
+
+    if !re.Targets[0].Passed || re.Targets[0].Eta != nil {
+        t.Fatalf("passed target has eta: %+v", re.Targets[0])
+    }
+
+    km := re.Targets[1]
+    if km.Kind != ETA_KM || math.Abs(km.Distance - (1000 - pos)) > 0.001 ||
+       math.Abs(km.Eta.Sub(snap.Last).Seconds() - (1000 - pos) / 2) > 1 {
+        t.Fatalf("wrong eta to km: %+v", km)
+    }
+
+    if re.Targets[2].Kind != ETA_CHECKPOINT || !re.Targets[2].Passed {
+        t.Fatalf("wrong checkpoint: %+v", re.Targets[2])
+    }
+
+    fin := re.Targets[3]
+    if fin.Kind != ETA_FINISH || fin.Offset != rt.Length {
+        t.Fatalf("wrong finish: %+v", fin)
+    }
+
+    /* no climbing left to finish, nothing changes */
+    with_climb := make_eta(snap, rt, nil, 10).Targets[1]
+    if !with_climb.Eta.Equal(*fin.Eta) {
+        t.Fatalf("descent slowed rider down: %v vs %v", with_climb.Eta, fin.Eta)
+    }
+
+    /* standing at start */
+    at_start := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: snap.Last })
+    at_start.Route = &RouteProgress{}
+
+    start := make_eta(at_start, rt, nil, 10)
+    if start.Pace != 0 || start.Targets[1].Eta != nil {
+        t.Fatalf("eta without pace: %+v", start)
+    }
+
+    /* 50 meters up cost 500 seconds */
+    eta, ok := estimate_arrival(at_start, rt, rt.Length, 2, 10)
+    if !ok || math.Abs(eta.Sub(snap.Last).Seconds() - (rt.Length / 2 + 500)) > 1 {
+        t.Fatalf("wrong climb adjusted eta: %v", eta)
+    }
+
+    /* finished riders are not expected anywhere */
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_FINISHED })
+
+    re = make_eta(ui.snapshot(), rt, nil, 0)
+    if re.Pace != 0 || re.Targets[len(re.Targets) - 1].Eta != nil {
+        t.Fatalf("eta for finished rider: %+v", re)
+    }
+
+    if re = make_eta(snap, nil, []float64{ 1000 }, 0); len(re.Targets) != 0 {
+        t.Fatalf("targets without route: %+v", re)
+    }
+}
+
+func TestFindRider(t *testing.T) {
+
+    users := []*UserInfo{
+        { UserID: 10, UserName: "Ivan Petrov" },
+        { UserID: 20, UserName: "Ivan" },
+        { UserID: 30, UserName: "Maria Ivanova" },
+        { UserID: 40, UserName: "Petr Sidorov" },
+    }
+
+    tests := []struct {
+        query  string
+        id     int64
+    } {
+        { "20", 20 },
+        { "Ivan", 20 },
+        { "petrov", 10 },
+        { " sidorov ", 40 },
+        { "ivan", 0 },
+        { "nobody", 0 },
+        { "", 0 },
+    }
+
+    for _, test := range tests {
+        ui, err := find_rider(users, test.query)
+
+        if test.id == 0 {
+            if err == nil {
+                t.Fatalf("'%s': found %+v", test.query, ui)
+            }
+            continue
+        }
+
+        if err != nil || ui.UserID != test.id {
+            t.Fatalf("'%s': got %+v, %v", test.query, ui, err)
+        }
+    }
+}
+
+func TestEtaArgs(t *testing.T) {
+
+    tests := []struct {
+        args    string
+        query   string
+        offset  float64
+    } {
+        { "", "", -1 },
+        { "12345", "12345", -1 },
+        { "150km", "", 150000 },
+        { "150 km", "", 150000 },
+        { "150.5КМ", "", 150500 },
+        { "12345 150", "12345", 150000 },
+        { "Ivan Petrov 150", "Ivan Petrov", 150000 },
+        { "Ivan Petrov 150 km", "Ivan Petrov", 150000 },
+        { "Ivan Petrov", "Ivan Petrov", -1 },
+        { "km", "km", -1 },
+    }
+
+    for _, test := range tests {
+        query, offset := parse_eta_args(strings.Fields(test.args))
+
+        if query != test.query || offset != test.offset {
+            t.Fatalf("'%s': got '%s' at %v", test.args, query, offset)
+        }
+    }
+}
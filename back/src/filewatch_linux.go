@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "strings"
+    "syscall"
+    "unsafe"
+    "path/filepath"
+)
+
+/*
+ * calls changed() every time file is written or replaced; directory is
+ * watched, since file is replaced by rename. Returns only on error
+ */
+func watch_file(file string, changed func()) error {
+
+    fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+    if err != nil {
+        return err
+    }
+
+    defer syscall.Close(fd)
+
+    dir, name := filepath.Split(file)
+    if len(dir) == 0 {
+        dir = "."
+    }
+
+    _, err = syscall.InotifyAddWatch(fd, dir,
+                                     syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+    if err != nil {
+        return err
+    }
+
+    buf := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+
+    for {
+        n, err := syscall.Read(fd, buf)
+        if err == syscall.EINTR {
+            continue
+        }
+
+        if err != nil {
+            return err
+        }
+
+        hit := false
+
+        for off := 0; off + syscall.SizeofInotifyEvent <= n; {
+            ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+
+            start := off + syscall.SizeofInotifyEvent
+            off = start + int(ev.Len)
+
+            if off > n {
+                break
+            }
+
+            if strings.TrimRight(string(buf[start:off]), "\x00") == name {
+                hit = true
+            }
+        }
+
+        if hit {
+            changed()
+        }
+    }
+}
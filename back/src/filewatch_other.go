@@ -0,0 +1,62 @@
+//go:build !linux
+
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "os"
+    "time"
+)
+
+/* no inotify, file is checked that often */
+const FileWatchPoll = 2 * time.Second
+
+/* calls changed() every time file is written or replaced */
+func watch_file(file string, changed func()) error {
+
+    var mtime time.Time
+    var size int64
+
+    if fi, err := os.Stat(file); err == nil {
+        mtime = fi.ModTime()
+        size = fi.Size()
+    }
+
+    for {
+        time.Sleep(FileWatchPoll)
+
+        fi, err := os.Stat(file)
+        if err != nil {
+            continue
+        }
+
+        if fi.ModTime().Equal(mtime) && fi.Size() == size {
+            continue
+        }
+
+        mtime = fi.ModTime()
+        size = fi.Size()
+
+        changed()
+    }
+}
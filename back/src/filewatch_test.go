@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "os"
+    "time"
+    "testing"
+    "path/filepath"
+)
+
+func TestWatchFile(t *testing.T) {
+
+    dir := t.TempDir()
+    file := filepath.Join(dir, "people.json")
+
+    changed := make(chan struct{}, 16)
+
+    go watch_file(file, func() { changed <- struct{}{} })
+
+    /* let watch be set up */
+    time.Sleep(100 * time.Millisecond)
+
+    /* other files in directory are ignored */
+    os.WriteFile(filepath.Join(dir, "other.json"), []byte("[]"), 0644)
+
+    /* file is replaced the same way bot saves it */
+    tmp := filepath.Join(dir, "tmp")
+    os.WriteFile(tmp, []byte("[{}]"), 0644)
+    os.Rename(tmp, file)
+
+    select {
+    case <-changed:
+    case <-time.After(10 * time.Second):
+        t.Fatalf("replaced file is not noticed")
+    }
+
+    select {
+    case <-changed:
+        t.Fatalf("unrelated change is reported")
+    case <-time.After(100 * time.Millisecond):
+    }
+}
@@ -0,0 +1,485 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+/* outcome of subscription */
+const (
+    SUB_NEW = iota        /* fresh client without Last-Event-ID */
+    SUB_RESUMED           /* missed updates are queued for client */
+    SUB_RESYNC            /* gap is too old to replay, client must bootstrap */
+)
+
+/*
+ * Broadcast hub for event source clients.
+ *
+ * Every client keeps at most one pending update per user: a newer update
+ * replaces older queued one, so memory used by a slow client is bounded
+ * by the number of users.  Clients are woken up via notify channel.
+ *
+ * Clients in delta mode receive UserDelta instead of full UserInfo;
+ * queued deltas of the same user are merged.
+ *
+ * Each published update gets a sequence number; event ids sent to clients
+ * are "<epoch>-<seq>", where epoch identifies this hub instance, so ids
+ * issued before restart are never mistaken for current ones.
+ *
+ * Clients resuming with Last-Event-ID get the latest update of every
+ * user changed since, like a slow client would; so the replay log keeps
+ * one update per user, and any gap since the last resync is replayed
+ * whatever the load is.
+ *
+ * Standings are sent to all clients when order of riders changes;
+ * they carry no event id and are not replayed: every subscriber
+ * starts with the current standings instead.
+ *
+ * When users are replaced as a whole, clients are asked to bootstrap
+ * again; resync takes a sequence number, so clients resuming from
+ * earlier events are asked as well.
+ */
+type Hub struct {
+    mu       sync.Mutex
+    clients  map[*Client]struct{}
+
+    epoch    int64
+    seq      uint64
+
+    /* the latest update of every user since resync at seq floor */
+    replay   map[int64]HubUpdate
+    floor    uint64
+
+    /* last standings sent to clients */
+    standings []Standing
+}
+
+/*
+ * partial user update for event source clients in delta mode,
+ * only changed fields are present; Finish is meaningful only while
+ * MovingState is finished
+ */
+type UserDelta struct {
+    UserID       int64
+    UserName     string      `json:",omitempty"`
+    Status       string      `json:",omitempty"`
+    MovingState  string      `json:",omitempty"`
+    Pos         *GeoPos      `json:",omitempty"`
+    Last        *time.Time   `json:",omitempty"`
+    Route       *RouteProgress `json:",omitempty"`
+    CheckIns     []CheckIn     `json:",omitempty"`
+    Finish      *time.Time     `json:",omitempty"`
+    Start       *time.Time     `json:",omitempty"`
+    Distance     float64       `json:",omitempty"`
+    MovingTime   float64       `json:",omitempty"`
+    OffCourse   *bool          `json:",omitempty"`
+}
+
+type HubUpdate struct {
+    seq      uint64
+    ui      *UserInfo
+    delta   *UserDelta
+}
+
+type Client struct {
+    id       string
+    realip   string
+
+    /* event id of stream position at the moment of subscription */
+    start    string
+
+    /* client wants UserDelta instead of UserInfo */
+    delta    bool
+
+    /* receives a token when there are pending updates */
+    notify   chan struct{}
+
+    mu       sync.Mutex
+    pending  map[int64]HubUpdate
+    order    []int64
+
+    /* standings not yet sent, nil if none */
+    standings []Standing
+
+    /* sequence number of pending resync request, zero if none */
+    resync   uint64
+}
+
+
+func CreateHub() *Hub {
+    return &Hub{
+        clients: make(map[*Client]struct{}),
+        epoch: time.Now().UnixNano(),
+        replay: make(map[int64]HubUpdate),
+    }
+}
+
+func (h *Hub) event_id(seq uint64) string {
+    return fmt.Sprintf("%d-%d", h.epoch, seq)
+}
+
+func parse_event_id(id string) (int64, uint64, error) {
+
+    var epoch int64
+    var seq uint64
+
+    n, err := fmt.Sscanf(id, "%d-%d", &epoch, &seq)
+    if err != nil || n != 2 {
+        return 0, 0, fmt.Errorf("malformed event id '%s'", id)
+    }
+
+    return epoch, seq, nil
+}
+
+/*
+ * Registers client; if last_id is not empty, users updated after it
+ * are queued for client, unless there was resync since.
+ */
+func (h *Hub) subscribe(id string, realip string, last_id string,
+                        delta bool) (*Client, int) {
+
+    cln := new(Client)
+
+    cln.id = id
+    cln.realip = realip
+    cln.delta = delta
+    cln.notify = make(chan struct{}, 1)
+    cln.pending = make(map[int64]HubUpdate)
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.clients[cln] = struct{}{}
+    cln.start = h.event_id(h.seq)
+
+    if h.standings != nil {
+        cln.push_standings(h.standings)
+    }
+
+    if len(last_id) == 0 {
+        return cln, SUB_NEW
+    }
+
+    epoch, seq, err := parse_event_id(last_id)
+    if err != nil || epoch != h.epoch || seq > h.seq {
+        return cln, SUB_RESYNC
+    }
+
+    if seq == h.seq {
+        /* nothing missed */
+        return cln, SUB_RESUMED
+    }
+
+    if seq < h.floor {
+        /* missed updates were dropped with resync */
+        return cln, SUB_RESYNC
+    }
+
+    var missed []HubUpdate
+
+    for _, u := range h.replay {
+        if u.seq > seq {
+            missed = append(missed, u)
+        }
+    }
+
+    sort.Slice(missed, func(i, j int) bool {
+        return missed[i].seq < missed[j].seq
+    })
+
+    /* earlier changes of user are missed too, delta is complete */
+    for _, u := range missed {
+        u.delta = delta_from_user(u.ui)
+        cln.push(u)
+    }
+
+    return cln, SUB_RESUMED
+}
+
+func (h *Hub) unsubscribe(cln *Client) {
+    h.mu.Lock()
+    delete(h.clients, cln)
+    h.mu.Unlock()
+}
+
+func (h *Hub) count() int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    return len(h.clients)
+}
+
+/*
+ * send a copy of user state to every subscribed client;
+ * delta describes what has changed, nil means everything
+ */
+func (h *Hub) publish(ui *UserInfo, delta *UserDelta) {
+
+    snap := ui.snapshot()
+
+    if delta == nil {
+        delta = delta_from_user(snap)
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.seq += 1
+
+    u := HubUpdate{ seq: h.seq, ui: snap, delta: delta }
+
+    h.replay[snap.UserID] = u
+
+    for cln := range h.clients {
+        cln.push(u)
+    }
+}
+
+/* users were replaced, every client has to bootstrap again */
+func (h *Hub) resync() {
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.seq += 1
+
+    /* earlier updates are not valid on top of new state */
+    h.replay = make(map[int64]HubUpdate)
+    h.floor = h.seq
+
+    for cln := range h.clients {
+        cln.push_resync(h.seq)
+    }
+}
+
+/* send standings to every client, if order of riders has changed */
+func (h *Hub) publish_standings(st []Standing) bool {
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if h.standings != nil && same_order(h.standings, st) {
+        return false
+    }
+
+    h.standings = st
+
+    for cln := range h.clients {
+        cln.push_standings(st)
+    }
+
+    return true
+}
+
+func (cln *Client) push(u HubUpdate) {
+
+    id := u.ui.UserID
+
+    cln.mu.Lock()
+
+    prev, ok := cln.pending[id]
+    if !ok {
+        cln.order = append(cln.order, id)
+
+    } else if cln.delta {
+        u.delta = merge_delta(prev.delta, u.delta)
+    }
+
+    cln.pending[id] = u
+
+    cln.mu.Unlock()
+
+    /* never blocks: a token already queued is enough to wake reader */
+    select {
+    case cln.notify <- struct{}{}:
+    default:
+    }
+}
+
+/* standings are shared between clients, never modified */
+func (cln *Client) push_standings(st []Standing) {
+
+    cln.mu.Lock()
+    cln.standings = st
+    cln.mu.Unlock()
+
+    select {
+    case cln.notify <- struct{}{}:
+    default:
+    }
+}
+
+/* pending updates are superseded by bootstrap */
+func (cln *Client) push_resync(seq uint64) {
+
+    cln.mu.Lock()
+    cln.resync = seq
+    cln.pending = make(map[int64]HubUpdate)
+    cln.order = cln.order[:0]
+    cln.mu.Unlock()
+
+    select {
+    case cln.notify <- struct{}{}:
+    default:
+    }
+}
+
+/* take pending resync request, zero if there is none */
+func (cln *Client) drain_resync() uint64 {
+
+    cln.mu.Lock()
+    defer cln.mu.Unlock()
+
+    seq := cln.resync
+    cln.resync = 0
+
+    return seq
+}
+
+/* take pending standings, nil if there are none */
+func (cln *Client) drain_standings() []Standing {
+
+    cln.mu.Lock()
+    defer cln.mu.Unlock()
+
+    st := cln.standings
+    cln.standings = nil
+
+    return st
+}
+
+/*
+ * take all pending updates (*UserInfo or *UserDelta, depending on mode),
+ * in order of arrival, and sequence number of the most recent of them
+ */
+func (cln *Client) drain() ([]interface{}, uint64) {
+
+    cln.mu.Lock()
+    defer cln.mu.Unlock()
+
+    var last uint64
+
+    out := make([]interface{}, 0, len(cln.order))
+
+    for _, id := range cln.order {
+        u := cln.pending[id]
+
+        if cln.delta {
+            out = append(out, u.delta)
+        } else {
+            out = append(out, u.ui)
+        }
+        if u.seq > last {
+            last = u.seq
+        }
+
+        delete(cln.pending, id)
+    }
+
+    cln.order = cln.order[:0]
+
+    return out, last
+}
+
+/* delta carrying complete user state, for users new to clients */
+func delta_from_user(ui *UserInfo) *UserDelta {
+
+    d := new(UserDelta)
+
+    pos := ui.Pos
+    last := ui.Last
+
+    d.UserID = ui.UserID
+    d.UserName = ui.UserName
+    d.Status = ui.Status
+    d.MovingState = ui.MovingState
+    d.Pos = &pos
+    d.Last = &last
+    d.Route = ui.Route
+    d.CheckIns = ui.CheckIns
+    d.Finish = ui.Finish
+    d.Start = ui.Start
+    d.Distance = ui.Distance
+    d.MovingTime = ui.MovingTime
+    off := ui.OffCourse
+    d.OffCourse = &off
+
+    return d
+}
+
+/* newer fields win; deltas are shared between clients, never modified */
+func merge_delta(old *UserDelta, upd *UserDelta) *UserDelta {
+
+    d := *old
+
+    if len(upd.UserName) != 0 {
+        d.UserName = upd.UserName
+    }
+
+    if len(upd.Status) != 0 {
+        d.Status = upd.Status
+    }
+
+    if len(upd.MovingState) != 0 {
+        d.MovingState = upd.MovingState
+    }
+
+    if upd.Pos != nil {
+        d.Pos = upd.Pos
+    }
+
+    if upd.Last != nil {
+        d.Last = upd.Last
+    }
+
+    if upd.Route != nil {
+        d.Route = upd.Route
+    }
+
+    if upd.CheckIns != nil {
+        d.CheckIns = upd.CheckIns
+    }
+
+    if upd.Finish != nil {
+        d.Finish = upd.Finish
+    }
+
+    if upd.Start != nil {
+        d.Start = upd.Start
+    }
+
+    if upd.OffCourse != nil {
+        d.OffCourse = upd.OffCourse
+    }
+
+    /* totals come with every position */
+    if upd.Pos != nil {
+        d.Distance = upd.Distance
+        d.MovingTime = upd.MovingTime
+    }
+
+    return &d
+}
@@ -0,0 +1,422 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "encoding/json"
+)
+
+func TestHubCoalesce(t *testing.T) {
+
+    hub := CreateHub()
+    cln, _ := hub.subscribe("test", "", "", false)
+
+    a := createUser(nil, &UserPosition{UserName: "a", Lat: 1})
+    b := createUser(nil, &UserPosition{UserName: "b", Lat: 1})
+    a.UserID = 1
+    b.UserID = 2
+
+    for i := 0; i < 100; i++ {
+        a.UpdatePosition(&UserPosition{Lat: float64(i)})
+        hub.publish(a, nil)
+        hub.publish(b, nil)
+    }
+
+    select {
+    case <-cln.notify:
+    default:
+        t.Fatalf("client was not notified")
+    }
+
+    out, _ := cln.drain()
+    if len(out) != 2 {
+        t.Fatalf("expected 2 merged updates, got %d", len(out))
+    }
+
+    if ui := out[0].(*UserInfo); ui.UserID != 1 || ui.Pos.Lat != 99 {
+        t.Fatalf("merged update is not the latest: %+v", out[0])
+    }
+
+    if out, _ := cln.drain(); len(out) != 0 {
+        t.Fatalf("drain left pending updates")
+    }
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+
+    hub := CreateHub()
+
+    c1, _ := hub.subscribe("c1", "", "", false)
+    c2, _ := hub.subscribe("c2", "", "", false)
+
+    if hub.count() != 2 {
+        t.Fatalf("expected 2 clients, got %d", hub.count())
+    }
+
+    hub.unsubscribe(c1)
+
+    ui := createUser(nil, nil)
+    ui.UserID = 1
+    hub.publish(ui, nil)
+
+    if out, _ := c1.drain(); len(out) != 0 {
+        t.Fatalf("unsubscribed client got update")
+    }
+
+    if out, _ := c2.drain(); len(out) != 1 {
+        t.Fatalf("subscribed client missed update")
+    }
+}
+
+func TestHubConcurrent(t *testing.T) {
+
+    var wg sync.WaitGroup
+
+    hub := CreateHub()
+
+    users := test_hub_users(hub, 20)
+
+    for c := 0; c < 10; c++ {
+        wg.Add(1)
+
+        go func(c int) {
+            defer wg.Done()
+
+            cln, _ := hub.subscribe(fmt.Sprintf("c%d", c), "", "", false)
+            defer hub.unsubscribe(cln)
+
+            for i := 0; i < 200; i++ {
+                <-cln.notify
+                if out, _ := cln.drain(); len(out) > len(users) {
+                    t.Errorf("client queue is not bounded")
+                    return
+                }
+            }
+        }(c)
+    }
+
+    for p := 0; p < 4; p++ {
+        wg.Add(1)
+
+        go func() {
+            defer wg.Done()
+
+            for i := 0; i < 2000; i++ {
+                ui := users[i % len(users)]
+                ui.UpdatePosition(&UserPosition{Lat: float64(i), Lon: 1})
+                hub.publish(ui, nil)
+            }
+        }()
+    }
+
+    /* keep publishing until all readers are done */
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    for {
+        select {
+        case <-done:
+            return
+        default:
+            hub.publish(users[0], nil)
+        }
+    }
+}
+
+func test_hub_users(hub *Hub, n int) []*UserInfo {
+
+    users := make([]*UserInfo, n)
+
+    for i := range users {
+        users[i] = createUser(nil, nil)
+        users[i].UserID = int64(i + 1)
+    }
+
+    return users
+}
+
+func TestHubResume(t *testing.T) {
+
+    hub := CreateHub()
+    users := test_hub_users(hub, 3)
+
+    hub.publish(users[0], nil)
+
+    cln, mode := hub.subscribe("c", "", "", false)
+    if mode != SUB_NEW {
+        t.Fatalf("expected new subscription, got %d", mode)
+    }
+
+    hub.publish(users[1], nil)
+
+    _, seq := cln.drain()
+    hub.unsubscribe(cln)
+
+    /* missed while disconnected */
+    hub.publish(users[2], nil)
+    hub.publish(users[1], nil)
+
+    cln, mode = hub.subscribe("c", "", hub.event_id(seq), false)
+    if mode != SUB_RESUMED {
+        t.Fatalf("expected resumed subscription, got %d", mode)
+    }
+
+    out, last := cln.drain()
+    if len(out) != 2 || out[0].(*UserInfo).UserID != 3 ||
+       out[1].(*UserInfo).UserID != 2 {
+        t.Fatalf("wrong replay: %+v", out)
+    }
+
+    if last != 4 {
+        t.Fatalf("expected last seq 4, got %d", last)
+    }
+
+    /* up to date client gets nothing replayed */
+    cln, mode = hub.subscribe("c", "", hub.event_id(last), false)
+    if mode != SUB_RESUMED {
+        t.Fatalf("expected resumed subscription, got %d", mode)
+    }
+
+    if out, _ := cln.drain(); len(out) != 0 {
+        t.Fatalf("unexpected replay: %+v", out)
+    }
+
+    if cln.start != hub.event_id(last) {
+        t.Fatalf("wrong stream start %s", cln.start)
+    }
+
+    /* race load: 500 riders, fix every 5 s, client is away for 2 minutes */
+    users = test_hub_users(hub, 500)
+
+    for _, ui := range users {
+        hub.publish(ui, nil)
+    }
+
+    /* the last event client got */
+    seq = hub.seq
+
+    for round := 0; round < 24; round++ {
+        for _, ui := range users[:400] {
+            ui.UpdatePosition(&UserPosition{ Lat: float64(round), Lon: 1 })
+            hub.publish(ui, &UserDelta{ UserID: ui.UserID,
+                                        Pos: &GeoPos{ Lat: float64(round) } })
+        }
+    }
+
+    cln, mode = hub.subscribe("c", "", hub.event_id(seq), true)
+    if mode != SUB_RESUMED {
+        t.Fatalf("expected resumed subscription under load, got %d", mode)
+    }
+
+    out, _ = cln.drain()
+    if len(out) != 400 {
+        t.Fatalf("expected 400 missed riders, got %d", len(out))
+    }
+
+    /* replayed delta is complete, not only the last change */
+    if d := out[0].(*UserDelta); d.Pos == nil || d.Pos.Lat != 23 ||
+       len(d.MovingState) == 0 {
+        t.Fatalf("wrong replayed delta: %+v", d)
+    }
+
+    if len(hub.replay) != len(users) {
+        t.Fatalf("replay log is not bounded by users: %d", len(hub.replay))
+    }
+}
+
+func TestHubResync(t *testing.T) {
+
+    hub := CreateHub()
+    users := test_hub_users(hub, 1)
+
+    for i := 0; i < 10; i++ {
+        hub.publish(users[0], nil)
+    }
+
+    hub.resync()
+
+    for i := 0; i < 10; i++ {
+        hub.publish(users[0], nil)
+    }
+
+    ids := []string {
+        hub.event_id(5),                           /* before resync */
+        hub.event_id(100),                         /* from the future */
+        fmt.Sprintf("%d-%d", hub.epoch + 1, 20),   /* previous instance */
+        "garbage",
+    }
+
+    for _, id := range ids {
+        _, mode := hub.subscribe("c", "", id, false)
+        if mode != SUB_RESYNC {
+            t.Fatalf("id %s: expected resync, got %d", id, mode)
+        }
+    }
+
+    /* right after resync */
+    cln, mode := hub.subscribe("c", "", hub.event_id(11), false)
+    if out, _ := cln.drain(); mode != SUB_RESUMED || len(out) != 1 {
+        t.Fatalf("expected resumed subscription, got %d, %+v", mode, out)
+    }
+}
+
+func TestHubReload(t *testing.T) {
+
+    hub := CreateHub()
+    users := test_hub_users(hub, 2)
+
+    hub.publish(users[0], nil)
+
+    cln, _ := hub.subscribe("c", "", "", false)
+    _, seq := cln.drain()
+
+    hub.publish(users[1], nil)
+    hub.resync()
+
+    /* pending update is dropped, client bootstraps instead */
+    rs := cln.drain_resync()
+    if out, _ := cln.drain(); rs == 0 || len(out) != 0 {
+        t.Fatalf("resync is not requested: %d, %+v", rs, out)
+    }
+
+    if cln.drain_resync() != 0 {
+        t.Fatalf("resync is requested twice")
+    }
+
+    /* client missed resync while disconnected */
+    _, mode := hub.subscribe("c", "", hub.event_id(seq), false)
+    if mode != SUB_RESYNC {
+        t.Fatalf("expected resync, got %d", mode)
+    }
+
+    /* client resumes right after resync */
+    hub.publish(users[0], nil)
+
+    c2, mode := hub.subscribe("c", "", hub.event_id(rs), false)
+    if out, _ := c2.drain(); mode != SUB_RESUMED || len(out) != 1 {
+        t.Fatalf("resume after resync failed: %d, %+v", mode, out)
+    }
+}
+
+func TestHubDelta(t *testing.T) {
+
+    hub := CreateHub()
+    users := test_hub_users(hub, 2)
+
+    full, _ := hub.subscribe("full", "", "", false)
+    cln, _ := hub.subscribe("delta", "", "", true)
+
+    /* first time everything is sent */
+    hub.publish(users[0], nil)
+
+    out, _ := cln.drain()
+    if d := out[0].(*UserDelta); d.Pos == nil || d.Last == nil {
+        t.Fatalf("new user delta is not complete: %+v", d)
+    }
+
+    hub.publish(users[0], &UserDelta{ UserID: 1, Status: "flat" })
+    hub.publish(users[1], &UserDelta{ UserID: 2, MovingState: STATUS_DNF })
+    hub.publish(users[0], &UserDelta{ UserID: 1, Pos: &GeoPos{ Lat: 5 } })
+    hub.publish(users[0], &UserDelta{ UserID: 1, Pos: &GeoPos{ Lat: 6 } })
+
+    out, _ = cln.drain()
+    if len(out) != 2 {
+        t.Fatalf("expected 2 merged deltas, got %d", len(out))
+    }
+
+    d := out[0].(*UserDelta)
+    if d.UserID != 1 || d.Status != "flat" || d.Pos.Lat != 6 ||
+       len(d.MovingState) != 0 || d.Last != nil {
+        t.Fatalf("wrong merged delta: %+v", d)
+    }
+
+    txt, err := json.Marshal(out[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(txt) != `{"UserID":2,"MovingState":"status_dnf"}` {
+        t.Fatalf("delta carries unchanged fields: %s", txt)
+    }
+
+    /* full clients are not affected */
+    out, _ = full.drain()
+    if len(out) != 2 || out[0].(*UserInfo).UserID != 1 {
+        t.Fatalf("full client got wrong updates: %+v", out)
+    }
+}
+
+func TestHubStandings(t *testing.T) {
+
+    hub := CreateHub()
+    cln, _ := hub.subscribe("test", "", "", true)
+
+    st := []Standing{ { Rank: 1, UserID: 1 }, { Rank: 2, UserID: 2 } }
+
+    if !hub.publish_standings(st) {
+        t.Fatalf("first standings are not published")
+    }
+
+    /* same order, gaps changed */
+    moved := []Standing{ { Rank: 1, UserID: 1 }, { Rank: 2, UserID: 2, Gap: 5 } }
+
+    if hub.publish_standings(moved) {
+        t.Fatalf("standings published without order change")
+    }
+
+    <-cln.notify
+
+    if out, _ := cln.drain(); len(out) != 0 {
+        t.Fatalf("standings mixed with updates: %+v", out)
+    }
+
+    if got := cln.drain_standings(); !same_order(got, st) {
+        t.Fatalf("wrong standings: %+v", got)
+    }
+
+    if cln.drain_standings() != nil {
+        t.Fatalf("standings are sent twice")
+    }
+
+    /* new subscribers start with current standings */
+    late, _ := hub.subscribe("late", "", "", true)
+
+    if got := late.drain_standings(); !same_order(got, st) {
+        t.Fatalf("late client got no standings: %+v", got)
+    }
+
+    swapped := []Standing{ { Rank: 1, UserID: 2 }, { Rank: 2, UserID: 1 } }
+
+    if !hub.publish_standings(swapped) {
+        t.Fatalf("order change is not published")
+    }
+
+    if got := cln.drain_standings(); !same_order(got, swapped) {
+        t.Fatalf("wrong standings after change: %+v", got)
+    }
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "errors"
+    "encoding/json"
+    "path/filepath"
+)
+
+/* states of incident, in order of handling */
+const (
+    INCIDENT_OPEN = "open"
+    INCIDENT_ACKED = "acknowledged"
+    INCIDENT_ENROUTE = "enroute"
+    INCIDENT_RESOLVED = "resolved"
+)
+
+/*
+ * incident reported by rider with fall or road incident status;
+ * Pos and Last is where and when rider was seen, Position is
+ * distance along route, Handler is organizer who took care of it.
+ * Also sent from bot to webmap as json update.
+ */
+type Incident struct {
+    ID        int64
+    UserID    int64
+    UserName  string
+    Kind      string
+    Time      time.Time
+    Pos       GeoPos
+    Last      time.Time
+    Position  float64     `json:",omitempty"`
+    State     string
+    Handler   string      `json:",omitempty"`
+    Updated   time.Time
+}
+
+/* incidents, ordered by id, serialized to/from file */
+type IncidentDb struct {
+    mu        sync.Mutex
+    list      []*Incident
+    File      string
+
+    /* serializes writers of File */
+    save_mu   sync.Mutex
+}
+
+/* by default incidents are kept next to state file */
+func incident_file(conf *UserConfig) string {
+
+    if len(conf.IncidentFile) != 0 {
+        return conf.IncidentFile
+    }
+
+    return filepath.Join(filepath.Dir(conf.StateFile), "incidents.json")
+}
+
+func is_incident_status(status string) bool {
+    return status == STATUS_FALL || status == STATUS_INCIDENT
+}
+
+func CreateIncidentDb(file string) (*IncidentDb, error) {
+
+    db := &IncidentDb{ File: file }
+
+    txt, err := os.ReadFile(file)
+    if errors.Is(err, os.ErrNotExist) {
+        log.Printf("no incidents file '%s', starting empty", file)
+        return db, nil
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    err = json.Unmarshal(txt, &db.list)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse incidents: %v", err)
+    }
+
+    log.Printf("incidents file loaded, %d incidents found", len(db.list))
+
+    return db, nil
+}
+
+func (db *IncidentDb) find(id int64) *Incident {
+
+    for _, inc := range db.list {
+        if inc.ID == id {
+            return inc
+        }
+    }
+
+    return nil
+}
+
+/*
+ * new incident of user (snapshot); if user has one not resolved yet,
+ * it is returned instead; tells if incident is new
+ */
+func (db *IncidentDb) open(ui *UserInfo, kind string,
+                           now time.Time) (Incident, bool) {
+
+    db.mu.Lock()
+    defer db.mu.Unlock()
+
+    var id int64
+
+    for _, inc := range db.list {
+        if inc.UserID == ui.UserID && inc.State != INCIDENT_RESOLVED {
+            return *inc, false
+        }
+
+        if inc.ID > id {
+            id = inc.ID
+        }
+    }
+
+    inc := &Incident{
+        ID: id + 1,
+        UserID: ui.UserID,
+        UserName: ui.UserName,
+        Kind: kind,
+        Time: now,
+        Pos: ui.Pos,
+        Last: ui.Last,
+        State: INCIDENT_OPEN,
+        Updated: now,
+    }
+
+    if ui.Route != nil {
+        inc.Position = ui.Route.Position
+    }
+
+    db.list = append(db.list, inc)
+
+    log.Printf("incident %d opened for user %s: %s", inc.ID, ui.UserName, kind)
+
+    return *inc, true
+}
+
+/* organizer moves incident further; resolved incidents are closed */
+func (db *IncidentDb) update(id int64, state string, handler string,
+                             now time.Time) (Incident, error) {
+
+    db.mu.Lock()
+    defer db.mu.Unlock()
+
+    inc := db.find(id)
+    if inc == nil {
+        return Incident{}, fmt.Errorf("no incident %d", id)
+    }
+
+    switch state {
+    case INCIDENT_ACKED, INCIDENT_ENROUTE, INCIDENT_RESOLVED:
+    default:
+        return *inc, fmt.Errorf("bad incident state '%s'", state)
+    }
+
+    if inc.State == INCIDENT_RESOLVED {
+        return *inc, fmt.Errorf("incident %d is resolved already", id)
+    }
+
+    inc.State = state
+    inc.Handler = handler
+    inc.Updated = now
+
+    log.Printf("incident %d is %s by %s", id, state, handler)
+
+    return *inc, nil
+}
+
+/* incident reported by bot */
+func (db *IncidentDb) put(inc Incident) {
+
+    db.mu.Lock()
+    defer db.mu.Unlock()
+
+    if old := db.find(inc.ID); old != nil {
+        *old = inc
+        return
+    }
+
+    db.list = append(db.list, &inc)
+}
+
+/* copies of incidents; only not resolved if asked to */
+func (db *IncidentDb) snapshot(active bool) []Incident {
+
+    db.mu.Lock()
+    defer db.mu.Unlock()
+
+    out := make([]Incident, 0, len(db.list))
+
+    for _, inc := range db.list {
+        if !active || inc.State != INCIDENT_RESOLVED {
+            out = append(out, *inc)
+        }
+    }
+
+    return out
+}
+
+func (db *IncidentDb) save(tmpdir string) error {
+
+    db.save_mu.Lock()
+    defer db.save_mu.Unlock()
+
+    txt, err := json.Marshal(db.snapshot(false))
+    if err != nil {
+        return fmt.Errorf("failed to export JSON: %v", err)
+    }
+
+    f, err := os.CreateTemp(tmpdir, "")
+    if err != nil {
+        return fmt.Errorf("failed to open temp file: %v", err)
+    }
+
+    _, err = f.Write(txt)
+    if err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = f.Close()
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = os.Rename(f.Name(), db.File)
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    return nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+    "path/filepath"
+)
+
+func TestIncidentFile(t *testing.T) {
+
+    conf := UserConfig{ StateFile: "/var/livemogt/people.json" }
+
+    if f := incident_file(&conf); f != "/var/livemogt/incidents.json" {
+        t.Fatalf("wrong default file: %s", f)
+    }
+
+    conf.IncidentFile = "/tmp/inc.json"
+
+    if f := incident_file(&conf); f != "/tmp/inc.json" {
+        t.Fatalf("wrong file: %s", f)
+    }
+}
+
+func TestIncidents(t *testing.T) {
+
+    dir := t.TempDir()
+
+    db, err := CreateIncidentDb(filepath.Join(dir, "incidents.json"))
+    if err != nil {
+        t.Fatalf("failed to create db: %v", err)
+    }
+
+    ui := createUser(nil, &UserPosition{ UserName: "rider", Lat: 55, Lon: 37,
+                                         Last: time.Unix(100, 0) })
+    ui.UserID = 42
+    ui.Route = &RouteProgress{ Position: 1500 }
+
+    now := time.Unix(200, 0)
+
+    inc, created := db.open(ui, STATUS_FALL, now)
+    if !created || inc.ID != 1 || inc.UserID != 42 || inc.Kind != STATUS_FALL ||
+       inc.State != INCIDENT_OPEN || inc.Pos.Lat != 55 || inc.Position != 1500 ||
+       !inc.Last.Equal(time.Unix(100, 0)) || !inc.Time.Equal(now) {
+        t.Fatalf("wrong incident: %+v", inc)
+    }
+
+    /* pressed twice, or changed fall to incident */
+    if again, created := db.open(ui, STATUS_INCIDENT, now); created || again.ID != 1 {
+        t.Fatalf("duplicate incident: %+v", again)
+    }
+
+    inc, err = db.update(1, INCIDENT_ACKED, "org", now.Add(time.Minute))
+    if err != nil || inc.State != INCIDENT_ACKED || inc.Handler != "org" {
+        t.Fatalf("incident is not acknowledged: %+v %v", inc, err)
+    }
+
+    if _, err = db.update(1, INCIDENT_OPEN, "org", now); err == nil {
+        t.Fatalf("incident is reopened")
+    }
+
+    if _, err = db.update(7, INCIDENT_ACKED, "org", now); err == nil {
+        t.Fatalf("unknown incident is updated")
+    }
+
+    if inc, err = db.update(1, INCIDENT_RESOLVED, "org2", now); err != nil {
+        t.Fatalf("incident is not resolved: %v", err)
+    }
+
+    if _, err = db.update(1, INCIDENT_ENROUTE, "org", now); err == nil {
+        t.Fatalf("resolved incident is updated")
+    }
+
+    /* the next one is new */
+    inc, created = db.open(ui, STATUS_INCIDENT, now)
+    if !created || inc.ID != 2 {
+        t.Fatalf("new incident is not opened: %+v", inc)
+    }
+
+    if l := db.snapshot(true); len(l) != 1 || l[0].ID != 2 {
+        t.Fatalf("wrong active incidents: %+v", l)
+    }
+
+    err = db.save(dir)
+    if err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+
+    db2, err := CreateIncidentDb(db.File)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    l := db2.snapshot(false)
+    if len(l) != 2 || l[0].State != INCIDENT_RESOLVED || l[0].Handler != "org2" ||
+       l[1].State != INCIDENT_OPEN {
+        t.Fatalf("incidents are not restored: %+v", l)
+    }
+
+    /* ids continue after restart */
+    db2.update(2, INCIDENT_RESOLVED, "org", now)
+
+    if inc, _ = db2.open(ui, STATUS_FALL, now); inc.ID != 3 {
+        t.Fatalf("wrong id after restart: %+v", inc)
+    }
+}
+
+func TestIncidentPut(t *testing.T) {
+
+    db, _ := CreateIncidentDb(filepath.Join(t.TempDir(), "incidents.json"))
+
+    db.put(Incident{ ID: 1, UserID: 42, State: INCIDENT_OPEN })
+    db.put(Incident{ ID: 2, UserID: 43, State: INCIDENT_OPEN })
+    db.put(Incident{ ID: 1, UserID: 42, State: INCIDENT_ENROUTE })
+
+    l := db.snapshot(false)
+    if len(l) != 2 || l[0].State != INCIDENT_ENROUTE || l[1].ID != 2 {
+        t.Fatalf("wrong incidents: %+v", l)
+    }
+}
@@ -24,9 +24,11 @@ import (
     "os"
     "log"
     "fmt"
-    "bytes"
+    "html"
     "time"
-    "net/http"
+    "strings"
+    "sync"
+    "strconv"
     "encoding/json"
 )
 
@@ -35,18 +37,48 @@ var i18n map[int]string;
 // https://core.telegram.org/bots/api#reactiontype
 const REACT_OK = "👌"
 
-var people *UsersDb
+/* /whereami mentions distance to route if it is larger */
+const OffRouteNotice = 100.0
+
+/* nil without route */
+var finish *FinishZone
+
+var course_rule *CourseRule
+
+var watchdog *Watchdog
+
+/* webmaps receiving updates, each with own outbox */
+var sinks []*Sink
+
+/* webmap in the same process, nil if it runs separately */
+var bus *Bus
+
+/* chats told about SOS of user, to let them know when it is cancelled */
+var sos_mu sync.Mutex
+var sos_sent = make(map[int64][]int64)
+
+/* controls riders were warned about, each warning is sent once */
+var risk_mu sync.Mutex
+var risk_warned = make(map[int64]map[int]bool)
 
 func handle_status_update(conf *UserConfig, up UserStatus) (error) {
 
+    if bus != nil {
+        bus.publish(BusMessage{ Status: &up })
+    }
+
+    if len(sinks) == 0 {
+        return nil
+    }
+
     j, err := json.Marshal(up)
     if (err != nil) {
         return fmt.Errorf("JSON creation failed: %v", err)
     }
 
-    err = send_update(conf.UpdateStatusURL, j)
+    err = push_update(sinks, UPDATE_STATUS, "", up.UserID, j, false)
     if (err != nil) {
-        return fmt.Errorf("failed to send status: %v", err)
+        return fmt.Errorf("failed to queue status: %v", err)
     }
 
     return nil
@@ -55,44 +87,775 @@ func handle_status_update(conf *UserConfig, up UserStatus) (error) {
 
 func handle_position_update(conf *UserConfig, up UserPosition) (error) {
 
+    if bus != nil {
+        bus.publish(BusMessage{ Position: &up })
+    }
+
+    if len(sinks) == 0 {
+        return nil
+    }
+
     j, err := json.Marshal(up)
     if (err != nil) {
         return fmt.Errorf("JSON creation failed: %v", err)
     }
 
-    err = send_update(conf.UpdatePositionURL, j)
+    /* position carries full state of rider, except check-ins */
+    err = push_update(sinks, UPDATE_POSITION, "", up.UserID, j,
+                      len(up.CheckIns) == 0)
     if (err != nil) {
-        return fmt.Errorf("failed to send position: %v", err)
+        return fmt.Errorf("failed to queue position: %v", err)
     }
 
     return nil
 }
 
-func send_update(url string, data []byte) error {
+func run_sinks(bot *LMBot) {
+    for _, s := range sinks {
+        go s.run(bot.ctx)
+    }
+}
 
-    req, err := http.NewRequest("POST", url, bytes.NewReader(data))
-    if (err != nil) {
-        return err
+func fmt_eta(t *EtaTarget) string {
+
+    if t.Passed {
+        return i18n[STR_ETA_PASSED]
+    }
+
+    if t.Eta == nil {
+        return i18n[STR_ETA_UNKNOWN]
+    }
+
+    eta := t.Eta.Local()
+
+    if eta.YearDay() != time.Now().YearDay() {
+        return eta.Format("02.01 15:04")
+    }
+
+    return eta.Format("15:04")
+}
+
+/* "/eta [rider] [km]": rider defaults to sender, km is optional */
+func eta_reply(conf *UserConfig, msg *LMMessage) string {
+
+    if route == nil {
+        return i18n[STR_ETA_NO_ROUTE]
+    }
+
+    args := strings.Fields(strings.TrimPrefix(msg.Text, "/eta"))
+
+    query, offset := parse_eta_args(args)
+
+    var offsets []float64
+
+    if offset >= 0 {
+        offsets = append(offsets, offset)
+    }
+
+    users := people.snapshot()
+
+    var ui *UserInfo
+
+    if len(query) == 0 {
+        for _, u := range users {
+            if u.UserID == msg.UserID {
+                ui = u
+            }
+        }
+
+        if ui == nil {
+            return i18n[STR_ETA_USAGE]
+        }
+
+    } else {
+        var err error
+
+        ui, err = find_rider(users, query)
+        if err != nil {
+            log.Printf("eta: %v", err)
+            return fmt.Sprintf(i18n[STR_FMT_ETA_NO_RIDER], html.EscapeString(query))
+        }
+    }
+
+    re := make_eta(ui, route, offsets, conf.ClimbPenalty)
+
+    s := fmt.Sprintf(i18n[STR_FMT_ETA_HEADER], html.EscapeString(re.UserName),
+                     re.Position / 1000, re.Pace * 3.6)
+
+    for i := range re.Targets {
+        t := &re.Targets[i]
+
+        switch t.Kind {
+        case ETA_KM:
+            s += "\n" + fmt.Sprintf(i18n[STR_FMT_ETA_KM], t.Offset / 1000,
+                                    fmt_eta(t))
+
+        case ETA_CHECKPOINT:
+            s += "\n" + fmt.Sprintf(i18n[STR_FMT_ETA_CHECKPOINT],
+                                    html.EscapeString(t.Name),
+                                    t.Offset / 1000, fmt_eta(t))
+
+        case ETA_FINISH:
+            s += "\n" + fmt.Sprintf(i18n[STR_FMT_ETA_FINISH], t.Offset / 1000,
+                                    fmt_eta(t))
+        }
+    }
+
+    return s
+}
+
+/* warn rider once if next control is going to close before arrival */
+func check_brevet_risk(bot *LMBot, msg *LMMessage, ui *UserInfo) {
+
+    c, idx, eta := brevet.at_risk(ui, route, bot.conf.ClimbPenalty, time.Now())
+    if c == nil {
+        return
+    }
+
+    risk_mu.Lock()
+
+    warned := risk_warned[ui.UserID]
+    if warned == nil {
+        warned = make(map[int]bool)
+        risk_warned[ui.UserID] = warned
+    }
+
+    again := warned[idx]
+    warned[idx] = true
+
+    risk_mu.Unlock()
+
+    if again {
+        return
+    }
+
+    name := c.Name
+    if c.Finish {
+        name = i18n[STR_FINISH]
+    }
+
+    var s string
+
+    /* stopped rider, arrival is unknown */
+    if eta.IsZero() {
+        s = fmt.Sprintf(i18n[STR_FMT_HTML_CONTROL_RISK_STOPPED],
+                        html.EscapeString(name), c.Km,
+                        c.Close.Local().Format("15:04"))
+    } else {
+        s = fmt.Sprintf(i18n[STR_FMT_HTML_CONTROL_RISK], html.EscapeString(name),
+                        c.Km, eta.Local().Format("15:04"),
+                        c.Close.Local().Format("15:04"))
+    }
+
+    lmbot_send_msg(bot, msg, s, true)
+
+    log.Printf("user %s warned about control '%s' closing at %v",
+               ui.UserName, name, c.Close)
+}
+
+/* congratulate user (snapshot) who just finished */
+func send_finished(bot *LMBot, msg *LMMessage, ui *UserInfo) {
+
+    if ui.Finish == nil {
+        return
     }
 
-    req.Header.Set("Content-Type", "application/json")
+    elapsed := "-"
+    if ui.Start != nil {
+        elapsed = fmt_duration(ui.elapsed(*ui.Finish))
+    }
+
+    s := fmt.Sprintf(i18n[STR_FMT_HTML_FINISHED],
+                     html.EscapeString(ui.UserName),
+                     ui.Finish.Local().Format("15:04"), elapsed)
+
+    lmbot_send_msg(bot, msg, s, true)
+}
+
+func is_organizer(conf *UserConfig, id int64) bool {
+
+    for _, org := range conf.Organizers {
+        if org == id {
+            return true
+        }
+    }
+
+    return false
+}
+
+/* "/setfinish rider time": organizers correct finish of riders */
+func setfinish_reply(conf *UserConfig, msg *LMMessage) string {
+
+    if !is_organizer(conf, msg.UserID) {
+        return i18n[STR_SETFINISH_DENIED]
+    }
 
-    client := http.Client{Timeout: 10 * time.Second}
-    res, err := client.Do(req)
+    args := strings.Fields(strings.TrimPrefix(msg.Text, "/setfinish"))
+    if len(args) < 2 {
+        return i18n[STR_SETFINISH_USAGE]
+    }
+
+    t, err := parse_finish_time(args[len(args) - 1], time.Now())
     if err != nil {
-        return err
+        return i18n[STR_SETFINISH_USAGE]
     }
 
-    log.Printf("%s => '%s': %d\n", data, url, res.StatusCode)
+    query := strings.Join(args[:len(args) - 1], " ")
 
-    return nil
+    found, err := find_rider(people.snapshot(), query)
+    if err != nil {
+        return fmt.Sprintf(i18n[STR_FMT_ETA_NO_RIDER], html.EscapeString(query))
+    }
+
+    user := people.get(found.UserID, found.UserName, false)
+    if user == nil {
+        return fmt.Sprintf(i18n[STR_FMT_ETA_NO_RIDER], html.EscapeString(query))
+    }
+
+    us, err := people.set_finish(user, t, conf.TmpDir)
+    if err != nil {
+        log.Printf("failed to update state file: %v", err)
+    }
+
+    err = handle_status_update(conf, us)
+    if err != nil {
+        log.Printf("error while sending status update: %v", err)
+    }
+
+    log.Printf("organizer %s set finish of %s to %v",
+               msg.UserName, found.UserName, t)
+
+    name := html.EscapeString(found.UserName)
+
+    if t == nil {
+        return fmt.Sprintf(i18n[STR_FMT_HTML_FINISH_CLEARED], name)
+    }
+
+    return fmt.Sprintf(i18n[STR_FMT_HTML_FINISH_SET], name,
+                       t.Local().Format("2006-01-02 15:04"))
+}
+
+/* message to organizer chat, if there is one */
+func organizer_alert(bot *LMBot, text string) {
+
+    if bot.conf.OrganizerChatId == 0 {
+        log.Printf("no organizer chat, alert is not sent: %s", text)
+        return
+    }
+
+    lmbot_send_msg(bot, &LMMessage{ ChatID: bot.conf.OrganizerChatId }, text,
+                   true)
+}
+
+/* where and when user (snapshot) was seen last time, for organizers */
+func last_position_lines(ui *UserInfo) string {
+
+    offset := -1.0
+    if ui.Route != nil {
+        offset = ui.Route.Position
+    }
+
+    return position_lines(ui.Pos, ui.Last, offset)
+}
+
+/* offset along route is negative if unknown */
+func position_lines(pos GeoPos, at time.Time, offset float64) string {
+
+    link := fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=16/%f/%f",
+                        pos.Lat, pos.Lon, pos.Lat, pos.Lon)
+
+    s := "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_LAST_POSITION],
+                            at.Local().Format("15:04"), link, pos.Lat, pos.Lon)
+
+    if route != nil && offset >= 0 {
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_ROUTE_KM],
+                                offset / 1000, route.Length / 1000)
+    }
+
+    return s
+}
+
+func incident_text(inc *Incident) string {
+
+    states := map[string]string{
+        INCIDENT_OPEN: i18n[STR_INCIDENT_OPEN],
+        INCIDENT_ACKED: i18n[STR_INCIDENT_ACKED],
+        INCIDENT_ENROUTE: i18n[STR_INCIDENT_ENROUTE],
+        INCIDENT_RESOLVED: i18n[STR_INCIDENT_RESOLVED],
+    }
+
+    s := fmt.Sprintf(i18n[STR_FMT_HTML_INCIDENT], inc.ID,
+                     get_statuses()[inc.Kind], html.EscapeString(inc.UserName),
+                     inc.Time.Local().Format("15:04"))
+
+    offset := -1.0
+    if inc.Position > 0 {
+        offset = inc.Position
+    }
+
+    s += position_lines(inc.Pos, inc.Last, offset)
+
+    s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_INCIDENT_STATE],
+                            states[inc.State])
+
+    if len(inc.Handler) != 0 {
+        s += " (" + html.EscapeString(inc.Handler) + ")"
+    }
+
+    return s
+}
+
+/* callback data is "incident_<state>_<id>" */
+func incident_buttons(inc *Incident) [][]LMButton {
+
+    if inc.State == INCIDENT_RESOLVED {
+        return nil
+    }
+
+    data := func(state string) string {
+        return fmt.Sprintf("incident_%s_%d", state, inc.ID)
+    }
+
+    return [][]LMButton{
+        {
+            { Text: i18n[STR_INCIDENT_ACK], Data: data(INCIDENT_ACKED) },
+            { Text: i18n[STR_INCIDENT_GO], Data: data(INCIDENT_ENROUTE) },
+            { Text: i18n[STR_INCIDENT_CLOSE], Data: data(INCIDENT_RESOLVED) },
+        },
+    }
+}
+
+/* keep incident on disk and let webmap know */
+func incident_changed(conf *UserConfig, inc *Incident) {
+
+    err := incidents.save(conf.TmpDir)
+    if err != nil {
+        log.Printf("failed to update incidents file: %v", err)
+    }
+
+    if bus != nil {
+        bus.publish(BusMessage{ Incident: inc })
+    }
+
+    if len(sinks) == 0 {
+        return
+    }
+
+    j, err := json.Marshal(inc)
+    if err != nil {
+        log.Printf("JSON creation failed: %v", err)
+        return
+    }
+
+    err = push_update(sinks, UPDATE_INCIDENT, "", inc.UserID, j, false)
+    if err != nil {
+        log.Printf("failed to queue incident: %v", err)
+    }
+}
+
+/* user reported fall or road incident */
+func open_incident(bot *LMBot, user *UserInfo) {
+
+    snap := user.snapshot()
+
+    inc, created := incidents.open(snap, snap.MovingState, time.Now())
+    if !created {
+        log.Printf("user %s has incident %d open already",
+                   snap.UserName, inc.ID)
+        return
+    }
+
+    incident_changed(bot.conf, &inc)
+
+    if bot.conf.OrganizerChatId == 0 {
+        log.Printf("no organizer chat, incident %d is not posted", inc.ID)
+        return
+    }
+
+    lm_bot_send_buttons(bot, &LMMessage{ ChatID: bot.conf.OrganizerChatId },
+                        incident_text(&inc), incident_buttons(&inc))
+}
+
+/* organizer pressed button of incident message */
+func incident_reply(bot *LMBot, msg *LMMessage) {
+
+    /* anybody in organizer chat can press buttons, told privately */
+    if !is_organizer(bot.conf, msg.UserID) {
+        log.Printf("user %s is not organizer, incident button ignored",
+                   msg.UserName)
+        lmbot_send_msg(bot, &LMMessage{ ChatID: msg.UserID },
+                       i18n[STR_INCIDENT_DENIED], true)
+        return
+    }
+
+    parts := strings.SplitN(msg.Status, "_", 3)
+    if len(parts) != 3 {
+        log.Printf("bad incident button '%s'", msg.Status)
+        return
+    }
+
+    id, err := strconv.ParseInt(parts[2], 10, 64)
+    if err != nil {
+        log.Printf("bad incident button '%s'", msg.Status)
+        return
+    }
+
+    inc, err := incidents.update(id, parts[1], msg.UserName, time.Now())
+    if err != nil {
+        log.Printf("incident update failed: %v", err)
+        return
+    }
+
+    incident_changed(bot.conf, &inc)
+
+    lm_bot_edit_buttons(bot, msg, incident_text(&inc), incident_buttons(&inc))
+
+    /* private chat with user has the same id */
+    rider := &LMMessage{ ChatID: inc.UserID }
+
+    switch inc.State {
+    case INCIDENT_ACKED:
+        lmbot_send_msg(bot, rider,
+                       fmt.Sprintf(i18n[STR_FMT_HTML_INCIDENT_ACKED],
+                                   html.EscapeString(inc.Handler)), true)
+
+    case INCIDENT_ENROUTE:
+        lmbot_send_msg(bot, rider,
+                       fmt.Sprintf(i18n[STR_FMT_HTML_INCIDENT_ENROUTE],
+                                   html.EscapeString(inc.Handler)), true)
+    }
+}
+
+/* periodically checks that moving riders are fine */
+func run_watchdog(bot *LMBot) {
+
+    ticker := time.NewTicker(WatchdogPeriod)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-bot.ctx.Done():
+            return
+
+        case now := <-ticker.C:
+            for _, ev := range watchdog.check(people.snapshot(), now) {
+                watch_event(bot, &ev, now)
+            }
+        }
+    }
+}
+
+func watch_event(bot *LMBot, ev *WatchEvent, now time.Time) {
+
+    ui := ev.User
+
+    if ev.Action == WATCH_ASK {
+
+        f, minutes := STR_FMT_HTML_WATCH_STALLED, watchdog.rule.Stall.Minutes()
+        if ev.Reason == WATCH_SILENT {
+            f, minutes = STR_FMT_HTML_WATCH_SILENT, now.Sub(ui.Last).Minutes()
+        }
+
+        s := fmt.Sprintf(i18n[f], int(minutes))
+
+        /* private chat with user has the same id */
+        msg := &LMMessage{ ChatID: ui.UserID }
+
+        lm_bot_send_buttons(bot, msg, s, [][]LMButton{
+            {
+                { Text: i18n[STR_WATCH_OK], Data: "watch_ok" },
+                { Text: i18n[STR_WATCH_HELP], Data: "watch_help" },
+            },
+        })
+
+        return
+    }
+
+    reason := i18n[STR_WATCH_REASON_STALLED]
+    if ev.Reason == WATCH_SILENT {
+        reason = i18n[STR_WATCH_REASON_SILENT]
+    }
+
+    s := fmt.Sprintf(i18n[STR_FMT_HTML_WATCH_ALERT],
+                     html.EscapeString(ui.UserName), reason)
+
+    organizer_alert(bot, s + last_position_lines(ui))
+}
+
+/* rider answered watchdog question */
+func watch_reply(bot *LMBot, msg *LMMessage, user *UserInfo) {
+
+    watchdog.answered(msg.UserID, time.Now())
+
+    if msg.Status != "watch_help" {
+        lmbot_send_msg(bot, msg, i18n[STR_WATCH_THANKS], true)
+        return
+    }
+
+    log.Printf("user %s asks for help", msg.UserName)
+
+    s := fmt.Sprintf(i18n[STR_FMT_HTML_WATCH_HELP],
+                     html.EscapeString(msg.UserName))
+
+    if user != nil {
+        s += last_position_lines(user.snapshot())
+    }
+
+    organizer_alert(bot, s)
+
+    lmbot_send_msg(bot, msg, i18n[STR_WATCH_HELP_SENT], true)
+}
+
+/* /sos and its buttons: confirmation, sending and cancel */
+func sos_reply(bot *LMBot, msg *LMMessage, user *UserInfo) {
+
+    switch msg.Status {
+    case "sos_confirm":
+        lm_bot_edit_buttons(bot, msg, i18n[STR_HTML_SOS_CONFIRM], nil)
+        send_sos(bot, msg, user)
+
+    case "sos_no":
+        lm_bot_edit_buttons(bot, msg, i18n[STR_HTML_SOS_NOT_SENT], nil)
+
+    case "sos_cancel":
+        if cancel_sos(bot, msg) {
+            lm_bot_edit_buttons(bot, msg, i18n[STR_HTML_SOS_CANCELLED], nil)
+        } else {
+            lm_bot_edit_buttons(bot, msg, i18n[STR_HTML_SOS_NOT_ACTIVE], nil)
+        }
+
+    default:
+        lm_bot_send_buttons(bot, msg, i18n[STR_HTML_SOS_CONFIRM], [][]LMButton{
+            {
+                { Text: i18n[STR_SOS_YES], Data: "sos_confirm" },
+                { Text: i18n[STR_SOS_NO], Data: "sos_no" },
+            },
+        })
+    }
+}
+
+func send_sos(bot *LMBot, msg *LMMessage, user *UserInfo) {
+
+    name := html.EscapeString(msg.UserName)
+
+    s := fmt.Sprintf(i18n[STR_FMT_HTML_SOS], name)
+    s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_SOS_PROFILE], msg.UserID, name,
+                            msg.UserID)
+
+    var snap *UserInfo
+
+    if user != nil {
+        snap = user.snapshot()
+
+        s += "\n" + get_statuses()[snap.MovingState]
+
+        if len(snap.Status) != 0 {
+            s += "\n<i>" + html.EscapeString(snap.Status) + "</i>"
+        }
+    }
+
+    known := snap != nil && !snap.Last.IsZero()
+
+    if known {
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_SOS_COORDS],
+                                snap.Pos.Lat, snap.Pos.Lon,
+                                fmt_dms(snap.Pos.Lat, snap.Pos.Lon))
+        s += last_position_lines(snap)
+
+    } else {
+        s += "\n" + i18n[STR_HTML_SOS_NO_POSITION]
+    }
+
+    var chats []int64
+
+    if org := bot.conf.OrganizerChatId; org != 0 {
+        if known {
+            lm_bot_send_location(bot, &LMMessage{ ChatID: org }, &snap.Pos)
+        }
+
+        lmbot_send_msg(bot, &LMMessage{ ChatID: org }, s, true)
+        chats = append(chats, org)
+
+    } else {
+        log.Printf("no organizer chat, SOS is not posted: %s", s)
+    }
+
+    var nearby []Neighbor
+
+    if known {
+        n := bot.conf.SosNearbyRiders
+        if n <= 0 {
+            n = SosNearbyRiders
+        }
+
+        dist := bot.conf.SosNearbyDistance
+        if dist <= 0 {
+            dist = SosNearbyDistance
+        }
+
+        nearby = nearest_riders(people.snapshot(), snap, n, dist, time.Now())
+    }
+
+    for _, nb := range nearby {
+
+        /* private chat with user has the same id */
+        rider := &LMMessage{ ChatID: nb.User.UserID }
+
+        lm_bot_send_location(bot, rider, &snap.Pos)
+        lmbot_send_msg(bot, rider,
+                       fmt.Sprintf(i18n[STR_FMT_HTML_SOS_NEARBY], name,
+                                   nb.Distance / 1000), true)
+
+        chats = append(chats, nb.User.UserID)
+    }
+
+    if len(chats) == 0 {
+        log.Printf("SOS from user %s is not sent, nobody to notify",
+                   msg.UserName)
+        lmbot_send_msg(bot, msg, i18n[STR_HTML_SOS_NOBODY], true)
+        return
+    }
+
+    sos_mu.Lock()
+    sos_sent[msg.UserID] = chats
+    sos_mu.Unlock()
+
+    log.Printf("SOS from user %s sent to %d chats", msg.UserName, len(chats))
+
+    /* rider is told who actually got it */
+    sent := fmt.Sprintf(i18n[STR_FMT_HTML_SOS_SENT], len(nearby))
+    if bot.conf.OrganizerChatId == 0 {
+        sent = fmt.Sprintf(i18n[STR_FMT_HTML_SOS_SENT_RIDERS], len(nearby))
+    }
+
+    lm_bot_send_buttons(bot, msg, sent,
+                        [][]LMButton{
+                            { { Text: i18n[STR_SOS_CANCEL], Data: "sos_cancel" } },
+                        })
+}
+
+/* false alarm, let know everybody who got SOS; false if none is active */
+func cancel_sos(bot *LMBot, msg *LMMessage) bool {
+
+    sos_mu.Lock()
+    chats, ok := sos_sent[msg.UserID]
+    delete(sos_sent, msg.UserID)
+    sos_mu.Unlock()
+
+    if !ok {
+        log.Printf("user %s cancels SOS, but none is active", msg.UserName)
+        return false
+    }
+
+    s := fmt.Sprintf(i18n[STR_FMT_HTML_SOS_CANCEL],
+                     html.EscapeString(msg.UserName))
+
+    for _, chat := range chats {
+        lmbot_send_msg(bot, &LMMessage{ ChatID: chat }, s, true)
+    }
+
+    log.Printf("SOS from user %s is cancelled", msg.UserName)
+
+    return true
+}
+
+/* part of /whereami and /stats common for both */
+func route_lines(ui *UserInfo) string {
+
+    s := "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_REMAINING],
+                            ui.Route.Remaining / 1000)
+
+    if cp := route.next_checkpoint(ui.Route.Position); cp != nil {
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_NEXT_CHECKPOINT],
+                                html.EscapeString(cp.Name),
+                                (cp.Offset - ui.Route.Position) / 1000)
+    }
+
+    return s
+}
+
+/* user is a snapshot */
+func whereami_reply(ui *UserInfo) string {
+
+    s := i18n[STR_HTML_WHEREAMI]
+
+    if route == nil || ui.Route == nil {
+        return s + "\n" + i18n[STR_HTML_NO_ROUTE]
+    }
+
+    s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_ROUTE_KM],
+                            ui.Route.Position / 1000, route.Length / 1000)
+
+    s += route_lines(ui)
+
+    if ui.Route.Diverge > OffRouteNotice {
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_OFF_ROUTE], ui.Route.Diverge)
+    }
+
+    return s
+}
+
+/* user is a snapshot */
+func stats_reply(ui *UserInfo) string {
+
+    s := i18n[STR_HTML_STATS]
+
+    ridden := ui.Distance
+    if route != nil && ui.Route != nil {
+        ridden = ui.Route.Position
+    }
+
+    s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_RIDDEN], ridden / 1000)
+
+    if route != nil && ui.Route != nil {
+        s += route_lines(ui)
+    }
+
+    if ui.MovingTime > 0 {
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_AVG_SPEED],
+                                ui.Distance / ui.MovingTime * 3.6)
+    }
+
+    if ui.Start == nil {
+        s += "\n" + i18n[STR_HTML_NOT_STARTED]
+
+    } else {
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_ELAPSED],
+                                fmt_duration(ui.elapsed(time.Now())))
+
+        s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_MOVING_TIME],
+                                fmt_duration(time.Duration(ui.MovingTime) *
+                                             time.Second))
+    }
+
+    st := make_standings(people.snapshot(), route, time.Now())
+
+    for _, r := range st {
+        if r.UserID == ui.UserID {
+            s += "\n" + fmt.Sprintf(i18n[STR_FMT_HTML_RANK], r.Rank, len(st))
+        }
+    }
+
+    return s
 }
 
-func create_menu_header(userid string, status string) string {
+/* hours and minutes */
+func fmt_duration(d time.Duration) string {
+
+    if d < 0 {
+        d = 0
+    }
+
+    m := int64(d.Minutes())
+
+    return fmt.Sprintf("%d:%02d", m / 60, m % 60)
+}
+
+func create_menu_header(name string, status string) string {
     if len(status) == 0 {
-        return "<b>" + userid + "</b> "
+        return "<b>" + name + "</b> "
     }
-    return "<b>" + userid + "</b> (" + status + ")"
+    return "<b>" + name + "</b> (" + status + ")"
 }
 
 
@@ -100,7 +863,8 @@ func handle_message(bot *LMBot, msg *LMMessage) (error) {
 
     var user *UserInfo
 
-    user = people.get(msg.Userid, false)
+    /* old state files keep riders by telegram first name only */
+    user = people.get(msg.UserID, msg.FirstName, false)
 
     if (msg.Text == "/start") {
         var start_text = i18n[STR_HTML_START]
@@ -108,82 +872,228 @@ func handle_message(bot *LMBot, msg *LMMessage) (error) {
         return nil
     }
 
+    /* available to support crews too, not only to riders */
+    if (msg.Text == "/eta" || strings.HasPrefix(msg.Text, "/eta ")) {
+        if !msg.Edited {
+            lmbot_send_msg(bot, msg, eta_reply(bot.conf, msg), true)
+        }
+        return nil
+    }
+
+    /* emergency, available before the first location too */
+    if (msg.Text == "/sos" || strings.HasPrefix(msg.Status, "sos_")) {
+        if !msg.Edited {
+            sos_reply(bot, msg, user)
+        }
+        return nil
+    }
+
+    /* buttons of incident message in organizer chat */
+    if strings.HasPrefix(msg.Status, "incident_") {
+        incident_reply(bot, msg)
+        return nil
+    }
+
+    /* buttons of watchdog question */
+    if strings.HasPrefix(msg.Status, "watch_") {
+        watch_reply(bot, msg, user)
+        return nil
+    }
+
+    if (msg.Text == "/setfinish" || strings.HasPrefix(msg.Text, "/setfinish ")) {
+        if !msg.Edited {
+            lmbot_send_msg(bot, msg, setfinish_reply(bot.conf, msg), true)
+        }
+        return nil
+    }
+
     if (user == nil) {
         /* new user - perform some introduction */
 
         var s string
 
         if (msg.Location == nil) {
-            s = fmt.Sprintf(i18n[STR_FMT_GEO_REQUEST], msg.Userid)
+            s = fmt.Sprintf(i18n[STR_FMT_GEO_REQUEST], msg.UserName)
             if !msg.Edited {
                 lm_bot_reply_to(bot, msg, s)
-                log.Printf("greeted unknown user %s", msg.Userid)
+                log.Printf("greeted unknown user %s (id %d)",
+                           msg.UserName, msg.UserID)
             }
             return nil
         }
 
         var up UserPosition
 
-        up.UserName = msg.Userid
+        up.UserID = msg.UserID
+        up.UserName = msg.UserName
+        up.FirstName = msg.FirstName
         up.Lat = msg.Location.Lat
         up.Lon = msg.Location.Lon
         up.Last = time.Now()
+        up.Accuracy = msg.Accuracy
+        up.Heading = msg.Heading
 
         user = createUser(nil, &up) /* always ok */
-        people.set(msg.Userid, user)
+        user.UpdateRoutePosition(route)
+        people.set(msg.UserID, user)
 
         if !msg.Edited {
+            cur := user.snapshot()
+
             if (len(msg.Status) == 0) {
-                msg.Status = user.MovingState
+                msg.Status = cur.MovingState
             }
 
-            msg.menu_title = create_menu_header(msg.Userid, user.Status)
-            s = fmt.Sprintf(i18n[STR_FMT_WELCOME_GOT_GEO], msg.Userid)
+            msg.menu_title = create_menu_header(msg.UserName, cur.Status)
+            s = fmt.Sprintf(i18n[STR_FMT_WELCOME_GOT_GEO], msg.UserName)
             lm_bot_reply_to(bot, msg, s)
             lm_bot_send_menu(bot, msg)
         }
 
-        log.Printf("created new user %s", up.UserName)
+        log.Printf("created new user %s (id %d)", up.UserName, up.UserID)
+
+    } else if (user.name() != msg.UserName) {
+        /* telegram profile renamed, keep the rider, update the label */
+
+        var us UserStatus
+
+        us.UserID = msg.UserID
+        us.UserName = msg.UserName
+        us.FirstName = msg.FirstName
+
+        user.UpdateStatus(&us)
+
+        err := handle_status_update(bot.conf, us)
+        if err != nil {
+            log.Printf("error while sending status update: %v", err)
+        }
     }
 
     if (msg.Text == "/status" || len(msg.Status) != 0) {
 
         if (len(msg.Status) == 0) {
-            msg.Status = user.MovingState
+            msg.Status = user.snapshot().MovingState
 
         } else {
             var up UserStatus
 
-            up.UserName = msg.Userid
+            up.UserID = msg.UserID
+            up.UserName = msg.UserName
+            up.FirstName = msg.FirstName
             up.MovingState = msg.Status
 
             user.UpdateStatus(&up)
 
+            /* webmap keeps the same finish time as bot */
+            up.Finish = user.snapshot().Finish
+
             err := handle_status_update(bot.conf, up)
             if err != nil {
                 log.Printf("error while sending status update: %v", err)
             }
+
+            if is_incident_status(up.MovingState) {
+                open_incident(bot, user)
+            }
         }
 
-        msg.menu_title = create_menu_header(msg.Userid, user.Status)
+        msg.menu_title = create_menu_header(msg.UserName, user.snapshot().Status)
         lm_bot_send_menu(bot, msg)
 
+    } else if (msg.Text == "/whereami") {
+
+        if !msg.Edited {
+            lmbot_send_msg(bot, msg, whereami_reply(user.snapshot()), true)
+        }
+
+    } else if (msg.Text == "/stats") {
+
+        if !msg.Edited {
+            lmbot_send_msg(bot, msg, stats_reply(user.snapshot()), true)
+        }
+
     } else if (msg.Location != nil) {
 
         var up UserPosition
 
-        up.UserName = msg.Userid
+        up.UserID = msg.UserID
+        up.UserName = msg.UserName
+        up.FirstName = msg.FirstName
         up.Lat = msg.Location.Lat
         up.Lon = msg.Location.Lon
         up.Last = time.Now()
+        up.Accuracy = msg.Accuracy
+        up.Heading = msg.Heading
 
         user.UpdatePosition(&up)
+        user.UpdateRoutePosition(route)
+
+        up.CheckIns = user.UpdateCheckIns(route)
+
+        started := user.UpdateStart(start_rule)
+        course := user.UpdateOffCourse(course_rule, route)
+
+        /* webmap follows start and course state seen by bot */
+        cur := user.snapshot()
+
+        up.Start = cur.Start
+        up.OffCourse = cur.OffCourse
 
         err := handle_position_update(bot.conf, up)
         if err != nil {
             log.Printf("error while sending position update: %v", err)
         }
 
+        /* personal start is confirmed, mass start is known to everybody */
+        if started != nil && start_rule.Staggered {
+            s := fmt.Sprintf(i18n[STR_FMT_HTML_STARTED],
+                             started.Local().Format("15:04"))
+            lmbot_send_msg(bot, msg, s, true)
+        }
+
+        switch course {
+        case COURSE_LEFT:
+            bearing, dist := cur.way_back(route)
+            compass := strings.Fields(i18n[STR_COMPASS])
+
+            s := fmt.Sprintf(i18n[STR_FMT_HTML_OFF_COURSE], dist,
+                             compass[compass_point(bearing)])
+            lmbot_send_msg(bot, msg, s, true)
+
+        case COURSE_BACK:
+            lmbot_send_msg(bot, msg, i18n[STR_HTML_BACK_ON_COURSE], true)
+        }
+
+        /* live location comes as edits, check-ins must be confirmed anyway */
+        for _, ci := range up.CheckIns {
+            s := fmt.Sprintf(i18n[STR_FMT_HTML_CHECKIN],
+                             html.EscapeString(ci.Name),
+                             ci.Time.Local().Format("15:04"))
+            lmbot_send_msg(bot, msg, s, true)
+        }
+
+        if t := user.UpdateFinish(finish, route); t != nil {
+
+            var us UserStatus
+
+            us.UserID = msg.UserID
+            us.UserName = msg.UserName
+            us.FirstName = msg.FirstName
+            us.MovingState = STATUS_FINISHED
+            us.Finish = t
+
+            err := handle_status_update(bot.conf, us)
+            if err != nil {
+                log.Printf("error while sending status update: %v", err)
+            }
+
+            send_finished(bot, msg, user.snapshot())
+        }
+
+        if brevet != nil {
+            check_brevet_risk(bot, msg, user.snapshot())
+        }
+
         if !msg.Edited {
             lm_bot_react(bot, msg, REACT_OK)
         }
@@ -198,7 +1108,9 @@ func handle_message(bot *LMBot, msg *LMMessage) (error) {
 
         var up UserStatus
 
-        up.UserName = msg.Userid
+        up.UserID = msg.UserID
+        up.UserName = msg.UserName
+        up.FirstName = msg.FirstName
         up.Status = msg.Text
 
         user.UpdateStatus(&up)
@@ -210,19 +1122,21 @@ func handle_message(bot *LMBot, msg *LMMessage) (error) {
 
         if !msg.Edited {
 
+            cur := user.snapshot()
+
             if (len(msg.Status) == 0) {
-                msg.Status = user.MovingState
+                msg.Status = cur.MovingState
             }
 
             //lm_bot_react(bot, msg, REACT_OK)
-            msg.menu_title = create_menu_header(msg.Userid, user.Status)
+            msg.menu_title = create_menu_header(msg.UserName, cur.Status)
             lm_bot_send_menu(bot, msg)
         }
     }
 
     log.Printf("done with message [edit:%v], total users: %d", msg.Edited, people.count())
 
-    people.set(msg.Userid, user)
+    people.set(msg.UserID, user)
 
     err := people.save(bot.conf.TmpDir)
     if err != nil {
@@ -235,17 +1149,28 @@ func handle_message(bot *LMBot, msg *LMMessage) (error) {
 
 func main() {
 
-    if len(os.Args) < 2 {
-        log.Printf("Usage: " + os.Args[0] + ": <conf.json>\n" );
+    /* "serve" runs webmap in the same process */
+    serve := len(os.Args) == 3 && os.Args[1] == "serve"
+
+    if len(os.Args) != 2 && !serve {
+        log.Printf("Usage: " + os.Args[0] + ": [serve] <conf.json>\n" );
         os.Exit(1);
     }
 
-    conf, err := ConfigLoad(os.Args[1])
+    conffile := os.Args[len(os.Args) - 1]
+
+    conf, err := ConfigLoad(conffile)
     if err != nil {
         log.Println(err.Error())
         os.Exit(1)
     }
 
+    /* http server would listen on port 80 otherwise */
+    if serve && len(conf.WebmapListen) == 0 {
+        log.Println("WebmapListen is required to serve webmap")
+        os.Exit(1)
+    }
+
     i18n, err = get_i18n(&conf)
     if err != nil {
         log.Println(err.Error())
@@ -271,12 +1196,64 @@ func main() {
         os.Exit(1)
     }
 
+    if len(conf.RouteFile) != 0 {
+        route, err = LoadRoute(conf.RouteFile)
+        if err != nil {
+            log.Println("failed to load route: " + err.Error())
+            os.Exit(1)
+        }
+
+        log.Printf("route '%s' loaded, %.1f km", route.Name, route.Length / 1000)
+    }
+
+    setup_checkpoints(route, &conf)
+
+    brevet = brevet_from_config(&conf)
+    start_rule = start_from_config(route, &conf)
+    course_rule = course_rule_from_config(&conf)
+    finish = finish_from_config(route, &conf)
+    watchdog = create_watchdog(watch_rule_from_config(&conf))
+
+    incidents, err = CreateIncidentDb(incident_file(&conf))
+    if err != nil {
+        log.Println("failed to load incidents: " + err.Error())
+        os.Exit(1)
+    }
+
+    keyring = CreateKeyring(conf.UpdateKeys)
+    go reload_keys(keyring, conffile)
+
+    /* webmap in the same process may still feed other webmaps */
+    list := sinks_from_config(&conf)
+
+    if serve {
+        bus = CreateBus()
+        updates := bus.subscribe()
+
+        go func() {
+            log.Fatal(webmap_serve(&conf, updates))
+        }()
+
+        list = conf.UpdateSinks
+    }
+
+    sinks, err = create_sinks(list, outbox_file(&conf), "outbox",
+                              conf.TmpDir, keyring)
+    if err != nil {
+        log.Println("failed to load outbox: " + err.Error())
+        os.Exit(1)
+    }
+
     bot, err := lm_bot_new(&conf)
     if err != nil {
         log.Println(err.Error())
         os.Exit(1)
     }
 
+    lm_bot_add_job(bot, run_watchdog)
+
+    lm_bot_add_job(bot, run_sinks)
+
     err = lm_bot_process_messages(bot, handle_message)
     if err != nil {
         log.Println(err.Error())
@@ -38,6 +38,81 @@ const  (
     STR_STATUS_FINISHED
     STR_STATUS_DNF
     STR_LIVE_MAP
+    STR_ETA_USAGE
+    STR_ETA_NO_ROUTE
+    STR_FMT_ETA_NO_RIDER
+    STR_FMT_ETA_HEADER
+    STR_FMT_ETA_KM
+    STR_FMT_ETA_CHECKPOINT
+    STR_FMT_ETA_FINISH
+    STR_ETA_PASSED
+    STR_ETA_UNKNOWN
+    STR_HTML_WHEREAMI
+    STR_HTML_STATS
+    STR_HTML_NO_ROUTE
+    STR_FMT_HTML_ROUTE_KM
+    STR_FMT_HTML_RIDDEN
+    STR_FMT_HTML_REMAINING
+    STR_FMT_HTML_NEXT_CHECKPOINT
+    STR_FMT_HTML_OFF_ROUTE
+    STR_FMT_HTML_AVG_SPEED
+    STR_FMT_HTML_ELAPSED
+    STR_FMT_HTML_RANK
+    STR_FMT_HTML_CHECKIN
+    STR_FINISH
+    STR_FMT_HTML_CONTROL_RISK
+    STR_FMT_HTML_CONTROL_RISK_STOPPED
+    STR_FMT_HTML_FINISHED
+    STR_SETFINISH_USAGE
+    STR_SETFINISH_DENIED
+    STR_FMT_HTML_FINISH_SET
+    STR_FMT_HTML_FINISH_CLEARED
+    STR_FMT_HTML_STARTED
+    STR_HTML_NOT_STARTED
+    STR_FMT_HTML_MOVING_TIME
+    STR_COMPASS
+    STR_FMT_HTML_OFF_COURSE
+    STR_HTML_BACK_ON_COURSE
+    STR_FMT_HTML_WATCH_STALLED
+    STR_FMT_HTML_WATCH_SILENT
+    STR_WATCH_OK
+    STR_WATCH_HELP
+    STR_WATCH_THANKS
+    STR_WATCH_HELP_SENT
+    STR_WATCH_REASON_STALLED
+    STR_WATCH_REASON_SILENT
+    STR_FMT_HTML_WATCH_ALERT
+    STR_FMT_HTML_WATCH_HELP
+    STR_FMT_HTML_LAST_POSITION
+    STR_FMT_HTML_INCIDENT
+    STR_FMT_HTML_INCIDENT_STATE
+    STR_INCIDENT_OPEN
+    STR_INCIDENT_ACKED
+    STR_INCIDENT_ENROUTE
+    STR_INCIDENT_RESOLVED
+    STR_INCIDENT_ACK
+    STR_INCIDENT_GO
+    STR_INCIDENT_CLOSE
+    STR_FMT_HTML_INCIDENT_ACKED
+    STR_FMT_HTML_INCIDENT_ENROUTE
+    STR_INCIDENT_DENIED
+    STR_MENU_SOS
+    STR_HTML_SOS_CONFIRM
+    STR_SOS_YES
+    STR_SOS_NO
+    STR_HTML_SOS_NOT_SENT
+    STR_FMT_HTML_SOS_SENT
+    STR_FMT_HTML_SOS_SENT_RIDERS
+    STR_HTML_SOS_NOBODY
+    STR_HTML_SOS_NOT_ACTIVE
+    STR_SOS_CANCEL
+    STR_HTML_SOS_CANCELLED
+    STR_FMT_HTML_SOS
+    STR_FMT_HTML_SOS_PROFILE
+    STR_FMT_HTML_SOS_COORDS
+    STR_HTML_SOS_NO_POSITION
+    STR_FMT_HTML_SOS_NEARBY
+    STR_FMT_HTML_SOS_CANCEL
 )
 
 func get_i18n(conf *UserConfig) (map[int]string, error) {
@@ -53,6 +128,9 @@ func get_i18n(conf *UserConfig) (map[int]string, error) {
 * Share your position with the bot (Attach->Geo->Translate my Position)
 * Any text message to will update your profile info (whatever you like to share: phone, email, real name...)
 * Type /status to set your status via menu
+* Type /eta [rider] [km] to see when rider is expected at finish, checkpoints or given km
+* Type /whereami to see where you are on the route, /stats for your ride statistics
+* Type /sos in emergency to send your position to organizers and riders nearby
 * Visit <a href="` + conf.LiveMapURL + `">Live map</a> that tracks everyone!`,
 
         STR_FMT_GEO_REQUEST: `Hello, %s. Translate me your Live GEO position to start`,
@@ -67,6 +145,83 @@ func get_i18n(conf *UserConfig) (map[int]string, error) {
         STR_STATUS_FINISHED: `Finished`,
         STR_STATUS_DNF: `DNF`,
         STR_LIVE_MAP: `Live map`,
+        STR_ETA_USAGE: `Usage: /eta [rider] [km], e.g. /eta 150km, /eta Ivan 150`,
+        STR_ETA_NO_ROUTE: `No route is loaded, ETA is not available`,
+        STR_FMT_ETA_NO_RIDER: `Cannot find a single rider matching '%s'`,
+        STR_FMT_ETA_HEADER: `<b>%s</b>: km %.1f, %.1f km/h`,
+        STR_FMT_ETA_KM: `km %.1f: %s`,
+        STR_FMT_ETA_CHECKPOINT: `%s (km %.1f): %s`,
+        STR_FMT_ETA_FINISH: `Finish (km %.1f): %s`,
+        STR_ETA_PASSED: `passed`,
+        STR_ETA_UNKNOWN: `unknown`,
+        STR_HTML_WHEREAMI: `<b>Where am I</b>`,
+        STR_HTML_STATS: `<b>Ride statistics</b>`,
+        STR_HTML_NO_ROUTE: `* Route is not loaded`,
+        STR_FMT_HTML_ROUTE_KM: `* On route: km %.1f of %.1f`,
+        STR_FMT_HTML_RIDDEN: `* Ridden: %.1f km`,
+        STR_FMT_HTML_REMAINING: `* Remaining: %.1f km`,
+        STR_FMT_HTML_NEXT_CHECKPOINT: `* Next checkpoint: %s in %.1f km`,
+        STR_FMT_HTML_OFF_ROUTE: `* Off route: %.0f m`,
+        STR_FMT_HTML_AVG_SPEED: `* Average moving speed: %.1f km/h`,
+        STR_FMT_HTML_ELAPSED: `* Elapsed time: %s`,
+        STR_FMT_HTML_RANK: `* Rank: %d of %d`,
+        STR_FMT_HTML_CHECKIN: `✅ Checkpoint <b>%s</b> reached at %s`,
+        STR_FINISH: `Finish`,
+        STR_FMT_HTML_CONTROL_RISK: `⚠️ At current pace you reach control <b>%s</b> (km %.0f) at %s, but it closes at %s`,
+        STR_FMT_HTML_CONTROL_RISK_STOPPED: `⚠️ You seem to be stopped, control <b>%s</b> (km %.0f) closes at %s`,
+        STR_FMT_HTML_FINISHED: `🏁 Congratulations, <b>%s</b>! You finished at %s, elapsed time %s`,
+        STR_SETFINISH_USAGE: `Usage: /setfinish rider HH:MM, /setfinish rider YYYY-MM-DDTHH:MM or /setfinish rider - to cancel finish`,
+        STR_SETFINISH_DENIED: `Only organizers can change finish time`,
+        STR_FMT_HTML_FINISH_SET: `Finish time of <b>%s</b> is set to %s`,
+        STR_FMT_HTML_FINISH_CLEARED: `Finish of <b>%s</b> is cancelled`,
+        STR_FMT_HTML_STARTED: `🚦 Your start is recorded at %s. Have a good ride!`,
+        STR_HTML_NOT_STARTED: `* Not started yet`,
+        STR_FMT_HTML_MOVING_TIME: `* Moving time: %s`,
+        STR_COMPASS: `north northeast east southeast south southwest west northwest`,
+        STR_FMT_HTML_OFF_COURSE: `⚠️ You are off course! The route is <b>%.0f m</b> to the <b>%s</b>`,
+        STR_HTML_BACK_ON_COURSE: `👍 You are back on course`,
+        STR_FMT_HTML_WATCH_STALLED: `🤔 You have not moved for %d minutes. Are you OK?`,
+        STR_FMT_HTML_WATCH_SILENT: `🤔 Your position has not been updated for %d minutes. Are you OK?`,
+        STR_WATCH_OK: `👍 I'm OK`,
+        STR_WATCH_HELP: `🆘 I need help`,
+        STR_WATCH_THANKS: `Thanks! Have a good ride`,
+        STR_WATCH_HELP_SENT: `Organizers are notified`,
+        STR_WATCH_REASON_STALLED: `not moving`,
+        STR_WATCH_REASON_SILENT: `no positions`,
+        STR_FMT_HTML_WATCH_ALERT: `🚨 <b>%s</b> did not answer if everything is OK (%s)`,
+        STR_FMT_HTML_WATCH_HELP: `🆘 <b>%s</b> asks for help`,
+        STR_FMT_HTML_LAST_POSITION: `Last position at %s: <a href="%s">%.5f, %.5f</a>`,
+        STR_FMT_HTML_INCIDENT: `🚑 <b>Incident #%d</b>: %s
+Rider: <b>%s</b>, reported at %s`,
+        STR_FMT_HTML_INCIDENT_STATE: `State: <b>%s</b>`,
+        STR_INCIDENT_OPEN: `open`,
+        STR_INCIDENT_ACKED: `acknowledged`,
+        STR_INCIDENT_ENROUTE: `on the way`,
+        STR_INCIDENT_RESOLVED: `resolved`,
+        STR_INCIDENT_ACK: `👌 Acknowledge`,
+        STR_INCIDENT_GO: `🚗 On my way`,
+        STR_INCIDENT_CLOSE: `✅ Resolved`,
+        STR_FMT_HTML_INCIDENT_ACKED: `👌 Organizers got your report, <b>%s</b> takes care of it`,
+        STR_FMT_HTML_INCIDENT_ENROUTE: `🚗 <b>%s</b> is on the way to you`,
+        STR_INCIDENT_DENIED: `Only organizers can handle incidents`,
+        STR_MENU_SOS: `🆘 SOS`,
+        STR_HTML_SOS_CONFIRM: `🆘 Send <b>SOS</b> with your position to organizers and riders nearby?`,
+        STR_SOS_YES: `🆘 Yes, send SOS`,
+        STR_SOS_NO: `Cancel`,
+        STR_HTML_SOS_NOT_SENT: `SOS is not sent`,
+        STR_FMT_HTML_SOS_SENT: `🆘 SOS is sent to organizers and %d riders nearby. Press the button below if help is not needed anymore`,
+        STR_FMT_HTML_SOS_SENT_RIDERS: `🆘 SOS is sent to %d riders nearby, organizers cannot be reached by bot. Press the button below if help is not needed anymore`,
+        STR_HTML_SOS_NOBODY: `🆘 SOS is not sent: neither organizers nor riders nearby can be reached by bot. Call emergency services if you need help`,
+        STR_HTML_SOS_NOT_ACTIVE: `There is no active SOS`,
+        STR_SOS_CANCEL: `❎ Cancel SOS`,
+        STR_HTML_SOS_CANCELLED: `❎ SOS is cancelled, everybody who got it is notified`,
+        STR_FMT_HTML_SOS: `🆘 <b>SOS from %s</b>`,
+        STR_FMT_HTML_SOS_PROFILE: `Profile: <a href="tg://user?id=%d">%s</a> (id %d)`,
+        STR_FMT_HTML_SOS_COORDS: `Coordinates: <code>%.6f, %.6f</code>
+<code>%s</code>`,
+        STR_HTML_SOS_NO_POSITION: `Position is unknown`,
+        STR_FMT_HTML_SOS_NEARBY: `🆘 <b>%s</b> needs help %.1f km from you`,
+        STR_FMT_HTML_SOS_CANCEL: `❎ SOS from <b>%s</b> is cancelled, help is not needed`,
     },
 
     "ru": {
@@ -75,6 +230,9 @@ func get_i18n(conf *UserConfig) (map[int]string, error) {
 * Поделитесь с ботом свей геопозицей (Attach->Geo->Translate my Position)
 * Любое текстовое сообщение боту обновит ваш профиль (что угодно, чем хотите поделиться: почта, телефон, имя...)
 * Отправьте /status чтобы увидеть меню и управлять вашим статусом
+* Отправьте /eta [участник] [км] чтобы узнать, когда участник будет на финише, КП или указанном километре
+* Отправьте /whereami чтобы узнать, где вы на трассе, /stats - для статистики заезда
+* Отправьте /sos в экстренной ситуации, чтобы передать позицию организаторам и участникам поблизости
 * Отслеживайте всех на <a href="` + conf.LiveMapURL + `">интерактивной карте</a>!`,
 
         STR_FMT_GEO_REQUEST: `Привет, %s. Начните трансляцию своей геопозиции, чтобы начать работу с ботом`,
@@ -89,6 +247,83 @@ func get_i18n(conf *UserConfig) (map[int]string, error) {
         STR_STATUS_FINISHED: `Финишировал`,
         STR_STATUS_DNF: `Сход с дистанции`,
         STR_LIVE_MAP: `Интерактивная карта`,
+        STR_ETA_USAGE: `Использование: /eta [участник] [км], например /eta 150км, /eta Иван 150`,
+        STR_ETA_NO_ROUTE: `Трасса не загружена, прогноз недоступен`,
+        STR_FMT_ETA_NO_RIDER: `Не удалось однозначно найти участника '%s'`,
+        STR_FMT_ETA_HEADER: `<b>%s</b>: %.1f км, %.1f км/ч`,
+        STR_FMT_ETA_KM: `%.1f км: %s`,
+        STR_FMT_ETA_CHECKPOINT: `%s (%.1f км): %s`,
+        STR_FMT_ETA_FINISH: `Финиш (%.1f км): %s`,
+        STR_ETA_PASSED: `пройден`,
+        STR_ETA_UNKNOWN: `неизвестно`,
+        STR_HTML_WHEREAMI: `<b>Где я</b>`,
+        STR_HTML_STATS: `<b>Статистика заезда</b>`,
+        STR_HTML_NO_ROUTE: `* Трасса не загружена`,
+        STR_FMT_HTML_ROUTE_KM: `* На трассе: %.1f км из %.1f`,
+        STR_FMT_HTML_RIDDEN: `* Пройдено: %.1f км`,
+        STR_FMT_HTML_REMAINING: `* Осталось: %.1f км`,
+        STR_FMT_HTML_NEXT_CHECKPOINT: `* Следующий КП: %s через %.1f км`,
+        STR_FMT_HTML_OFF_ROUTE: `* В стороне от трассы: %.0f м`,
+        STR_FMT_HTML_AVG_SPEED: `* Средняя скорость в движении: %.1f км/ч`,
+        STR_FMT_HTML_ELAPSED: `* Время в пути: %s`,
+        STR_FMT_HTML_RANK: `* Позиция: %d из %d`,
+        STR_FMT_HTML_CHECKIN: `✅ КП <b>%s</b> пройден в %s`,
+        STR_FINISH: `Финиш`,
+        STR_FMT_HTML_CONTROL_RISK: `⚠️ В текущем темпе вы будете на КП <b>%s</b> (%.0f км) в %s, а он закрывается в %s`,
+        STR_FMT_HTML_CONTROL_RISK_STOPPED: `⚠️ Похоже, вы стоите, а КП <b>%s</b> (%.0f км) закрывается в %s`,
+        STR_FMT_HTML_FINISHED: `🏁 Поздравляем, <b>%s</b>! Вы финишировали в %s, время в пути %s`,
+        STR_SETFINISH_USAGE: `Использование: /setfinish участник ЧЧ:ММ, /setfinish участник ГГГГ-ММ-ДДTЧЧ:ММ или /setfinish участник - для отмены финиша`,
+        STR_SETFINISH_DENIED: `Менять время финиша могут только организаторы`,
+        STR_FMT_HTML_FINISH_SET: `Время финиша <b>%s</b> установлено: %s`,
+        STR_FMT_HTML_FINISH_CLEARED: `Финиш <b>%s</b> отменён`,
+        STR_FMT_HTML_STARTED: `🚦 Ваш старт зафиксирован в %s. Хорошей дороги!`,
+        STR_HTML_NOT_STARTED: `* Ещё не стартовали`,
+        STR_FMT_HTML_MOVING_TIME: `* Время в движении: %s`,
+        STR_COMPASS: `север северо-восток восток юго-восток юг юго-запад запад северо-запад`,
+        STR_FMT_HTML_OFF_COURSE: `⚠️ Вы сбились с маршрута! Трасса в <b>%.0f м</b>, направление: <b>%s</b>`,
+        STR_HTML_BACK_ON_COURSE: `👍 Вы вернулись на маршрут`,
+        STR_FMT_HTML_WATCH_STALLED: `🤔 Вы не двигаетесь уже %d минут. У вас всё в порядке?`,
+        STR_FMT_HTML_WATCH_SILENT: `🤔 Ваша позиция не обновлялась уже %d минут. У вас всё в порядке?`,
+        STR_WATCH_OK: `👍 Всё в порядке`,
+        STR_WATCH_HELP: `🆘 Нужна помощь`,
+        STR_WATCH_THANKS: `Спасибо! Хорошей дороги`,
+        STR_WATCH_HELP_SENT: `Организаторы оповещены`,
+        STR_WATCH_REASON_STALLED: `не двигается`,
+        STR_WATCH_REASON_SILENT: `нет позиций`,
+        STR_FMT_HTML_WATCH_ALERT: `🚨 <b>%s</b> не ответил(а), всё ли в порядке (%s)`,
+        STR_FMT_HTML_WATCH_HELP: `🆘 <b>%s</b> просит о помощи`,
+        STR_FMT_HTML_LAST_POSITION: `Последняя позиция в %s: <a href="%s">%.5f, %.5f</a>`,
+        STR_FMT_HTML_INCIDENT: `🚑 <b>Происшествие #%d</b>: %s
+Участник: <b>%s</b>, сообщено в %s`,
+        STR_FMT_HTML_INCIDENT_STATE: `Состояние: <b>%s</b>`,
+        STR_INCIDENT_OPEN: `открыто`,
+        STR_INCIDENT_ACKED: `принято`,
+        STR_INCIDENT_ENROUTE: `выехали`,
+        STR_INCIDENT_RESOLVED: `решено`,
+        STR_INCIDENT_ACK: `👌 Принять`,
+        STR_INCIDENT_GO: `🚗 Выезжаю`,
+        STR_INCIDENT_CLOSE: `✅ Решено`,
+        STR_FMT_HTML_INCIDENT_ACKED: `👌 Организаторы получили ваше сообщение, им занимается <b>%s</b>`,
+        STR_FMT_HTML_INCIDENT_ENROUTE: `🚗 <b>%s</b> едет к вам`,
+        STR_INCIDENT_DENIED: `Заниматься происшествиями могут только организаторы`,
+        STR_MENU_SOS: `🆘 SOS`,
+        STR_HTML_SOS_CONFIRM: `🆘 Отправить <b>SOS</b> с вашей позицией организаторам и участникам поблизости?`,
+        STR_SOS_YES: `🆘 Да, отправить SOS`,
+        STR_SOS_NO: `Отмена`,
+        STR_HTML_SOS_NOT_SENT: `SOS не отправлен`,
+        STR_FMT_HTML_SOS_SENT: `🆘 SOS отправлен организаторам и участникам поблизости (%d). Нажмите кнопку ниже, если помощь больше не нужна`,
+        STR_FMT_HTML_SOS_SENT_RIDERS: `🆘 SOS отправлен участникам поблизости (%d), организаторы ботом недоступны. Нажмите кнопку ниже, если помощь больше не нужна`,
+        STR_HTML_SOS_NOBODY: `🆘 SOS не отправлен: ни организаторы, ни участники поблизости ботом недоступны. Если нужна помощь, звоните в экстренные службы`,
+        STR_HTML_SOS_NOT_ACTIVE: `Активного SOS нет`,
+        STR_SOS_CANCEL: `❎ Отменить SOS`,
+        STR_HTML_SOS_CANCELLED: `❎ SOS отменён, все получившие его оповещены`,
+        STR_FMT_HTML_SOS: `🆘 <b>SOS от %s</b>`,
+        STR_FMT_HTML_SOS_PROFILE: `Профиль: <a href="tg://user?id=%d">%s</a> (id %d)`,
+        STR_FMT_HTML_SOS_COORDS: `Координаты: <code>%.6f, %.6f</code>
+<code>%s</code>`,
+        STR_HTML_SOS_NO_POSITION: `Позиция неизвестна`,
+        STR_FMT_HTML_SOS_NEARBY: `🆘 <b>%s</b> нужна помощь в %.1f км от вас`,
+        STR_FMT_HTML_SOS_CANCEL: `❎ SOS от <b>%s</b> отменён, помощь не нужна`,
     },
     }
 
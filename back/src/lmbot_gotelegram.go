@@ -36,13 +36,20 @@ type LMBot struct {
     ctx            context.Context
     bot           *bot.Bot
     conf          *UserConfig
+
+    /* background jobs, started once bot is connected */
+    jobs           []func(*LMBot)
 }
 
 type LMMessage struct {
-    Userid         string
+    UserID         int64
+    UserName       string
+    FirstName      string
     Text           string
     Edited         bool
     Location      *GeoPos
+    Accuracy       float64
+    Heading        int
     Status         string
 
     menu_title     string
@@ -53,6 +60,12 @@ type LMMessage struct {
 
 type LMMessageHandler func(bot *LMBot, msg *LMMessage) (error)
 
+/* inline keyboard button, Data is passed back in LMMessage.Status */
+type LMButton struct {
+    Text           string
+    Data           string
+}
+
 
 func lm_bot_new(conf *UserConfig) (*LMBot, error) {
     var res LMBot
@@ -89,7 +102,9 @@ func bot_msg_handler(ctx context.Context, b* bot.Bot, update *models.Update,
 
     //debug_input_msg(msg)
 
-    lm_msg.Userid = msg.From.FirstName
+    lm_msg.UserID = msg.From.ID
+    lm_msg.UserName = user_display_name(msg.From)
+    lm_msg.FirstName = msg.From.FirstName
 
     if user_allowed(ctx, b, msg, lmbot.conf.RestrictChannelId) == false {
         //lm_bot_reply_to(lmbot, &lm_msg, "you are not allowed")
@@ -107,6 +122,8 @@ func bot_msg_handler(ctx context.Context, b* bot.Bot, update *models.Update,
         pos.Lat = msg.Location.Latitude
 
         lm_msg.Location = &pos
+        lm_msg.Accuracy = msg.Location.HorizontalAccuracy
+        lm_msg.Heading = msg.Location.Heading
     }
 
     lm_msg.Text = msg.Text
@@ -129,6 +146,18 @@ func lm_bot_process_messages(lmbot *LMBot, handler LMMessageHandler) (error) {
             func (ctx context.Context, b *bot.Bot, update *models.Update) {
                   bot_menu_handler(ctx, b, update, lmbot, handler);
             }),
+        bot.WithCallbackQueryDataHandler("watch_", bot.MatchTypePrefix,
+            func (ctx context.Context, b *bot.Bot, update *models.Update) {
+                  bot_menu_handler(ctx, b, update, lmbot, handler);
+            }),
+        bot.WithCallbackQueryDataHandler("incident_", bot.MatchTypePrefix,
+            func (ctx context.Context, b *bot.Bot, update *models.Update) {
+                  bot_menu_handler(ctx, b, update, lmbot, handler);
+            }),
+        bot.WithCallbackQueryDataHandler("sos_", bot.MatchTypePrefix,
+            func (ctx context.Context, b *bot.Bot, update *models.Update) {
+                  bot_menu_handler(ctx, b, update, lmbot, handler);
+            }),
     }
 
     bot, err := bot.New(lmbot.conf.Token, opts...)
@@ -140,6 +169,10 @@ func lm_bot_process_messages(lmbot *LMBot, handler LMMessageHandler) (error) {
 
     lmbot.bot = bot
 
+    for _, job := range lmbot.jobs {
+        go job(lmbot)
+    }
+
     // pass handler now to custom function
     lmbot.bot.Start(lmbot.ctx)
 
@@ -160,7 +193,9 @@ func bot_menu_handler(ctx context.Context, b* bot.Bot, update *models.Update,
         ShowAlert:       false,
     })
 
-    lm_msg.Userid = update.CallbackQuery.From.FirstName
+    lm_msg.UserID = update.CallbackQuery.From.ID
+    lm_msg.UserName = user_display_name(&update.CallbackQuery.From)
+    lm_msg.FirstName = update.CallbackQuery.From.FirstName
     lm_msg.ChatID = update.CallbackQuery.Message.Chat.ID
     lm_msg.MessageID = update.CallbackQuery.Message.MessageID
     lm_msg.Status = update.CallbackQuery.Data
@@ -170,6 +205,14 @@ func bot_menu_handler(ctx context.Context, b* bot.Bot, update *models.Update,
     handler(lmbot, &lm_msg);
 }
 
+/* name shown to others, telegram id is used to identify user */
+func user_display_name(u *models.User) string {
+    if len(u.LastName) == 0 {
+        return u.FirstName
+    }
+    return u.FirstName + " " + u.LastName
+}
+
 func debug_input_msg(m *models.Message) {
     dump, _ := json.Marshal(m)
     log.Printf("MSG=%s\n", dump)
@@ -252,6 +295,9 @@ func lm_bot_send_menu(lmbot *LMBot, lm_msg *LMMessage) {
                 {Text: menu_title(STATUS_FINISHED, s), CallbackData: STATUS_FINISHED},
                 {Text: menu_title(STATUS_DNF, s), CallbackData: STATUS_DNF},
             },
+            {
+                {Text: i18n[STR_MENU_SOS], CallbackData: "sos_ask"},
+            },
         },
     }
 
@@ -289,6 +335,81 @@ func lm_bot_reply_to(lmbot *LMBot, lm_msg *LMMessage, reply_text string) {
     }
 }
 
+/* replaces text and buttons of message, no buttons remove keyboard */
+func lm_bot_edit_buttons(lmbot *LMBot, lm_msg *LMMessage, text string,
+                         buttons [][]LMButton) {
+
+    var msg    bot.EditMessageTextParams
+
+    msg.ChatID = lm_msg.ChatID
+    msg.MessageID = lm_msg.MessageID
+    msg.Text = text
+    msg.ReplyMarkup = lm_bot_keyboard(buttons)
+    msg.ParseMode = models.ParseModeHTML
+
+    _, err := lmbot.bot.EditMessageText(lmbot.ctx, &msg)
+    if (err != nil) {
+        log.Printf("failed to edit message: %v", err);
+    }
+}
+
+func lm_bot_send_location(lmbot *LMBot, lm_msg *LMMessage, pos *GeoPos) {
+
+    var msg    bot.SendLocationParams
+
+    msg.ChatID = lm_msg.ChatID
+    msg.Latitude = pos.Lat
+    msg.Longitude = pos.Lon
+
+    _, err := lmbot.bot.SendLocation(lmbot.ctx, &msg)
+    if (err != nil) {
+        log.Printf("failed to send location: %v", err);
+    }
+}
+
+/* job runs in background since bot is connected till it is stopped */
+func lm_bot_add_job(lmbot *LMBot, job func(*LMBot)) {
+    lmbot.jobs = append(lmbot.jobs, job)
+}
+
+func lm_bot_keyboard(buttons [][]LMButton) *models.InlineKeyboardMarkup {
+
+    kb := &models.InlineKeyboardMarkup{
+        InlineKeyboard: [][]models.InlineKeyboardButton{},
+    }
+
+    for _, row := range buttons {
+        var line []models.InlineKeyboardButton
+
+        for _, b := range row {
+            line = append(line, models.InlineKeyboardButton{
+                Text: b.Text,
+                CallbackData: b.Data,
+            })
+        }
+
+        kb.InlineKeyboard = append(kb.InlineKeyboard, line)
+    }
+
+    return kb
+}
+
+func lm_bot_send_buttons(lmbot *LMBot, lm_msg *LMMessage, text string,
+                         buttons [][]LMButton) {
+
+    var msg    bot.SendMessageParams
+
+    msg.ChatID = lm_msg.ChatID
+    msg.Text = text
+    msg.ReplyMarkup = lm_bot_keyboard(buttons)
+    msg.ParseMode = models.ParseModeHTML
+
+    _, err := lmbot.bot.SendMessage(lmbot.ctx, &msg)
+    if (err != nil) {
+        log.Printf("failed to send buttons: %v", err);
+    }
+}
+
 func lmbot_send_msg(lmbot *LMBot, lm_msg *LMMessage, text string, html bool) {
 
     var msg    bot.SendMessageParams
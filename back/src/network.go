@@ -31,17 +31,60 @@ type KeepalivePing struct {
     Alive    bool
 }
 
-/* json position update */
+/* sent to event source client that must reload /bootstrap */
+type ResyncRequest struct {
+    Resync   bool
+}
+
+/* rider entered geofence of route checkpoint with given index */
+type CheckIn struct {
+    Checkpoint int
+    Name       string
+    Time       time.Time
+}
+
+/*
+ * point of user track: where and when user was;
+ * Accuracy (meters) and Heading (1-360 degrees) are zero if unknown
+ */
+type TrackPoint struct {
+    Lon      float64
+    Lat      float64
+    Last     time.Time
+    Accuracy float64      `json:",omitempty"`
+    Heading  int          `json:",omitempty"`
+}
+
+/*
+ * json position update, with checkpoints reached by this move, if any,
+ * official start of user, once it is known, and off-course state;
+ * Missed are older positions replaced by this one in outbox.
+ * FirstName is telegram first name, legacy users are claimed by it
+ */
 type UserPosition struct {
+    UserID   int64
     UserName string
+    FirstName string      `json:",omitempty"`
     Lat      float64
     Lon      float64
     Last     time.Time
+    Accuracy float64      `json:",omitempty"`
+    Heading  int          `json:",omitempty"`
+    CheckIns []CheckIn    `json:",omitempty"`
+    Start   *time.Time    `json:",omitempty"`
+    OffCourse bool        `json:",omitempty"`
+    Missed   []TrackPoint `json:",omitempty"`
 }
 
-/* json status update */
+/*
+ * json status update;
+ * Finish is time of finish, if known, when MovingState is finished
+ */
 type UserStatus struct {
+    UserID       int64
     UserName     string
+    FirstName    string       `json:",omitempty"`
     Status       string
     MovingState  string
+    Finish      *time.Time    `json:",omitempty"`
 }
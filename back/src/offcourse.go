@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "time"
+)
+
+/* defaults: rider is off course that far from route for that long */
+const OffCourseDistance = 200.0
+const OffCourseTime = 5 * time.Minute
+
+/* rider is back on course when that close, part of OffCourseDistance */
+const OffCourseRejoin = 0.5
+
+/* changes of off-course state */
+const (
+    COURSE_SAME = iota
+    COURSE_LEFT
+    COURSE_BACK
+)
+
+type CourseRule struct {
+    Distance  float64
+    Delay     time.Duration
+}
+
+func course_rule_from_config(conf *UserConfig) *CourseRule {
+
+    cr := &CourseRule{ Distance: conf.OffCourseDistance,
+                       Delay: time.Duration(conf.OffCourseTime * float64(time.Second)) }
+
+    if cr.Distance <= 0 {
+        cr.Distance = OffCourseDistance
+    }
+
+    if cr.Delay <= 0 {
+        cr.Delay = OffCourseTime
+    }
+
+    return cr
+}
+
+/*
+ * Updates off-course state of user after route position is known:
+ * user is off course after being farther from route than rule allows
+ * for long enough, and back on course when close to route again
+ */
+func (ui *UserInfo) UpdateOffCourse(cr *CourseRule, rt *Route) int {
+
+    if rt == nil {
+        return COURSE_SAME
+    }
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    if ui.Route == nil {
+        return COURSE_SAME
+    }
+
+    /* nobody cares where riders go after the ride */
+    if ui.MovingState == STATUS_FINISHED || ui.MovingState == STATUS_DNF {
+        ui.OffSince = nil
+        ui.OffCourse = false
+        return COURSE_SAME
+    }
+
+    d := ui.Route.Diverge
+
+    switch {
+    case d > cr.Distance:
+        if ui.OffSince == nil {
+            since := ui.Last
+            ui.OffSince = &since
+        }
+
+        if !ui.OffCourse && ui.Last.Sub(*ui.OffSince) >= cr.Delay {
+            ui.OffCourse = true
+
+            log.Printf("user %s is off course by %.0f m since %v",
+                       ui.UserName, d, *ui.OffSince)
+
+            return COURSE_LEFT
+        }
+
+    case d <= cr.Distance * OffCourseRejoin:
+        ui.OffSince = nil
+
+        if ui.OffCourse {
+            ui.OffCourse = false
+
+            log.Printf("user %s is back on course", ui.UserName)
+
+            return COURSE_BACK
+        }
+    }
+
+    return COURSE_SAME
+}
+
+/* off-course state reported by bot; tells if it has changed */
+func (ui *UserInfo) set_off_course(off bool) bool {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    if ui.OffCourse == off {
+        return false
+    }
+
+    ui.OffCourse = off
+
+    return true
+}
+
+/*
+ * way back to route for user (snapshot): bearing (degrees)
+ * and distance to the place on route where user is matched
+ */
+func (ui *UserInfo) way_back(rt *Route) (float64, float64) {
+
+    if rt == nil || ui.Route == nil {
+        return 0, 0
+    }
+
+    lat, lon := rt.point_at(ui.Route.Position)
+
+    return geo_bearing(ui.Pos.Lat, ui.Pos.Lon, lat, lon),
+           geo_distance(ui.Pos.Lat, ui.Pos.Lon, lat, lon)
+}
+
+/* index of one of 8 compass points for bearing */
+func compass_point(bearing float64) int {
+
+    return int(math.Floor(math.Mod(bearing + 22.5 + 360, 360) / 45)) % 8
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "math"
+    "time"
+    "testing"
+)
+
+/* moves user to the given place near test line route */
+func wander_to(ui *UserInfo, rt *Route, cr *CourseRule, lat float64,
+               lon float64, at int64) int {
+
+    ui.UpdatePosition(&UserPosition{ Lat: lat, Lon: lon, Last: time.Unix(at, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    return ui.UpdateOffCourse(cr, rt)
+}
+
+func TestCourseRule(t *testing.T) {
+
+    var conf UserConfig
+
+    cr := course_rule_from_config(&conf)
+    if cr.Distance != OffCourseDistance || cr.Delay != OffCourseTime {
+        t.Fatalf("wrong default rule: %+v", cr)
+    }
+
+    conf.OffCourseDistance = 300
+    conf.OffCourseTime = 90
+
+    cr = course_rule_from_config(&conf)
+    if cr.Distance != 300 || cr.Delay != 90 * time.Second {
+        t.Fatalf("wrong rule: %+v", cr)
+    }
+}
+
+func TestOffCourse(t *testing.T) {
+
+    rt := test_line_route()
+    cr := &CourseRule{ Distance: 100, Delay: 60 * time.Second }
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    if c := wander_to(ui, rt, cr, 55.001, 37, 30); c != COURSE_SAME {
+        t.Fatalf("wrong state on route: %v", c)
+    }
+
+    /* 190 m to the east of route, not for long yet */
+    if c := wander_to(ui, rt, cr, 55.0015, 37.003, 60); c != COURSE_SAME {
+        t.Fatalf("off course too early: %v", c)
+    }
+
+    if c := wander_to(ui, rt, cr, 55.002, 37.003, 130); c != COURSE_LEFT {
+        t.Fatalf("off course is missed: %v", c)
+    }
+
+    snap := ui.snapshot()
+    if !snap.OffCourse || !snap.OffSince.Equal(time.Unix(60, 0)) {
+        t.Fatalf("wrong off-course state: %v %v", snap.OffCourse, snap.OffSince)
+    }
+
+    bearing, dist := snap.way_back(rt)
+    if compass_point(bearing) != 6 || math.Abs(dist - 192) > 5 {
+        t.Fatalf("wrong way back: %v° %v m", bearing, dist)
+    }
+
+    if c := wander_to(ui, rt, cr, 55.0025, 37.003, 200); c != COURSE_SAME {
+        t.Fatalf("warned twice: %v", c)
+    }
+
+    /* closer, but not quite on route */
+    if c := wander_to(ui, rt, cr, 55.003, 37.001, 230); c != COURSE_SAME {
+        t.Fatalf("back on course too early: %v", c)
+    }
+
+    if c := wander_to(ui, rt, cr, 55.0035, 37, 260); c != COURSE_BACK {
+        t.Fatalf("return is missed: %v", c)
+    }
+
+    if snap = ui.snapshot(); snap.OffCourse || snap.OffSince != nil {
+        t.Fatalf("off-course state is not cleared: %v %v", snap.OffCourse,
+                 snap.OffSince)
+    }
+
+    /* short excursion is not reported */
+    wander_to(ui, rt, cr, 55.004, 37.003, 290)
+
+    if c := wander_to(ui, rt, cr, 55.0045, 37, 320); c != COURSE_SAME {
+        t.Fatalf("short excursion is reported: %v", c)
+    }
+}
+
+func TestCompassPoint(t *testing.T) {
+
+    for _, c := range []struct { bearing float64; point int } {
+        { 0, 0 }, { 22, 0 }, { 23, 1 }, { 90, 2 }, { 180, 4 },
+        { 270, 6 }, { 337, 7 }, { 338, 0 }, { 359.9, 0 },
+    } {
+        if p := compass_point(c.bearing); p != c.point {
+            t.Fatalf("bearing %v is point %d, expected %d", c.bearing, p, c.point)
+        }
+    }
+}
@@ -0,0 +1,446 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "sync/atomic"
+    "errors"
+    "context"
+    "strconv"
+    "encoding/json"
+    "path/filepath"
+)
+
+/* delay before retry, doubled after every failure up to maximum */
+const OutboxBackoff = time.Second
+const OutboxMaxBackoff = 5 * time.Minute
+
+/* HTTP header with key of update, the same for all its retries */
+const IdempotencyHeader = "Idempotency-Key"
+
+/* webmap remembers that many recent keys */
+const IdempotencyKeys = 65536
+
+/* update is malformed, there is no point in retrying */
+var ErrUpdateRejected = errors.New("update rejected")
+
+/* keys are unique across restarts */
+var key_prefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+var key_seq atomic.Int64
+
+func update_key() string {
+    return key_prefix + "-" + strconv.FormatInt(key_seq.Add(1), 10)
+}
+
+/*
+ * update waiting for delivery; Next is the time of next attempt.
+ * Replaceable update is merged into the next one of the same user
+ * to the same URL when it is queued, see OutboxMerge
+ */
+type OutboxItem struct {
+    Key         string
+    UserID      int64
+    URL         string
+    Body        json.RawMessage
+    Replaceable bool         `json:",omitempty"`
+    Tries       int          `json:",omitempty"`
+    Next        time.Time
+}
+
+type OutboxSender func(url string, key string, body []byte) error
+
+/* body of update that carries also older one, which is replaced */
+type OutboxMerge func(old []byte, body []byte) ([]byte, error)
+
+/*
+ * updates from bot to webmap, kept in file until delivered;
+ * updates of the same user are delivered in order
+ */
+type Outbox struct {
+    mu        sync.Mutex
+    items     []*OutboxItem
+    Name      string
+    File      string
+    tmpdir    string
+    send      OutboxSender
+    wake      chan struct{}
+
+    /* replaceable updates are kept separately if not set */
+    merge     OutboxMerge
+
+    /* serializes writers of File */
+    save_mu   sync.Mutex
+}
+
+/* by default outbox is kept next to state file */
+func outbox_file(conf *UserConfig) string {
+
+    if len(conf.OutboxFile) != 0 {
+        return conf.OutboxFile
+    }
+
+    return filepath.Join(filepath.Dir(conf.StateFile), "outbox.json")
+}
+
+func CreateOutbox(file string, tmpdir string, send OutboxSender) (*Outbox, error) {
+
+    ob := &Outbox{
+        Name: "outbox",
+        File: file,
+        tmpdir: tmpdir,
+        send: send,
+        wake: make(chan struct{}, 1),
+    }
+
+    txt, err := os.ReadFile(file)
+    if errors.Is(err, os.ErrNotExist) {
+        return ob, nil
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    err = json.Unmarshal(txt, &ob.items)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse outbox: %v", err)
+    }
+
+    log.Printf("outbox '%s' loaded, %d updates pending", file, len(ob.items))
+
+    return ob, nil
+}
+
+func (ob *Outbox) depth() int {
+
+    ob.mu.Lock()
+    defer ob.mu.Unlock()
+
+    return len(ob.items)
+}
+
+/* queues update of user for delivery; fails if it cannot be kept */
+func (ob *Outbox) push(url string, userid int64, body []byte,
+                       replaceable bool) error {
+    return ob.push_key("", url, userid, body, replaceable)
+}
+
+/* relayed update keeps its key, new one is made if it is empty */
+func (ob *Outbox) push_key(key string, url string, userid int64,
+                           body []byte, replaceable bool) error {
+
+    if len(key) == 0 {
+        key = update_key()
+    }
+
+    ob.mu.Lock()
+
+    item := &OutboxItem{
+        Key: key,
+        UserID: userid,
+        URL: url,
+        Body: body,
+        Replaceable: replaceable,
+    }
+
+    /*
+     * queue holds at most one replaceable update per user and URL,
+     * nothing is lost, it is merged into the new one; the new one
+     * waits for retry of replaced, not to hammer the sink
+     */
+    kept := ob.items[:0]
+
+    for _, old := range ob.items {
+        if ob.merge != nil && old.Replaceable && old.UserID == userid &&
+           old.URL == url {
+
+            merged, err := ob.merge(old.Body, item.Body)
+            if err == nil {
+                item.Body = merged
+                item.Tries = old.Tries
+                item.Next = old.Next
+                continue
+            }
+
+            log.Printf("%s: update %s is not merged: %v", ob.Name, old.Key,
+                       err)
+        }
+
+        kept = append(kept, old)
+    }
+
+    ob.items = append(kept, item)
+
+    ob.mu.Unlock()
+
+    err := ob.save()
+
+    select {
+    case ob.wake <- struct{}{}:
+    default:
+    }
+
+    return err
+}
+
+/* updates to be sent now: the oldest of every user, if it is time */
+func (ob *Outbox) due(now time.Time) ([]OutboxItem, time.Time) {
+
+    ob.mu.Lock()
+    defer ob.mu.Unlock()
+
+    var out []OutboxItem
+    var next time.Time
+
+    head := make(map[int64]bool)
+
+    for _, item := range ob.items {
+        if head[item.UserID] {
+            continue
+        }
+
+        head[item.UserID] = true
+
+        if item.Next.After(now) {
+            if next.IsZero() || item.Next.Before(next) {
+                next = item.Next
+            }
+            continue
+        }
+
+        out = append(out, *item)
+    }
+
+    return out, next
+}
+
+/* attempt is over: update is forgotten, or retried later */
+func (ob *Outbox) done(key string, err error, now time.Time) {
+
+    ob.mu.Lock()
+    defer ob.mu.Unlock()
+
+    for i, item := range ob.items {
+        if item.Key != key {
+            continue
+        }
+
+        if err == nil || errors.Is(err, ErrUpdateRejected) {
+            ob.items = append(ob.items[:i], ob.items[i + 1:]...)
+            return
+        }
+
+        backoff := OutboxBackoff << min_int(item.Tries, 16)
+        if backoff > OutboxMaxBackoff {
+            backoff = OutboxMaxBackoff
+        }
+
+        item.Tries++
+        item.Next = now.Add(backoff)
+
+        return
+    }
+}
+
+/*
+ * one round of delivery; returns number of delivered or dropped updates
+ * and time of the next attempt, zero if nothing is waiting
+ */
+func (ob *Outbox) flush(now time.Time) (int, time.Time) {
+
+    items, next := ob.due(now)
+
+    sent := 0
+    failed := 0
+
+    for i := range items {
+        item := &items[i]
+
+        err := ob.send(item.URL, item.Key, item.Body)
+
+        switch {
+        case err == nil:
+            sent++
+
+        case errors.Is(err, ErrUpdateRejected):
+            sent++
+            log.Printf("%s: update %s dropped: %v", ob.Name, item.Key, err)
+
+        default:
+            failed++
+            log.Printf("%s: update %s failed (try %d): %v",
+                       ob.Name, item.Key, item.Tries + 1, err)
+        }
+
+        ob.done(item.Key, err, now)
+    }
+
+    if len(items) != 0 {
+        err := ob.save()
+        if err != nil {
+            log.Printf("failed to update outbox file: %v", err)
+        }
+    }
+
+    if failed != 0 {
+        log.Printf("%s: %d updates pending", ob.Name, ob.depth())
+    }
+
+    if sent != 0 {
+        /* next updates of the same users are due now */
+        return sent, now
+    }
+
+    _, next = ob.due(now)
+
+    return sent, next
+}
+
+/* delivers updates till context is done */
+func (ob *Outbox) run(ctx context.Context) {
+
+    timer := time.NewTimer(0)
+    defer timer.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+
+        case <-ob.wake:
+        case <-timer.C:
+        }
+
+        sent, next := ob.flush(time.Now())
+
+        if sent != 0 {
+            for sent != 0 {
+                sent, next = ob.flush(time.Now())
+            }
+
+            if depth := ob.depth(); depth != 0 {
+                log.Printf("%s: %d updates pending", ob.Name, depth)
+            }
+        }
+
+        if !timer.Stop() {
+            select {
+            case <-timer.C:
+            default:
+            }
+        }
+
+        if !next.IsZero() {
+            timer.Reset(time.Until(next))
+        }
+    }
+}
+
+func (ob *Outbox) save() error {
+
+    ob.save_mu.Lock()
+    defer ob.save_mu.Unlock()
+
+    ob.mu.Lock()
+    txt, err := json.Marshal(ob.items)
+    ob.mu.Unlock()
+
+    if err != nil {
+        return fmt.Errorf("failed to export JSON: %v", err)
+    }
+
+    f, err := os.CreateTemp(ob.tmpdir, "")
+    if err != nil {
+        return fmt.Errorf("failed to open temp file: %v", err)
+    }
+
+    _, err = f.Write(txt)
+    if err == nil {
+        /* queue must survive crash, not only restart */
+        err = f.Sync()
+    }
+
+    if err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = f.Close()
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = os.Rename(f.Name(), ob.File)
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    return nil
+}
+
+/* recently seen idempotency keys, the oldest are forgotten first */
+type KeyCache struct {
+    mu        sync.Mutex
+    keys      map[string]bool
+    order     []string
+    size      int
+}
+
+func CreateKeyCache(size int) *KeyCache {
+    return &KeyCache{ keys: make(map[string]bool), size: size }
+}
+
+func (kc *KeyCache) has(key string) bool {
+
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+
+    return kc.keys[key]
+}
+
+/* remembers key; false if it was seen already */
+func (kc *KeyCache) add(key string) bool {
+
+    kc.mu.Lock()
+    defer kc.mu.Unlock()
+
+    if kc.keys[key] {
+        return false
+    }
+
+    if len(kc.order) == kc.size {
+        delete(kc.keys, kc.order[0])
+        kc.order = kc.order[1:]
+    }
+
+    kc.keys[key] = true
+    kc.order = append(kc.order, key)
+
+    return true
+}
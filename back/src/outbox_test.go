@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "time"
+    "errors"
+    "testing"
+    "path/filepath"
+)
+
+func TestOutbox(t *testing.T) {
+
+    dir := t.TempDir()
+    file := filepath.Join(dir, "outbox.json")
+
+    var got []string
+    down := map[int64]bool{ 1: true }
+
+    send := func(url string, key string, body []byte) error {
+        if url == "bad" {
+            return ErrUpdateRejected
+        }
+        if down[int64(body[1] - '0')] {
+            return errors.New("connection refused")
+        }
+        got = append(got, string(body[1:3]))
+        return nil
+    }
+
+    ob, err := CreateOutbox(file, dir, send)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    /* bodies are JSON strings, first digit is user */
+    for _, u := range []struct { url string; id int64; body string } {
+        { "pos", 1, `"1a"` },
+        { "pos", 2, `"2a"` },
+        { "bad", 2, `"2b"` },
+        { "pos", 1, `"1b"` },
+        { "pos", 2, `"2c"` },
+    } {
+        err = ob.push(u.url, u.id, []byte(u.body), false)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    now := time.Unix(1000, 0)
+
+    /* first user is blocked, second is delivered in order, rejected is dropped */
+    for sent := 1; sent != 0; {
+        sent, _ = ob.flush(now)
+    }
+
+    if len(got) != 2 || got[0] != "2a" || got[1] != "2c" || ob.depth() != 2 {
+        t.Fatalf("wrong delivery: %v, %d pending", got, ob.depth())
+    }
+
+    /* backoff after failures */
+    _, next := ob.flush(now.Add(time.Second))
+    if next != now.Add(3 * time.Second) {
+        t.Fatalf("wrong retry time %v", next.Sub(now))
+    }
+
+    /* pending updates survive restart and keep order */
+    ob, err = CreateOutbox(file, dir, send)
+    if err != nil || ob.depth() != 2 {
+        t.Fatalf("outbox is not restored: %v", err)
+    }
+
+    down[1] = false
+
+    for sent := 1; sent != 0; {
+        sent, _ = ob.flush(now.Add(time.Hour))
+    }
+
+    if len(got) != 4 || got[2] != "1a" || got[3] != "1b" || ob.depth() != 0 {
+        t.Fatalf("wrong delivery: %v, %d pending", got, ob.depth())
+    }
+}
+
+func TestOutboxReplace(t *testing.T) {
+
+    dir := t.TempDir()
+
+    var got []string
+
+    send := func(url string, key string, body []byte) error {
+        got = append(got, string(body))
+        return nil
+    }
+
+    ob, err := CreateOutbox(filepath.Join(dir, "outbox.json"), dir, send)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    /* replaced are not lost, new body carries them */
+    ob.merge = func(old []byte, body []byte) ([]byte, error) {
+        return []byte(`"` + string(old[1:len(old) - 1]) + "+" +
+                      string(body[1:])), nil
+    }
+
+    /* only the last position without check-ins is queued per user and URL */
+    for _, u := range []struct { url string; id int64; body string; r bool } {
+        { "pos", 1, `"1a"`, true },
+        { "pos", 1, `"1b"`, false },
+        { "pos", 1, `"1c"`, true },
+        { "pos", 2, `"2a"`, true },
+        { "st", 1, `"1d"`, false },
+        { "pos", 1, `"1e"`, true },
+    } {
+        err = ob.push(u.url, u.id, []byte(u.body), u.r)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if ob.depth() != 4 {
+        t.Fatalf("replaced updates are queued: %d pending", ob.depth())
+    }
+
+    for sent := 1; sent != 0; {
+        sent, _ = ob.flush(time.Now())
+    }
+
+    want := []string{ `"1a+1b"`, `"2a"`, `"1d"`, `"1c+1e"` }
+
+    if len(got) != len(want) {
+        t.Fatalf("wrong delivery: %v", got)
+    }
+
+    for i := range want {
+        if got[i] != want[i] {
+            t.Fatalf("wrong delivery: %v", got)
+        }
+    }
+}
+
+func TestKeyCache(t *testing.T) {
+
+    kc := CreateKeyCache(2)
+
+    if !kc.add("a") || kc.add("a") || !kc.has("a") {
+        t.Fatalf("duplicate is not detected")
+    }
+
+    kc.add("b")
+    kc.add("c")
+
+    if kc.has("a") || !kc.has("b") || !kc.has("c") {
+        t.Fatalf("oldest key is not forgotten")
+    }
+}
@@ -20,7 +20,13 @@
 
 package main
 
+import (
+    "sync"
+)
+
+/* fixed size ring, safe for concurrent use */
 type RingBuffer struct {
+    mu       sync.Mutex
     buffer   []interface{}
     size     int
     index    int
@@ -37,14 +43,34 @@ func CreateRing(size int) *RingBuffer {
 
 
 func (rng *RingBuffer) push(data interface{}) {
+    rng.mu.Lock()
+    defer rng.mu.Unlock()
+
     rng.buffer[rng.index] = data
     rng.index = (rng.index + 1) % rng.size
 }
 
 
-func (rng *RingBuffer) extract() []GeoPos {
+/* independent copy of ring with the same contents */
+func (rng *RingBuffer) clone() *RingBuffer {
+    rng.mu.Lock()
+    defer rng.mu.Unlock()
+
+    out := CreateRing(rng.size)
+
+    copy(out.buffer, rng.buffer)
+    out.index = rng.index
+
+    return out
+}
+
+
+func (rng *RingBuffer) extract() []TrackPoint {
+
+    rng.mu.Lock()
+    defer rng.mu.Unlock()
 
-    var values []GeoPos
+    var values []TrackPoint
 
     i := rng.index
 
@@ -54,7 +80,7 @@ func (rng *RingBuffer) extract() []GeoPos {
             i = (i + 1) % rng.size
             continue
         }
-        values = append(values, rng.buffer[i].(GeoPos))
+        values = append(values, rng.buffer[i].(TrackPoint))
         i = (i + 1) % rng.size
     }
 
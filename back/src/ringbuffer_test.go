@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "sync"
+    "testing"
+)
+
+func TestRingOrder(t *testing.T) {
+
+    rng := CreateRing(4)
+
+    if len(rng.extract()) != 0 {
+        t.Fatalf("new ring is not empty")
+    }
+
+    for i := 1; i <= 6; i++ {
+        rng.push(TrackPoint{Lat: float64(i)})
+    }
+
+    vals := rng.extract()
+    if len(vals) != 4 {
+        t.Fatalf("expected 4 values, got %d", len(vals))
+    }
+
+    /* oldest first */
+    for i, v := range vals {
+        if v.Lat != float64(i + 3) {
+            t.Fatalf("value %d: expected %v, got %v", i, i + 3, v.Lat)
+        }
+    }
+}
+
+func TestRingClone(t *testing.T) {
+
+    rng := CreateRing(4)
+    rng.push(TrackPoint{Lat: 1})
+
+    cp := rng.clone()
+    rng.push(TrackPoint{Lat: 2})
+
+    if len(cp.extract()) != 1 {
+        t.Fatalf("clone is affected by push to original")
+    }
+
+    if len(rng.extract()) != 2 {
+        t.Fatalf("original lost values")
+    }
+}
+
+func TestRingConcurrent(t *testing.T) {
+
+    var wg sync.WaitGroup
+
+    rng := CreateRing(TrackDepth)
+
+    for g := 0; g < 8; g++ {
+        wg.Add(2)
+
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 1000; i++ {
+                rng.push(TrackPoint{Lat: float64(g), Lon: float64(i)})
+            }
+        }(g)
+
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 1000; i++ {
+                if len(rng.extract()) > TrackDepth {
+                    t.Errorf("ring overflow")
+                    return
+                }
+                rng.clone()
+            }
+        }()
+    }
+
+    wg.Wait()
+
+    if len(rng.extract()) != TrackDepth {
+        t.Fatalf("ring is not full after all pushes")
+    }
+}
@@ -0,0 +1,739 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "math"
+    "sort"
+    "time"
+    "encoding/xml"
+)
+
+const EarthRadius = 6371000.0 /* meters */
+
+/* side of spatial index cell, meters */
+const RouteCellSize = 200.0
+
+/*
+ * tracks and segments of GPX are ridden one after another;
+ * a longer jump between them is not a road, nobody is projected there
+ */
+const RouteMaxGap = 200.0
+
+/*
+ * Matching a fix to route when road is used more than once
+ * (out-and-back, laps): all passes not farther than the closest one
+ * plus RouteMatchSlack are candidates; passes behind last known position
+ * more than RouteBackTolerance, or too far ahead for RouteMaxSpeed, are
+ * not considered; a pass going against rider's direction costs
+ * RouteWrongWay meters, going back costs as much as the distance;
+ * and among the rest the least progress wins, with RouteProgressWeight
+ * meters of cost per meter of progress
+ */
+const RouteMatchSlack = 50.0
+const RouteBackTolerance = 200.0
+const RouteMaxSpeed = 20.0         /* m/s */
+const RouteWrongWay = 1000.0
+const RouteProgressWeight = 0.01
+
+/* movement shorter than this tells nothing about direction */
+const RouteMinMove = 15.0
+
+/* GPX waypoints farther from route are not checkpoints */
+const RouteCheckpointMaxDist = 500.0
+
+/* default geofence of checkpoint, meters */
+const RouteCheckpointRadius = 100.0
+
+/* point of route with distance from route start */
+type RoutePoint struct {
+    Lat      float64
+    Lon      float64
+    Ele      float64
+    Offset   float64
+
+    /* segment ending at this point is a gap between GPX segments */
+    Gap      bool
+}
+
+/* event route, loaded from GPX */
+type Route struct {
+    Name        string
+    points      []RoutePoint
+    Length      float64
+    Checkpoints []RouteCheckpoint
+    grid       *RouteGrid
+}
+
+/* named place on route, riders check in within Radius meters of it */
+type RouteCheckpoint struct {
+    Name     string
+    Lat      float64
+    Lon      float64
+    Offset   float64
+    Radius   float64
+}
+
+/*
+ * uniform grid over route segments: each cell lists segments
+ * (by index of their end point) whose bounding box touches it
+ */
+type RouteGrid struct {
+    lat0     float64
+    lon0     float64
+    kx       float64   /* meters per degree of longitude */
+    ky       float64   /* meters per degree of latitude */
+
+    minx     int
+    miny     int
+    maxx     int
+    maxy     int
+
+    cells    map[[2]int][]int
+}
+
+/*
+ * where user is relative to route, in meters;
+ * never modified once created, so may be shared between snapshots
+ */
+type RouteProgress struct {
+    Position   float64   /* covered, along route from start */
+    Remaining  float64   /* left to finish */
+    Diverge    float64   /* distance from route */
+}
+
+/* position of rider to be matched with route */
+type RouteFix struct {
+    Lat      float64
+    Lon      float64
+    At       time.Time
+    Heading  int       /* 1-360 degrees, 0 if unknown */
+}
+
+/* candidate pass of route near a fix */
+type routeMatch struct {
+    seg      int
+    dist     float64
+    off      float64
+}
+
+/* subset of GPX 1.1 we are interested in */
+type gpxPoint struct {
+    Lat      float64   `xml:"lat,attr"`
+    Lon      float64   `xml:"lon,attr"`
+    Ele      float64   `xml:"ele"`
+    Name     string    `xml:"name"`
+}
+
+type gpxSegment struct {
+    Points   []gpxPoint   `xml:"trkpt"`
+}
+
+type gpxTrack struct {
+    Name     string        `xml:"name"`
+    Segments []gpxSegment  `xml:"trkseg"`
+}
+
+type gpxFile struct {
+    Tracks    []gpxTrack   `xml:"trk"`
+    Waypoints []gpxPoint   `xml:"wpt"`
+}
+
+
+func parse_gpx(fn string) (*gpxFile, error) {
+
+    data, err := os.ReadFile(fn)
+    if err != nil {
+        return nil, err
+    }
+
+    var gpx gpxFile
+
+    err = xml.Unmarshal(data, &gpx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse GPX '%s': %v", fn, err)
+    }
+
+    return &gpx, nil
+}
+
+func LoadRoute(fn string) (*Route, error) {
+
+    gpx, err := parse_gpx(fn)
+    if err != nil {
+        return nil, err
+    }
+
+    rt := new(Route)
+
+    /* all tracks and segments are ridden one after another */
+    for _, trk := range gpx.Tracks {
+
+        if len(rt.Name) == 0 {
+            rt.Name = trk.Name
+        }
+
+        for _, seg := range trk.Segments {
+            for i, p := range seg.Points {
+                rt.add(p.Lat, p.Lon, p.Ele, i == 0)
+            }
+        }
+    }
+
+    if len(rt.points) < 2 {
+        return nil, fmt.Errorf("route '%s' has less than 2 points", fn)
+    }
+
+    rt.build_index()
+
+    if len(rt.grid.cells) == 0 {
+        return nil, fmt.Errorf("route '%s' has no segments to ride", fn)
+    }
+
+    for _, w := range gpx.Waypoints {
+
+        p := rt.project(w.Lat, w.Lon)
+        if p.Diverge > RouteCheckpointMaxDist {
+            continue
+        }
+
+        rt.add_checkpoint(w.Name, w.Lat, w.Lon, RouteCheckpointRadius)
+    }
+
+    return rt, nil
+}
+
+/* checkpoints are kept ordered along route */
+func (rt *Route) add_checkpoint(name string, lat float64, lon float64,
+                                radius float64) {
+
+    p := rt.project(lat, lon)
+
+    rt.Checkpoints = append(rt.Checkpoints, RouteCheckpoint{
+        Name: name,
+        Lat: lat,
+        Lon: lon,
+        Offset: p.Position,
+        Radius: radius,
+    })
+
+    sort.SliceStable(rt.Checkpoints, func(i, j int) bool {
+        return rt.Checkpoints[i].Offset < rt.Checkpoints[j].Offset
+    })
+}
+
+/* first point of GPX segment may follow a gap */
+func (rt *Route) add(lat float64, lon float64, ele float64, first bool) {
+
+    var p RoutePoint
+
+    p.Lat = lat
+    p.Lon = lon
+    p.Ele = ele
+
+    n := len(rt.points)
+
+    if n > 0 {
+        prev := &rt.points[n - 1]
+        d := geo_distance(prev.Lat, prev.Lon, lat, lon)
+
+        if d == 0 {
+            /* duplicate point, typically where segments are joined */
+            return
+        }
+
+        p.Offset = prev.Offset + d
+        p.Gap = first && d > RouteMaxGap
+    }
+
+    rt.points = append(rt.points, p)
+    rt.Length = p.Offset
+}
+
+func (rt *Route) build_index() {
+
+    g := new(RouteGrid)
+
+    g.lat0 = rt.points[0].Lat
+    g.lon0 = rt.points[0].Lon
+    g.ky = EarthRadius * math.Pi / 180
+    g.kx = g.ky * math.Cos(g.lat0 * math.Pi / 180)
+    g.cells = make(map[[2]int][]int)
+
+    for i := 1; i < len(rt.points); i++ {
+
+        if rt.points[i].Gap {
+            continue
+        }
+
+        a := &rt.points[i - 1]
+        b := &rt.points[i]
+
+        ax, ay := g.cell(a.Lat, a.Lon)
+        bx, by := g.cell(b.Lat, b.Lon)
+
+        for x := min_int(ax, bx); x <= max_int(ax, bx); x++ {
+            for y := min_int(ay, by); y <= max_int(ay, by); y++ {
+                g.add(x, y, i)
+            }
+        }
+    }
+
+    rt.grid = g
+}
+
+func (g *RouteGrid) cell(lat float64, lon float64) (int, int) {
+    x := (lon - g.lon0) * g.kx / RouteCellSize
+    y := (lat - g.lat0) * g.ky / RouteCellSize
+
+    return int(math.Floor(x)), int(math.Floor(y))
+}
+
+/*
+ * smallest width of cell between the point and route: grid is scaled
+ * at lat0, closer to pole degree of longitude is shorter
+ */
+func (g *RouteGrid) cell_size(lat float64) float64 {
+
+    k := math.Cos(lat * math.Pi / 180) / math.Cos(g.lat0 * math.Pi / 180)
+
+    if k >= 1 {
+        return RouteCellSize
+    }
+
+    return RouteCellSize * math.Max(k, 0.01)
+}
+
+func (g *RouteGrid) add(x int, y int, seg int) {
+
+    if len(g.cells) == 0 {
+        g.minx, g.maxx, g.miny, g.maxy = x, x, y, y
+
+    } else {
+        g.minx = min_int(g.minx, x)
+        g.maxx = max_int(g.maxx, x)
+        g.miny = min_int(g.miny, y)
+        g.maxy = max_int(g.maxy, y)
+    }
+
+    key := [2]int{x, y}
+    g.cells[key] = append(g.cells[key], seg)
+}
+
+/*
+ * calls fn for segments in cells at Chebyshev distance r from (cx, cy);
+ * returns false if there is nothing beyond this ring
+ */
+func (g *RouteGrid) ring(cx int, cy int, r int, fn func(seg int)) bool {
+
+    visit := func(x int, y int) {
+        for _, seg := range g.cells[[2]int{x, y}] {
+            fn(seg)
+        }
+    }
+
+    /* only part of ring that overlaps grid */
+    x0 := max_int(cx - r, g.minx)
+    x1 := min_int(cx + r, g.maxx)
+    y0 := max_int(cy - r + 1, g.miny)
+    y1 := min_int(cy + r - 1, g.maxy)
+
+    if r == 0 {
+        visit(cx, cy)
+
+    } else {
+        for x := x0; x <= x1; x++ {
+            if cy - r >= g.miny {
+                visit(x, cy - r)
+            }
+            if cy + r <= g.maxy {
+                visit(x, cy + r)
+            }
+        }
+
+        for y := y0; y <= y1; y++ {
+            if cx - r >= g.minx {
+                visit(cx - r, y)
+            }
+            if cx + r <= g.maxx {
+                visit(cx + r, y)
+            }
+        }
+    }
+
+    return !(cx - r <= g.minx && cx + r >= g.maxx &&
+             cy - r <= g.miny && cy + r >= g.maxy)
+}
+
+/* rings closer than this one do not touch grid */
+func (g *RouteGrid) first_ring(cx int, cy int) int {
+    return max_int(max_int(0, g.minx - cx), max_int(cx - g.maxx,
+           max_int(g.miny - cy, cy - g.maxy)))
+}
+
+func min_int(a int, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+func max_int(a int, b int) int {
+    if a > b {
+        return a
+    }
+    return b
+}
+
+/* closest point of route, no history is taken into account */
+func (rt *Route) project(lat float64, lon float64) *RouteProgress {
+
+    best := math.Inf(1)
+    var pos float64
+
+    check := func(seg int) {
+        d, off := rt.project_segment(seg, lat, lon)
+        if d < best || (d == best && off < pos) {
+            best = d
+            pos = off
+        }
+    }
+
+    g := rt.grid
+    cx, cy := g.cell(lat, lon)
+    size := g.cell_size(lat)
+
+    /*
+     * walk rings of cells around the point; segments in the next ring
+     * are at least r cells away, so stop once we have something closer
+     */
+    for r := g.first_ring(cx, cy); ; r++ {
+        more := g.ring(cx, cy, r, check)
+
+        if !more || best <= float64(r) * size {
+            break
+        }
+    }
+
+    return &RouteProgress{
+        Position: pos,
+        Remaining: rt.Length - pos,
+        Diverge: best,
+    }
+}
+
+/* all passes of route around the point, see RouteMatchSlack */
+func (rt *Route) matches(lat float64, lon float64) []routeMatch {
+
+    nearest := rt.project(lat, lon)
+    radius := nearest.Diverge + RouteMatchSlack
+
+    var out []routeMatch
+
+    seen := make(map[int]bool)
+
+    check := func(seg int) {
+        if seen[seg] {
+            return
+        }
+        seen[seg] = true
+
+        d, off := rt.project_segment(seg, lat, lon)
+        if d <= radius {
+            out = append(out, routeMatch{ seg: seg, dist: d, off: off })
+        }
+    }
+
+    g := rt.grid
+    cx, cy := g.cell(lat, lon)
+
+    last := int(math.Ceil(radius / g.cell_size(lat))) + 1
+
+    /* nearest pass is always among matches, look further if missed */
+    for r := g.first_ring(cx, cy); r <= last || len(out) == 0; r++ {
+        if !g.ring(cx, cy, r, check) {
+            break
+        }
+    }
+
+    return out
+}
+
+/*
+ * Finds where rider is on route, given the previous fix and progress,
+ * if known.  Route position never decreases.
+ */
+func (rt *Route) locate(fix *RouteFix, from *RouteFix,
+                        prev *RouteProgress) *RouteProgress {
+
+    candidates := rt.matches(fix.Lat, fix.Lon)
+
+    /* direction of movement, if it can be trusted */
+    bearing := -1.0
+
+    var moved float64
+
+    if from != nil {
+        moved = geo_distance(from.Lat, from.Lon, fix.Lat, fix.Lon)
+        if moved >= RouteMinMove {
+            bearing = geo_bearing(from.Lat, from.Lon, fix.Lat, fix.Lon)
+        }
+    }
+
+    if bearing < 0 && fix.Heading > 0 {
+        bearing = float64(fix.Heading % 360)
+    }
+
+    var base float64
+
+    if prev != nil {
+        base = prev.Position
+
+        /* drop passes the rider could not be on */
+        lo := base - RouteBackTolerance
+        hi := math.Inf(1)
+
+        if from != nil && fix.At.After(from.At) {
+            dt := fix.At.Sub(from.At).Seconds()
+            hi = base + math.Max(moved, RouteMaxSpeed * dt) + RouteMatchSlack
+        }
+
+        var feasible []routeMatch
+
+        for _, m := range candidates {
+            if m.off >= lo && m.off <= hi {
+                feasible = append(feasible, m)
+            }
+        }
+
+        if len(feasible) != 0 {
+            candidates = feasible
+        }
+    }
+
+    var best *routeMatch
+    var best_cost float64
+
+    for i := range candidates {
+        m := &candidates[i]
+
+        cost := m.dist
+
+        if m.off < base {
+            cost += base - m.off
+        } else {
+            cost += (m.off - base) * RouteProgressWeight
+        }
+
+        if bearing >= 0 && angle_diff(bearing, rt.heading(m, moved)) > 90 {
+            cost += RouteWrongWay
+        }
+
+        if best == nil || cost < best_cost {
+            best = m
+            best_cost = cost
+        }
+    }
+
+    pos, dist := 0.0, 0.0
+
+    if best != nil {
+        pos, dist = best.off, best.dist
+
+    } else {
+        /* no pass found around the point, take the closest one */
+        nearest := rt.project(fix.Lat, fix.Lon)
+        pos, dist = nearest.Position, nearest.Diverge
+    }
+
+    if prev != nil && pos < prev.Position {
+        pos = prev.Position
+    }
+
+    return &RouteProgress{
+        Position: pos,
+        Remaining: rt.Length - pos,
+        Diverge: dist,
+    }
+}
+
+/*
+ * direction the rider would have if riding this pass: from the place
+ * on route 'moved' meters back, or along the segment if not moved
+ */
+func (rt *Route) heading(m *routeMatch, moved float64) float64 {
+
+    lat, lon := rt.point_at(m.off)
+
+    if moved >= RouteMinMove && m.off > 0 {
+        plat, plon := rt.point_at(m.off - moved)
+        if geo_distance(plat, plon, lat, lon) >= RouteMinMove {
+            return geo_bearing(plat, plon, lat, lon)
+        }
+    }
+
+    a := &rt.points[m.seg - 1]
+    b := &rt.points[m.seg]
+
+    return geo_bearing(a.Lat, a.Lon, b.Lat, b.Lon)
+}
+
+/* first checkpoint ahead of given distance from route start, if any */
+func (rt *Route) next_checkpoint(offset float64) *RouteCheckpoint {
+
+    for i := range rt.Checkpoints {
+        if rt.Checkpoints[i].Offset > offset {
+            return &rt.Checkpoints[i]
+        }
+    }
+
+    return nil
+}
+
+/* total climbing between two distances from route start, meters */
+func (rt *Route) ascent(from float64, to float64) float64 {
+
+    var up float64
+
+    /* first segment ending after from */
+    i := sort.Search(len(rt.points),
+                     func(k int) bool { return rt.points[k].Offset > from })
+
+    for i = max_int(i, 1); i < len(rt.points); i++ {
+        a := &rt.points[i - 1]
+        b := &rt.points[i]
+
+        if a.Offset >= to {
+            break
+        }
+
+        dh := b.Ele - a.Ele
+        if dh <= 0 {
+            continue
+        }
+
+        /* only part of segment may be in range */
+        lo := math.Max(a.Offset, from)
+        hi := math.Min(b.Offset, to)
+
+        up += dh * (hi - lo) / (b.Offset - a.Offset)
+    }
+
+    return up
+}
+
+/* coordinates of place at given distance from route start */
+func (rt *Route) point_at(off float64) (float64, float64) {
+
+    n := len(rt.points)
+
+    /* first point at or after off */
+    i := sort.Search(n, func(k int) bool { return rt.points[k].Offset >= off })
+
+    if i == 0 {
+        return rt.points[0].Lat, rt.points[0].Lon
+    }
+
+    if i == n {
+        return rt.points[n - 1].Lat, rt.points[n - 1].Lon
+    }
+
+    a := &rt.points[i - 1]
+    b := &rt.points[i]
+
+    f := (off - a.Offset) / (b.Offset - a.Offset)
+
+    return a.Lat + (b.Lat - a.Lat) * f, a.Lon + (b.Lon - a.Lon) * f
+}
+
+/*
+ * projects point onto segment ending at points[i]:
+ * returns distance to segment and route offset of the projection
+ */
+func (rt *Route) project_segment(i int, lat float64, lon float64) (float64, float64) {
+
+    a := &rt.points[i - 1]
+    b := &rt.points[i]
+
+    /* small distances: flat approximation around segment start */
+    k := math.Cos(a.Lat * math.Pi / 180)
+
+    bx := (b.Lon - a.Lon) * k
+    by := b.Lat - a.Lat
+    px := (lon - a.Lon) * k
+    py := lat - a.Lat
+
+    var t float64
+
+    l2 := bx * bx + by * by
+    if l2 > 0 {
+        t = (px * bx + py * by) / l2
+        t = math.Max(0, math.Min(1, t))
+    }
+
+    clat := a.Lat + t * (b.Lat - a.Lat)
+    clon := a.Lon + t * (b.Lon - a.Lon)
+
+    d := geo_distance(lat, lon, clat, clon)
+
+    return d, a.Offset + t * (b.Offset - a.Offset)
+}
+
+/* haversine distance in meters */
+func geo_distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+
+    const rad = math.Pi / 180
+
+    dlat := (lat2 - lat1) * rad
+    dlon := (lon2 - lon1) * rad
+
+    a := math.Sin(dlat / 2) * math.Sin(dlat / 2) +
+         math.Cos(lat1 * rad) * math.Cos(lat2 * rad) *
+         math.Sin(dlon / 2) * math.Sin(dlon / 2)
+
+    return 2 * EarthRadius * math.Asin(math.Sqrt(a))
+}
+
+/* initial bearing from first point to second, degrees 0-360 */
+func geo_bearing(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+
+    const rad = math.Pi / 180
+
+    dlon := (lon2 - lon1) * rad
+
+    y := math.Sin(dlon) * math.Cos(lat2 * rad)
+    x := math.Cos(lat1 * rad) * math.Sin(lat2 * rad) -
+         math.Sin(lat1 * rad) * math.Cos(lat2 * rad) * math.Cos(dlon)
+
+    return math.Mod(math.Atan2(y, x) / rad + 360, 360)
+}
+
+/* smallest angle between two directions, 0-180 degrees */
+func angle_diff(a float64, b float64) float64 {
+    d := math.Mod(math.Abs(a - b), 360)
+    if d > 180 {
+        d = 360 - d
+    }
+    return d
+}
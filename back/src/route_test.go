@@ -0,0 +1,482 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "os"
+    "math"
+    "time"
+    "testing"
+    "math/rand"
+    "path/filepath"
+)
+
+/* path to sample route, relative to src */
+const TestRouteFile = "../../conf/track.gpx"
+
+/* straight route to the north along meridian, ~1112 meters */
+func test_line_route() *Route {
+
+    rt := new(Route)
+
+    for i := 0; i <= 10; i++ {
+        rt.add(55 + float64(i) / 1000, 37, 0, i == 0)
+    }
+
+    rt.build_index()
+
+    return rt
+}
+
+func TestGeoDistance(t *testing.T) {
+
+    /* one degree of latitude */
+    d := geo_distance(55, 37, 56, 37)
+    if math.Abs(d - 111195) > 10 {
+        t.Fatalf("wrong distance: %v", d)
+    }
+
+    if geo_distance(55, 37, 55, 37) != 0 {
+        t.Fatalf("distance to itself is not zero")
+    }
+}
+
+func TestRouteProject(t *testing.T) {
+
+    rt := test_line_route()
+
+    if math.Abs(rt.Length - 1112) > 1 {
+        t.Fatalf("wrong route length: %v", rt.Length)
+    }
+
+    /* halfway, ~100 meters to the east */
+    p := rt.project(55.005, 37.00157)
+
+    if math.Abs(p.Position - 556) > 1 {
+        t.Fatalf("wrong position: %v", p.Position)
+    }
+
+    if math.Abs(p.Remaining - (rt.Length - p.Position)) > 0.001 {
+        t.Fatalf("wrong remaining: %v", p.Remaining)
+    }
+
+    if math.Abs(p.Diverge - 100) > 1 {
+        t.Fatalf("wrong divergence: %v", p.Diverge)
+    }
+
+    /* before start */
+    p = rt.project(54.99, 37)
+    if p.Position != 0 || math.Abs(p.Diverge - 1112) > 1 {
+        t.Fatalf("wrong projection before start: %+v", p)
+    }
+}
+
+func TestLoadRoute(t *testing.T) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        t.Fatalf("failed to load route: %v", err)
+    }
+
+    if len(rt.points) < 1000 || rt.Length < 10000 {
+        t.Fatalf("route is too short: %d points, %v m", len(rt.points), rt.Length)
+    }
+
+    /* every route point lies on route */
+    for i := 0; i < len(rt.points); i += 100 {
+        p := rt.points[i]
+
+        pr := rt.project(p.Lat, p.Lon)
+        if pr.Diverge > 0.5 {
+            t.Fatalf("point %d is %v m off route", i, pr.Diverge)
+        }
+    }
+
+    if _, err = LoadRoute("nonexistent.gpx"); err == nil {
+        t.Fatalf("missing file is not reported")
+    }
+}
+
+func TestUserRoutePosition(t *testing.T) {
+
+    rt := test_line_route()
+
+    ui := createUser(nil, &UserPosition{ Lat: 55.002, Lon: 37 })
+
+    if ui.UpdateRoutePosition(nil) != nil || ui.Route != nil {
+        t.Fatalf("progress without route")
+    }
+
+    p := ui.UpdateRoutePosition(rt)
+    if p == nil || math.Abs(p.Position - 222) > 1 {
+        t.Fatalf("wrong progress: %+v", p)
+    }
+
+    snap := ui.snapshot()
+    if snap.Route == nil || snap.Route.Position != p.Position {
+        t.Fatalf("snapshot lost progress")
+    }
+}
+
+/* reference projection: check every segment */
+func project_linear(rt *Route, lat float64, lon float64) (float64, float64) {
+
+    best := math.Inf(1)
+    var pos float64
+
+    for i := 1; i < len(rt.points); i++ {
+        if rt.points[i].Gap {
+            continue
+        }
+
+        d, off := rt.project_segment(i, lat, lon)
+        if d < best || (d == best && off < pos) {
+            best = d
+            pos = off
+        }
+    }
+
+    return best, pos
+}
+
+/* random point around route, up to spread degrees away from its points */
+func random_point(rt *Route, rnd *rand.Rand, spread float64) (float64, float64) {
+
+    p := rt.points[rnd.Intn(len(rt.points))]
+
+    return p.Lat + (rnd.Float64() - 0.5) * spread,
+           p.Lon + (rnd.Float64() - 0.5) * spread
+}
+
+func TestRouteIndex(t *testing.T) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        t.Fatalf("failed to load route: %v", err)
+    }
+
+    rnd := rand.New(rand.NewSource(1))
+
+    /* near the road, in the area and far away from it */
+    for _, spread := range []float64{ 0.001, 0.05, 3 } {
+        for i := 0; i < 500; i++ {
+            lat, lon := random_point(rt, rnd, spread)
+
+            d, _ := project_linear(rt, lat, lon)
+            p := rt.project(lat, lon)
+
+            if math.Abs(p.Diverge - d) > 0.01 {
+                t.Fatalf("[%v, %v]: index found %v m, real distance %v m",
+                         lat, lon, p.Diverge, d)
+            }
+        }
+    }
+}
+
+func TestRouteSegments(t *testing.T) {
+
+    /* two tracks; second segment of first track continues the first one */
+    gpx := `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk><name>part one</name>
+    <trkseg>
+      <trkpt lat="55.000" lon="37"/><trkpt lat="55.001" lon="37"/>
+    </trkseg>
+    <trkseg>
+      <trkpt lat="55.001" lon="37"/><trkpt lat="55.002" lon="37"/>
+    </trkseg>
+  </trk>
+  <trk><name>part two</name>
+    <trkseg>
+      <trkpt lat="55.012" lon="37"/><trkpt lat="55.013" lon="37"/>
+    </trkseg>
+  </trk>
+</gpx>`
+
+    fn := filepath.Join(t.TempDir(), "route.gpx")
+
+    err := os.WriteFile(fn, []byte(gpx), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rt, err := LoadRoute(fn)
+    if err != nil {
+        t.Fatalf("failed to load route: %v", err)
+    }
+
+    if rt.Name != "part one" || len(rt.points) != 5 {
+        t.Fatalf("wrong route: %s, %d points", rt.Name, len(rt.points))
+    }
+
+    if !rt.points[3].Gap || rt.points[2].Gap {
+        t.Fatalf("gap between tracks is not detected")
+    }
+
+    /* distance of the gap still counts */
+    if math.Abs(rt.Length - 1445) > 1 {
+        t.Fatalf("wrong route length: %v", rt.Length)
+    }
+
+    /* in the middle of gap: closest are ends of ridden parts */
+    p := rt.project(55.007, 37)
+    if math.Abs(p.Diverge - 556) > 1 || math.Abs(p.Position - 222) > 1 {
+        t.Fatalf("projected onto gap: %+v", p)
+    }
+
+    p = rt.project(55.0125, 37)
+    if math.Abs(p.Position - 1389) > 1 || p.Diverge > 0.1 {
+        t.Fatalf("wrong projection on second track: %+v", p)
+    }
+}
+
+func BenchmarkRouteProject(b *testing.B) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        b.Fatalf("failed to load route: %v", err)
+    }
+
+    rnd := rand.New(rand.NewSource(1))
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        lat, lon := random_point(rt, rnd, 0.002)
+        rt.project(lat, lon)
+    }
+}
+
+func BenchmarkRouteProjectFar(b *testing.B) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        b.Fatalf("failed to load route: %v", err)
+    }
+
+    rnd := rand.New(rand.NewSource(1))
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        lat, lon := random_point(rt, rnd, 0.2)
+        rt.project(lat, lon)
+    }
+}
+
+func BenchmarkRouteProjectLinear(b *testing.B) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        b.Fatalf("failed to load route: %v", err)
+    }
+
+    rnd := rand.New(rand.NewSource(1))
+
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        lat, lon := random_point(rt, rnd, 0.002)
+        project_linear(rt, lat, lon)
+    }
+}
+
+/* goes along points of route with given step, fix every 10 seconds */
+func ride_route(t *testing.T, rt *Route, pts []RoutePoint, step int) {
+
+    ui := createUser(nil, &UserPosition{ Lat: pts[0].Lat, Lon: pts[0].Lon,
+                                         Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    for i := step; i < len(pts); i += step {
+        up := UserPosition{ Lat: pts[i].Lat, Lon: pts[i].Lon,
+                            Last: time.Unix(int64(i) * 10, 0) }
+
+        ui.UpdatePosition(&up)
+        p := ui.UpdateRoutePosition(rt)
+
+        if math.Abs(p.Position - pts[i].Offset) > 1 {
+            t.Fatalf("point %d: position %v, expected %v",
+                     i, p.Position, pts[i].Offset)
+        }
+    }
+}
+
+/* route to the north and back along the same road */
+func test_out_and_back_route() *Route {
+
+    rt := new(Route)
+
+    for i := 0; i <= 20; i++ {
+        rt.add(55 + float64(10 - abs_int(10 - i)) / 1000, 37, 0, i == 0)
+    }
+
+    rt.build_index()
+
+    return rt
+}
+
+func abs_int(x int) int {
+    if x < 0 {
+        return -x
+    }
+    return x
+}
+
+func TestRouteOutAndBack(t *testing.T) {
+
+    rt := test_out_and_back_route()
+
+    if math.Abs(rt.Length - 2224) > 1 {
+        t.Fatalf("wrong route length: %v", rt.Length)
+    }
+
+    ride_route(t, rt, rt.points, 1)
+}
+
+func TestRouteLaps(t *testing.T) {
+
+    rt := new(Route)
+
+    square := [][2]float64{ {55, 37}, {55.002, 37}, {55.002, 37.003},
+                            {55, 37.003} }
+
+    /* three laps, finish at start */
+    for lap := 0; lap < 3; lap++ {
+        for _, p := range square {
+            rt.add(p[0], p[1], 0, len(rt.points) == 0)
+        }
+    }
+    rt.add(55, 37, 0, false)
+
+    rt.build_index()
+
+    /* split route into fixes every ~50 meters */
+    var pts []RoutePoint
+
+    for i := 1; i < len(rt.points); i++ {
+        a, b := rt.points[i - 1], rt.points[i]
+        n := int((b.Offset - a.Offset) / 50)
+        for k := 0; k < n; k++ {
+            f := float64(k) / float64(n)
+            pts = append(pts, RoutePoint{ Lat: a.Lat + (b.Lat - a.Lat) * f,
+                                          Lon: a.Lon + (b.Lon - a.Lon) * f,
+                                          Offset: a.Offset + (b.Offset - a.Offset) * f })
+        }
+    }
+    pts = append(pts, rt.points[len(rt.points) - 1])
+
+    ride_route(t, rt, pts, 1)
+}
+
+func TestRouteDirection(t *testing.T) {
+
+    rt := test_out_and_back_route()
+
+    /* first fix, no history: the outward pass */
+    p := rt.locate(&RouteFix{ Lat: 55.005, Lon: 37 }, nil, nil)
+    if math.Abs(p.Position - 556) > 1 {
+        t.Fatalf("wrong start position: %+v", p)
+    }
+
+    /* rider heading south on the shared road is on the way back */
+    p = rt.locate(&RouteFix{ Lat: 55.005, Lon: 37, Heading: 180 }, nil, nil)
+    if math.Abs(p.Position - 1668) > 1 {
+        t.Fatalf("direction ignored: %+v", p)
+    }
+
+    /* stopped before the turn for an hour: still outward */
+    prev := &RouteProgress{ Position: 1000 }
+    from := &RouteFix{ Lat: 55.009, Lon: 37, At: time.Unix(0, 0) }
+
+    p = rt.locate(&RouteFix{ Lat: 55.009, Lon: 37, At: time.Unix(3600, 0) },
+                  from, prev)
+    if math.Abs(p.Position - 1000) > 1 {
+        t.Fatalf("stopped rider moved: %+v", p)
+    }
+
+    /* going back after the turn */
+    p = rt.locate(&RouteFix{ Lat: 55.008, Lon: 37, At: time.Unix(3700, 0) },
+                  from, prev)
+    if math.Abs(p.Position - 1334) > 1 {
+        t.Fatalf("wrong position after turn: %+v", p)
+    }
+
+    /* never goes backward */
+    p = rt.locate(&RouteFix{ Lat: 55.0095, Lon: 37, At: time.Unix(3800, 0) },
+                  &RouteFix{ Lat: 55.008, Lon: 37, At: time.Unix(3700, 0) }, p)
+    if math.Abs(p.Position - 1334) > 1 {
+        t.Fatalf("position decreased: %+v", p)
+    }
+}
+
+func TestRouteHistory(t *testing.T) {
+
+    rt := test_out_and_back_route()
+
+    /* rider on the way back, route configured only now */
+    ui := createUser(nil, &UserPosition{ Lat: 55.009, Lon: 37,
+                                         Last: time.Unix(0, 0) })
+
+    for i, lat := range []float64{ 55.008, 55.007, 55.006 } {
+        ui.UpdatePosition(&UserPosition{ Lat: lat, Lon: 37,
+                                         Last: time.Unix(int64(i + 1) * 10, 0) })
+    }
+
+    p := ui.UpdateRoutePosition(rt)
+    if math.Abs(p.Position - 1557) > 1 {
+        t.Fatalf("history ignored: %+v", p)
+    }
+}
+
+func TestRouteFarAway(t *testing.T) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        t.Fatalf("failed to load route: %v", err)
+    }
+
+    /* first fix of rider tens of km off route, and far north */
+    for _, pt := range [][2]float64{ { 55.70, 34.60 }, { 70, 80 } } {
+        fix := &RouteFix{ Lat: pt[0], Lon: pt[1], At: time.Unix(0, 0) }
+
+        p := rt.locate(fix, nil, nil)
+        d, _ := project_linear(rt, pt[0], pt[1])
+
+        if math.Abs(p.Diverge - d) > 0.01 {
+            t.Fatalf("%v: %v m from route, real distance %v m", pt, p.Diverge, d)
+        }
+    }
+}
+
+func TestRealRouteRide(t *testing.T) {
+
+    rt, err := LoadRoute(TestRouteFile)
+    if err != nil {
+        t.Fatalf("failed to load route: %v", err)
+    }
+
+    /* sparse fixes cut corners */
+    for _, step := range []int{ 1, 5, 10 } {
+        ride_route(t, rt, rt.points, step)
+    }
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "os"
+    "log"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "net/http"
+    "os/signal"
+    "syscall"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+/* bot signs updates it sends to webmap with shared secret */
+const SignatureHeader = "X-Rieman-Signature"
+const SignatureTimeHeader = "X-Rieman-Timestamp"
+
+/* longer updates are cut and fail verification */
+const MaxUpdateSize = 1 << 20
+
+/* signed request is accepted if its clock differs less than that */
+const SignatureWindow = 5 * time.Minute
+
+var ErrUnsigned = errors.New("request is not signed")
+var ErrBadSignature = errors.New("bad request signature")
+var ErrStaleSignature = errors.New("request signature is expired")
+
+/*
+ * keys from UpdateKeys: the first signs, any of them verifies;
+ * key is rotated by adding new one to webmap first, then putting it
+ * first in bot and finally removing the old one. Keys are reread on SIGHUP
+ */
+type Keyring struct {
+    mu        sync.RWMutex
+    keys      []string
+}
+
+func CreateKeyring(keys []string) *Keyring {
+    kr := new(Keyring)
+    kr.set(keys)
+    return kr
+}
+
+func (kr *Keyring) set(keys []string) {
+
+    kr.mu.Lock()
+    defer kr.mu.Unlock()
+
+    kr.keys = nil
+
+    for _, key := range keys {
+        if len(key) != 0 {
+            kr.keys = append(kr.keys, key)
+        }
+    }
+}
+
+func (kr *Keyring) enabled() bool {
+
+    kr.mu.RLock()
+    defer kr.mu.RUnlock()
+
+    return len(kr.keys) != 0
+}
+
+/* timestamp, path and idempotency key are signed along with body */
+func update_signature(key string, ts string, path string, idkey string,
+                      body []byte) []byte {
+
+    mac := hmac.New(sha256.New, []byte(key))
+
+    mac.Write([]byte(ts + "\n" + path + "\n" + idkey + "\n"))
+    mac.Write(body)
+
+    return mac.Sum(nil)
+}
+
+/* nothing is done without keys */
+func (kr *Keyring) sign(req *http.Request, body []byte, now time.Time) {
+
+    kr.mu.RLock()
+    defer kr.mu.RUnlock()
+
+    if len(kr.keys) == 0 {
+        return
+    }
+
+    ts := strconv.FormatInt(now.Unix(), 10)
+
+    sig := update_signature(kr.keys[0], ts, req.URL.Path,
+                            req.Header.Get(IdempotencyHeader), body)
+
+    req.Header.Set(SignatureTimeHeader, ts)
+    req.Header.Set(SignatureHeader, hex.EncodeToString(sig))
+}
+
+func (kr *Keyring) verify(r *http.Request, body []byte, now time.Time) error {
+
+    ts := r.Header.Get(SignatureTimeHeader)
+    hexsig := r.Header.Get(SignatureHeader)
+
+    if len(ts) == 0 || len(hexsig) == 0 {
+        return ErrUnsigned
+    }
+
+    sec, err := strconv.ParseInt(ts, 10, 64)
+    if err != nil {
+        return ErrBadSignature
+    }
+
+    skew := now.Sub(time.Unix(sec, 0))
+    if skew > SignatureWindow || skew < -SignatureWindow {
+        return ErrStaleSignature
+    }
+
+    sig, err := hex.DecodeString(hexsig)
+    if err != nil {
+        return ErrBadSignature
+    }
+
+    kr.mu.RLock()
+    defer kr.mu.RUnlock()
+
+    for _, key := range kr.keys {
+        exp := update_signature(key, ts, r.URL.Path,
+                                r.Header.Get(IdempotencyHeader), body)
+
+        if hmac.Equal(sig, exp) {
+            return nil
+        }
+    }
+
+    return ErrBadSignature
+}
+
+/* rereads UpdateKeys from configuration file on SIGHUP */
+func reload_keys(kr *Keyring, conffile string) {
+
+    ch := make(chan os.Signal, 1)
+    signal.Notify(ch, syscall.SIGHUP)
+
+    for range ch {
+        conf, err := ConfigLoad(conffile)
+        if err != nil {
+            log.Printf("failed to reload keys: %v", err)
+            continue
+        }
+
+        kr.set(conf.UpdateKeys)
+
+        log.Printf("update keys reloaded, %d keys", len(conf.UpdateKeys))
+    }
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "time"
+    "errors"
+    "testing"
+    "strings"
+    "net/http"
+    "encoding/json"
+    "net/http/httptest"
+)
+
+func TestSignature(t *testing.T) {
+
+    now := time.Unix(1700000000, 0)
+    body := []byte(`{"UserID":1}`)
+
+    req := func(url string) *http.Request {
+        r, _ := http.NewRequest("POST", url, nil)
+        r.Header.Set(IdempotencyHeader, "k-1")
+        return r
+    }
+
+    /* bot already signs with new key, webmap accepts both */
+    bot := CreateKeyring([]string{ "new", "old" })
+    webmap := CreateKeyring([]string{ "old", "new" })
+
+    r := req("http://127.0.0.1/updatepos")
+    bot.sign(r, body, now)
+
+    if err := webmap.verify(r, body, now.Add(time.Minute)); err != nil {
+        t.Fatalf("signed update is rejected: %v", err)
+    }
+
+    if err := webmap.verify(r, []byte(`{"UserID":2}`), now); !errors.Is(err, ErrBadSignature) {
+        t.Fatalf("modified body is accepted: %v", err)
+    }
+
+    if err := webmap.verify(r, body, now.Add(10 * time.Minute)); !errors.Is(err, ErrStaleSignature) {
+        t.Fatalf("replay is accepted: %v", err)
+    }
+
+    /* body of position is not valid for status */
+    r.URL.Path = "/updatestatus"
+    if err := webmap.verify(r, body, now); !errors.Is(err, ErrBadSignature) {
+        t.Fatalf("update for other endpoint is accepted: %v", err)
+    }
+
+    /* old key is removed */
+    webmap.set([]string{ "new" })
+
+    old := req("http://127.0.0.1/updatepos")
+    CreateKeyring([]string{ "old" }).sign(old, body, now)
+
+    if err := webmap.verify(old, body, now); !errors.Is(err, ErrBadSignature) {
+        t.Fatalf("removed key is accepted: %v", err)
+    }
+
+    if err := webmap.verify(req("http://127.0.0.1/updatepos"), body, now); !errors.Is(err, ErrUnsigned) {
+        t.Fatalf("unsigned update is accepted: %v", err)
+    }
+}
+
+/* status line and error body agree */
+func TestUnsignedUpdate(t *testing.T) {
+
+    keyring = CreateKeyring([]string{ "secret" })
+    defer func() { keyring = nil }()
+
+    r := httptest.NewRequest("POST", "/updatepos",
+                             strings.NewReader(`{"UserID":1}`))
+    w := httptest.NewRecorder()
+
+    request_handler(w, r)
+
+    var msg WebErrorMessage
+
+    err := json.Unmarshal(w.Body.Bytes(), &msg)
+    if err != nil || w.Code != http.StatusUnauthorized || msg.Code != w.Code {
+        t.Fatalf("wrong reply %d: %s", w.Code, w.Body.String())
+    }
+}
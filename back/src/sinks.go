@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "io"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "net/http"
+    "path/filepath"
+    "encoding/json"
+)
+
+/* kinds of updates, every sink has its own URL for each */
+const (
+    UPDATE_POSITION = iota
+    UPDATE_STATUS
+    UPDATE_INCIDENT
+)
+
+/* sink is reported down after that many failures in a row */
+const SinkDownFailures = 3
+
+/* updates to one webmap with own outbox and health state */
+type Sink struct {
+    Name      string
+    urls      [3]string
+    outbox    *Outbox
+
+    mu        sync.Mutex
+    failures  int
+    down      bool
+    since     time.Time
+}
+
+/* without UpdateSinks, bot sends to the single configured webmap */
+func sinks_from_config(conf *UserConfig) []SinkConfig {
+
+    if len(conf.UpdateSinks) != 0 {
+        return conf.UpdateSinks
+    }
+
+    return []SinkConfig{{
+        PositionURL: conf.UpdatePositionURL,
+        StatusURL: conf.UpdateStatusURL,
+        IncidentURL: conf.UpdateIncidentURL,
+    }}
+}
+
+/*
+ * outboxes of named sinks are kept next to the outbox file,
+ * unnamed sink uses outbox file itself
+ */
+func create_sinks(list []SinkConfig, file string, prefix string,
+                  tmpdir string, kr *Keyring) ([]*Sink, error) {
+
+    var sinks []*Sink
+
+    names := make(map[string]bool)
+
+    for _, sc := range list {
+
+        if names[sc.Name] {
+            return nil, fmt.Errorf("duplicate sink name '%s'", sc.Name)
+        }
+
+        names[sc.Name] = true
+
+        sfile := file
+        if len(sc.Name) != 0 {
+            sfile = filepath.Join(filepath.Dir(file),
+                                  prefix + "-" + sc.Name + ".json")
+        }
+
+        s, err := CreateSink(sc, sfile, tmpdir, kr)
+        if err != nil {
+            return nil, err
+        }
+
+        sinks = append(sinks, s)
+    }
+
+    return sinks, nil
+}
+
+func CreateSink(sc SinkConfig, file string, tmpdir string,
+                kr *Keyring) (*Sink, error) {
+
+    s := &Sink{ Name: sc.Name }
+
+    if len(s.Name) == 0 {
+        s.Name = "webmap"
+    }
+
+    s.urls[UPDATE_POSITION] = sc.PositionURL
+    s.urls[UPDATE_STATUS] = sc.StatusURL
+    s.urls[UPDATE_INCIDENT] = sc.IncidentURL
+
+    /* temporary file must be on the same file system */
+    if len(tmpdir) == 0 {
+        tmpdir = filepath.Dir(file)
+    }
+
+    send := func(url string, key string, body []byte) error {
+        err := send_update(kr, url, key, body)
+        s.report(err, time.Now())
+        return err
+    }
+
+    ob, err := CreateOutbox(file, tmpdir, send)
+    if err != nil {
+        return nil, err
+    }
+
+    ob.Name = "sink " + s.Name
+    ob.merge = merge_positions
+
+    s.outbox = ob
+
+    return s, nil
+}
+
+/*
+ * newer position of rider carries the replaced one and positions it
+ * has carried itself, so receiver counts track and distance as if
+ * it got every update
+ */
+func merge_positions(old []byte, body []byte) ([]byte, error) {
+
+    var prev, up UserPosition
+
+    err := json.Unmarshal(old, &prev)
+    if err != nil {
+        return nil, err
+    }
+
+    err = json.Unmarshal(body, &up)
+    if err != nil {
+        return nil, err
+    }
+
+    missed := append(prev.Missed, TrackPoint{
+        Lat: prev.Lat,
+        Lon: prev.Lon,
+        Last: prev.Last,
+        Accuracy: prev.Accuracy,
+        Heading: prev.Heading,
+    })
+
+    up.Missed = append(missed, up.Missed...)
+
+    if up.Start == nil {
+        up.Start = prev.Start
+    }
+
+    return json.Marshal(&up)
+}
+
+/* queues update unless sink does not accept such updates */
+func (s *Sink) push(kind int, key string, userid int64, body []byte,
+                    replaceable bool) error {
+
+    url := s.urls[kind]
+    if len(url) == 0 {
+        return nil
+    }
+
+    return s.outbox.push_key(key, url, userid, body, replaceable)
+}
+
+func (s *Sink) run(ctx context.Context) {
+    s.outbox.run(ctx)
+}
+
+/* keeps health state, changes are logged */
+func (s *Sink) report(err error, now time.Time) {
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err == nil || errors.Is(err, ErrUpdateRejected) {
+        if s.down {
+            log.Printf("sink %s is up again after %v, %d updates pending",
+                       s.Name, now.Sub(s.since).Round(time.Second),
+                       s.outbox.depth())
+        }
+
+        s.failures = 0
+        s.down = false
+
+        return
+    }
+
+    if s.failures == 0 {
+        s.since = now
+    }
+
+    s.failures++
+
+    if s.failures == SinkDownFailures {
+        s.down = true
+        log.Printf("sink %s is down: %v", s.Name, err)
+    }
+}
+
+/*
+ * queues update for every sink with the same key, so webmap
+ * getting it also from relay drops duplicate; errors of all
+ * sinks are reported. Replaceable update is superseded by the
+ * next one of the same kind and user, see OutboxItem
+ */
+func push_update(sinks []*Sink, kind int, key string, userid int64,
+                 body []byte, replaceable bool) error {
+
+    var errs []error
+
+    if len(key) == 0 {
+        key = update_key()
+    }
+
+    for _, s := range sinks {
+        err := s.push(kind, key, userid, body, replaceable)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("sink %s: %w", s.Name, err))
+        }
+    }
+
+    return errors.Join(errs...)
+}
+
+func send_update(kr *Keyring, url string, key string, data []byte) error {
+
+    req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+    if (err != nil) {
+        return fmt.Errorf("%w: %v", ErrUpdateRejected, err)
+    }
+
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(IdempotencyHeader, key)
+
+    kr.sign(req, data, time.Now())
+
+    client := http.Client{Timeout: 10 * time.Second}
+    res, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+
+    defer res.Body.Close()
+
+    /* let connection be reused */
+    io.Copy(io.Discard, res.Body)
+
+    log.Printf("%s => '%s': %d\n", data, url, res.StatusCode)
+
+    switch {
+    case res.StatusCode >= 200 && res.StatusCode < 300:
+        return nil
+
+    /* keys or clocks disagree, retry until it is fixed */
+    case res.StatusCode == http.StatusUnauthorized:
+        return fmt.Errorf("HTTP %d, check UpdateKeys", res.StatusCode)
+
+    case res.StatusCode >= 400 && res.StatusCode < 500:
+        return fmt.Errorf("%w: HTTP %d", ErrUpdateRejected, res.StatusCode)
+    }
+
+    return fmt.Errorf("HTTP %d", res.StatusCode)
+}
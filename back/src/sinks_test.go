@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "io"
+    "sync"
+    "time"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "encoding/json"
+)
+
+func TestSinks(t *testing.T) {
+
+    var mu sync.Mutex
+    var keys []string
+
+    up := httptest.NewServer(http.HandlerFunc(
+        func(w http.ResponseWriter, r *http.Request) {
+            io.ReadAll(r.Body)
+            mu.Lock()
+            keys = append(keys, r.Header.Get(IdempotencyHeader))
+            mu.Unlock()
+        }))
+    defer up.Close()
+
+    down := httptest.NewServer(http.HandlerFunc(
+        func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }))
+    defer down.Close()
+
+    dir := t.TempDir()
+
+    sinks, err := create_sinks([]SinkConfig{
+        { Name: "main", PositionURL: up.URL + "/updatepos" },
+        { Name: "staging", PositionURL: down.URL + "/updatepos",
+          StatusURL: down.URL + "/updatestatus" },
+    }, filepath.Join(dir, "outbox.json"), "outbox", dir, CreateKeyring(nil))
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    main, staging := sinks[0], sinks[1]
+
+    err = push_update(sinks, UPDATE_POSITION, "", 1, []byte(`{"UserID":1}`),
+                      false)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    /* main does not take statuses */
+    push_update(sinks, UPDATE_STATUS, "", 1, []byte(`{"UserID":1}`), false)
+
+    if main.outbox.depth() != 1 || staging.outbox.depth() != 2 {
+        t.Fatalf("wrong queues: %d, %d", main.outbox.depth(),
+                 staging.outbox.depth())
+    }
+
+    now := time.Now()
+
+    main.outbox.flush(now)
+
+    for i := 0; i < SinkDownFailures; i++ {
+        staging.outbox.flush(now.Add(time.Duration(i) * time.Hour))
+    }
+
+    if main.outbox.depth() != 0 || main.down {
+        t.Fatalf("main sink is not delivered: %d pending", main.outbox.depth())
+    }
+
+    /* failing sink keeps updates and does not hold others */
+    if staging.outbox.depth() != 2 || !staging.down {
+        t.Fatalf("staging sink is not down: %d pending", staging.outbox.depth())
+    }
+
+    /* the same update has the same key in every sink */
+    staging.outbox.mu.Lock()
+    key := staging.outbox.items[0].Key
+    staging.outbox.mu.Unlock()
+
+    if len(keys) != 1 || keys[0] != key {
+        t.Fatalf("keys differ: %v, %s", keys, key)
+    }
+
+    _, err = create_sinks([]SinkConfig{ { Name: "a" }, { Name: "a" } },
+                          filepath.Join(dir, "outbox.json"), "outbox", dir, nil)
+    if err == nil {
+        t.Fatalf("duplicate sink names are accepted")
+    }
+}
+
+func TestMergePositions(t *testing.T) {
+
+    t0 := time.Unix(1000, 0)
+    start := t0.Add(-time.Hour)
+
+    var body []byte
+
+    /* rider moves 100 m per 20 s, sink is down all the time */
+    for i := 0; i < 4; i++ {
+        up := UserPosition{ UserID: 1, Lat: 55 + float64(i) * 0.0009,
+                            Lon: 37, Last: t0.Add(time.Duration(i) * 20 * time.Second) }
+
+        if i == 0 {
+            up.Start = &start
+        }
+
+        j, err := json.Marshal(&up)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if body != nil {
+            j, err = merge_positions(body, j)
+            if err != nil {
+                t.Fatal(err)
+            }
+        }
+
+        body = j
+    }
+
+    var up UserPosition
+
+    err := json.Unmarshal(body, &up)
+    if err != nil || len(up.Missed) != 3 || up.Start == nil ||
+       up.Lat != 55 + 3 * 0.0009 || up.Missed[0].Lat != 55 {
+        t.Fatalf("wrong merged position: %+v, %v", up, err)
+    }
+
+    /* receiver gets the same as if every update was delivered */
+    ui := createUser(nil, nil)
+    ui.UpdatePosition(&up)
+
+    snap := ui.snapshot()
+
+    if len(snap.Track.extract()) != 3 || snap.Distance < 290 ||
+       snap.Distance > 310 || snap.MovingTime != 60 {
+        t.Fatalf("missed positions are not counted: %+v", snap)
+    }
+}
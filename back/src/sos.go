@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "time"
+)
+
+/* defaults: that many riders within that distance learn about SOS */
+const SosNearbyRiders = 3
+const SosNearbyDistance = 20000.0
+
+/* positions older than that tell nothing about where rider is now */
+const SosStalePosition = time.Hour
+
+type Neighbor struct {
+    User      *UserInfo
+    Distance  float64
+}
+
+/*
+ * riders (snapshots) closest to user who may help: still on the ride,
+ * with recent positions, within maxdist meters; at most n
+ */
+func nearest_riders(users []*UserInfo, ui *UserInfo, n int, maxdist float64,
+                    now time.Time) []Neighbor {
+
+    var out []Neighbor
+
+    for _, u := range users {
+
+        if u.UserID == ui.UserID || u.Last.IsZero() ||
+           now.Sub(u.Last) > SosStalePosition {
+            continue
+        }
+
+        if u.MovingState == STATUS_FINISHED || u.MovingState == STATUS_DNF {
+            continue
+        }
+
+        d := geo_distance(ui.Pos.Lat, ui.Pos.Lon, u.Pos.Lat, u.Pos.Lon)
+        if d > maxdist {
+            continue
+        }
+
+        out = append(out, Neighbor{ u, d })
+    }
+
+    sort.SliceStable(out, func(i, j int) bool {
+        return out[i].Distance < out[j].Distance
+    })
+
+    if len(out) > n {
+        out = out[:n]
+    }
+
+    return out
+}
+
+/* one coordinate as degrees, minutes and seconds */
+func dms(v float64, pos string, neg string) string {
+
+    hemi := pos
+    if v < 0 {
+        hemi = neg
+        v = -v
+    }
+
+    /* tenths of arc second, to avoid 60" after rounding */
+    t := int64(math.Round(v * 36000))
+
+    return fmt.Sprintf("%d°%02d'%02d.%d\"%s", t / 36000, t / 600 % 60,
+                       t / 10 % 60, t % 10, hemi)
+}
+
+func fmt_dms(lat float64, lon float64) string {
+    return dms(lat, "N", "S") + " " + dms(lon, "E", "W")
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+func TestDms(t *testing.T) {
+
+    for _, c := range []struct { lat, lon float64; s string } {
+        { 55.755833, 37.617778, `55°45'21.0"N 37°37'04.0"E` },
+        { -33.856784, 151.215297, `33°51'24.4"S 151°12'55.1"E` },
+        { 40.689247, -74.044502, `40°41'21.3"N 74°02'40.2"W` },
+        /* rounds up to the next minute */
+        { 10.9999999, 0, `11°00'00.0"N 0°00'00.0"E` },
+    } {
+        if s := fmt_dms(c.lat, c.lon); s != c.s {
+            t.Fatalf("%v,%v is %s, expected %s", c.lat, c.lon, s, c.s)
+        }
+    }
+}
+
+func TestNearestRiders(t *testing.T) {
+
+    now := time.Unix(10000, 0)
+
+    rider := func(id int64, lat float64, state string, ago time.Duration) *UserInfo {
+        return &UserInfo{ UserID: id, Pos: GeoPos{ Lat: lat, Lon: 37 },
+                          Last: now.Add(-ago), MovingState: state }
+    }
+
+    me := rider(1, 55, STATUS_FALL, 0)
+
+    users := []*UserInfo{
+        me,
+        rider(2, 55.05, STATUS_MOVING, time.Minute),
+        rider(3, 55.01, STATUS_PITSTOP, time.Minute),
+        rider(4, 55.001, STATUS_FINISHED, time.Minute),
+        rider(5, 55.002, STATUS_MOVING, 2 * time.Hour),
+        rider(6, 55.5, STATUS_MOVING, time.Minute),
+        rider(7, 55.03, STATUS_MOVING, time.Minute),
+    }
+
+    nb := nearest_riders(users, me, 2, 20000, now)
+    if len(nb) != 2 || nb[0].User.UserID != 3 || nb[1].User.UserID != 7 {
+        t.Fatalf("wrong neighbors: %+v", nb)
+    }
+
+    if nb[0].Distance < 1100 || nb[0].Distance > 1125 {
+        t.Fatalf("wrong distance: %v", nb[0].Distance)
+    }
+
+    /* far rider is out of reach */
+    if nb = nearest_riders(users, me, 10, 20000, now); len(nb) != 3 {
+        t.Fatalf("wrong neighbors in range: %+v", nb)
+    }
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "sort"
+    "time"
+)
+
+/* groups of riders in standings, in order of ranking */
+const (
+    RANK_FINISHED = iota
+    RANK_RIDING
+    RANK_UNKNOWN      /* no position on route */
+    RANK_DNF
+)
+
+/*
+ * rider's place in the race;
+ * Gap is meters behind leader, GapTime is seconds behind leader:
+ * exact for finished riders, estimated from recent pace for others,
+ * zero if unknown.  Silence is seconds since the last update.
+ */
+type Standing struct {
+    Rank         int
+    UserID       int64
+    UserName     string
+    MovingState  string
+    Position     float64
+    Finish      *time.Time   `json:",omitempty"`
+    Gap          float64      `json:",omitempty"`
+    GapTime      float64      `json:",omitempty"`
+    Last         time.Time
+    Silence      float64
+
+    group        int
+    pace         float64
+
+    /* with staggered start, finished riders are ranked by elapsed time */
+    start       *time.Time
+    elapsed      time.Duration
+}
+
+func rank_group(ui *UserInfo) int {
+
+    switch {
+    case ui.MovingState == STATUS_DNF:
+        return RANK_DNF
+
+    case ui.MovingState == STATUS_FINISHED:
+        return RANK_FINISHED
+
+    case ui.Route == nil:
+        return RANK_UNKNOWN
+    }
+
+    return RANK_RIDING
+}
+
+/*
+ * ranks users (snapshots) by elapsed time, or finish time if start is
+ * unknown, and distance along route
+ */
+func make_standings(users []*UserInfo, rt *Route, now time.Time) []Standing {
+
+    out := make([]Standing, 0, len(users))
+
+    for _, ui := range users {
+
+        s := Standing{
+            UserID: ui.UserID,
+            UserName: ui.UserName,
+            MovingState: ui.MovingState,
+            Finish: ui.Finish,
+            Last: ui.Last,
+            group: rank_group(ui),
+            start: ui.Start,
+        }
+
+        if ui.Start != nil && ui.Finish != nil {
+            s.elapsed = ui.elapsed(*ui.Finish)
+        }
+
+        if ui.Route != nil {
+            s.Position = ui.Route.Position
+        }
+
+        if s.group == RANK_FINISHED && rt != nil {
+            s.Position = rt.Length
+        }
+
+        if !ui.Last.IsZero() {
+            s.Silence = now.Sub(ui.Last).Seconds()
+        }
+
+        if s.group == RANK_RIDING {
+            s.pace = ui.pace()
+        }
+
+        out = append(out, s)
+    }
+
+    sort.Slice(out, func(i, j int) bool {
+        a, b := &out[i], &out[j]
+
+        if a.group != b.group {
+            return a.group < b.group
+        }
+
+        switch a.group {
+        case RANK_FINISHED:
+            /* finish time may be unknown for old state files */
+            if (a.Finish == nil) != (b.Finish == nil) {
+                return a.Finish != nil
+            }
+
+            /* start may be unknown as well */
+            if (a.elapsed != 0) != (b.elapsed != 0) {
+                return a.elapsed != 0
+            }
+
+            if a.elapsed != b.elapsed {
+                return a.elapsed < b.elapsed
+            }
+
+            if a.Finish != nil && !a.Finish.Equal(*b.Finish) {
+                return a.Finish.Before(*b.Finish)
+            }
+
+        case RANK_RIDING:
+            if a.Position != b.Position {
+                return a.Position > b.Position
+            }
+        }
+
+        return a.UserID < b.UserID
+    })
+
+    if len(out) == 0 {
+        return out
+    }
+
+    leader := &out[0]
+
+    for i := range out {
+        s := &out[i]
+
+        s.Rank = i + 1
+
+        if i == 0 {
+            continue
+        }
+
+        switch s.group {
+        case RANK_FINISHED:
+            if s.elapsed != 0 && leader.elapsed != 0 {
+                s.GapTime = (s.elapsed - leader.elapsed).Seconds()
+
+            } else if s.Finish != nil && leader.Finish != nil {
+                s.GapTime = s.Finish.Sub(*leader.Finish).Seconds()
+            }
+
+        case RANK_RIDING:
+            s.Gap = leader.Position - s.Position
+
+            if s.pace == 0 {
+                break
+            }
+
+            if leader.elapsed != 0 && s.start != nil {
+                /* expected elapsed time of rider against leader's one */
+                s.GapTime = now.Sub(*s.start).Seconds() + s.Gap / s.pace -
+                            leader.elapsed.Seconds()
+
+            } else if leader.group == RANK_FINISHED && leader.Finish != nil {
+                /* expected finish of rider against leader's one */
+                s.GapTime = now.Sub(*leader.Finish).Seconds() + s.Gap / s.pace
+
+            } else if leader.group == RANK_RIDING {
+                s.GapTime = s.Gap / s.pace
+            }
+        }
+    }
+
+    return out
+}
+
+/* tells if both standings have riders in the same order */
+func same_order(a []Standing, b []Standing) bool {
+
+    if len(a) != len(b) {
+        return false
+    }
+
+    for i := range a {
+        if a[i].UserID != b[i].UserID {
+            return false
+        }
+    }
+
+    return true
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "math"
+    "time"
+    "testing"
+)
+
+/* rider going north along meridian at given speed, fix every minute */
+func test_rider(id int64, state string, speed float64, minutes int) *UserInfo {
+
+    ui := createUser(nil, &UserPosition{ UserName: "rider", Lat: 55,
+                                         Lon: 37, Last: time.Unix(0, 0) })
+    ui.UserID = id
+    ui.MovingState = state
+
+    for i := 1; i <= minutes; i++ {
+        /* meters to degrees of latitude */
+        lat := 55 + speed * 60 * float64(i) / 111195
+
+        ui.UpdatePosition(&UserPosition{ UserName: "rider", Lat: lat, Lon: 37,
+                                         Last: time.Unix(int64(i) * 60, 0) })
+    }
+
+    return ui
+}
+
+func TestPace(t *testing.T) {
+
+    ui := test_rider(1, STATUS_MOVING, 5, 10)
+
+    if p := ui.pace(); math.Abs(p - 5) > 0.01 {
+        t.Fatalf("wrong pace: %v", p)
+    }
+
+    /* stopped for a while: stop is not counted */
+    last := ui.snapshot()
+    for i := 1; i <= 5; i++ {
+        ui.UpdatePosition(&UserPosition{ UserName: "rider",
+                                         Lat: last.Pos.Lat + float64(i) * 1e-6,
+                                         Lon: 37,
+                                         Last: last.Last.Add(time.Duration(i) * time.Minute) })
+    }
+
+    if p := ui.pace(); math.Abs(p - 5) > 0.01 {
+        t.Fatalf("stop changed pace: %v", p)
+    }
+
+    if p := createUser(nil, &UserPosition{ Lat: 1 }).pace(); p != 0 {
+        t.Fatalf("pace without track: %v", p)
+    }
+}
+
+func TestStandings(t *testing.T) {
+
+    rt := test_line_route()
+    now := time.Unix(600, 0)
+
+    f1 := time.Unix(500, 0)
+    f2 := time.Unix(560, 0)
+
+    var users []*UserInfo
+
+    add := func(ui *UserInfo, pos float64, finish *time.Time) {
+        if pos >= 0 {
+            ui.Route = &RouteProgress{ Position: pos, Remaining: rt.Length - pos }
+        }
+        ui.Finish = finish
+        users = append(users, ui.snapshot())
+    }
+
+    add(test_rider(1, STATUS_MOVING, 2, 5), 500, nil)
+    add(test_rider(2, STATUS_FINISHED, 2, 5), 1000, &f2)
+    add(test_rider(3, STATUS_DNF, 2, 5), 900, nil)
+    add(test_rider(4, STATUS_MOVING, 2, 5), 700, nil)
+    add(test_rider(5, STATUS_FINISHED, 2, 5), 1000, &f1)
+    add(test_rider(6, STATUS_MOVING, 2, 5), -1, nil)
+
+    st := make_standings(users, rt, now)
+
+    expect := []int64{ 5, 2, 4, 1, 6, 3 }
+
+    for i, id := range expect {
+        if st[i].UserID != id || st[i].Rank != i + 1 {
+            t.Fatalf("wrong standings at %d: %+v", i, st)
+        }
+    }
+
+    if st[0].Position != rt.Length || st[0].Gap != 0 || st[0].GapTime != 0 {
+        t.Fatalf("wrong leader: %+v", st[0])
+    }
+
+    if st[1].GapTime != 60 {
+        t.Fatalf("wrong finish gap: %+v", st[1])
+    }
+
+    /* 100 seconds after leader's finish, ~412 meters left at 2 m/s */
+    if math.Abs(st[2].Gap - (rt.Length - 700)) > 0.001 ||
+       math.Abs(st[2].GapTime - (100 + st[2].Gap / 2)) > 1 {
+        t.Fatalf("wrong estimated gap: %+v", st[2])
+    }
+
+    if st[3].Silence != 300 {
+        t.Fatalf("wrong silence: %+v", st[3])
+    }
+
+    if st[4].Gap != 0 || st[4].GapTime != 0 {
+        t.Fatalf("gap for rider not on route: %+v", st[4])
+    }
+
+    /* nobody finished yet */
+    st = make_standings([]*UserInfo{ users[0], users[3] }, rt, now)
+
+    if st[0].UserID != 4 || st[1].Gap != 200 ||
+       math.Abs(st[1].GapTime - 100) > 1 {
+        t.Fatalf("wrong standings while riding: %+v", st)
+    }
+
+    if len(make_standings(nil, rt, now)) != 0 {
+        t.Fatalf("standings without users")
+    }
+
+    /* staggered start: the later finisher rode faster */
+    s1 := time.Unix(0, 0)
+    s2 := time.Unix(100, 0)
+
+    users = nil
+
+    add(test_rider(1, STATUS_FINISHED, 2, 5), 1000, &f1)
+    add(test_rider(2, STATUS_FINISHED, 2, 5), 1000, &f2)
+    users[0].Start = &s1
+    users[1].Start = &s2
+
+    /* riding since 200, expected at finish after 600 + Gap / 2 */
+    add(test_rider(3, STATUS_MOVING, 2, 5), 700, nil)
+    s3 := time.Unix(200, 0)
+    users[2].Start = &s3
+
+    st = make_standings(users, rt, now)
+
+    if st[0].UserID != 2 || st[1].UserID != 1 || st[1].GapTime != 40 {
+        t.Fatalf("wrong staggered standings: %+v", st)
+    }
+
+    if math.Abs(st[2].GapTime - (400 + st[2].Gap / 2 - 460)) > 1 {
+        t.Fatalf("wrong estimated gap with staggered start: %+v", st[2])
+    }
+}
+
+func TestFinishTime(t *testing.T) {
+
+    ui := test_rider(1, STATUS_MOVING, 2, 1)
+
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_FINISHED })
+
+    finish := ui.snapshot().Finish
+    if finish == nil {
+        t.Fatalf("finish time is not recorded")
+    }
+
+    /* pressing "finished" again keeps the first time */
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_FINISHED })
+    if ui.snapshot().Finish != finish {
+        t.Fatalf("finish time changed")
+    }
+
+    ui.UpdateStatus(&UserStatus{ MovingState: STATUS_MOVING })
+    if ui.snapshot().Finish != nil {
+        t.Fatalf("finish time kept after resuming")
+    }
+}
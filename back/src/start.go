@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+)
+
+/*
+ * rider who is that far along route without leaving start geofence
+ * seen (joined late, or no fixes at start) is started at first fix
+ */
+const StartLateDistance = 2000.0
+
+/*
+ * how start of riders is determined:
+ *  - mass start: everybody starts at Time;
+ *  - staggered start: rider starts when leaving geofence around
+ *    Lat/Lon, but not before Time, if it is set;
+ *  - neither: rider starts with the first position
+ */
+type StartRule struct {
+    Time       time.Time
+    Staggered  bool
+    Lat        float64
+    Lon        float64
+    Radius     float64
+}
+
+/* start geofence is by default at the beginning of route */
+func start_from_config(rt *Route, conf *UserConfig) *StartRule {
+
+    sr := &StartRule{ Time: conf.StartTime }
+
+    if !conf.StaggeredStart {
+        if !sr.Time.IsZero() {
+            log.Printf("mass start at %v", sr.Time)
+        }
+        return sr
+    }
+
+    sr.Lat = conf.Start.Lat
+    sr.Lon = conf.Start.Lon
+    sr.Radius = conf.Start.Radius
+
+    if sr.Lat == 0 && sr.Lon == 0 && rt != nil && len(rt.points) != 0 {
+        sr.Lat = rt.points[0].Lat
+        sr.Lon = rt.points[0].Lon
+    }
+
+    if sr.Lat == 0 && sr.Lon == 0 {
+        log.Printf("staggered start without route or start position, ignored")
+        return sr
+    }
+
+    if sr.Radius <= 0 {
+        sr.Radius = conf.CheckpointRadius
+    }
+
+    if sr.Radius <= 0 {
+        sr.Radius = RouteCheckpointRadius
+    }
+
+    sr.Staggered = true
+
+    log.Printf("staggered start at %f,%f, radius %.0f m",
+               sr.Lat, sr.Lon, sr.Radius)
+
+    return sr
+}
+
+/* official start of user; distance and time ridden before do not count */
+func (ui *UserInfo) set_start(start time.Time) {
+
+    if ui.Start != nil && ui.Start.Equal(start) {
+        return
+    }
+
+    ui.Start = &start
+    ui.Distance = 0
+    ui.MovingTime = 0
+}
+
+/*
+ * Records start of user according to rule, after position update;
+ * returns time of start if it was just recorded
+ */
+func (ui *UserInfo) UpdateStart(sr *StartRule) *time.Time {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    if ui.Start != nil || ui.Last.IsZero() {
+        return nil
+    }
+
+    var start time.Time
+
+    track := ui.Track.extract()
+
+    switch {
+    case !sr.Staggered && sr.Time.IsZero():
+        start = ui.Last
+        if len(track) != 0 {
+            start = track[0].Last
+        }
+
+    case !sr.Staggered:
+        if ui.Last.Before(sr.Time) {
+            return nil
+        }
+
+        start = sr.Time
+
+    default:
+        t, ok := ui.left_start(sr, track)
+        if !ok {
+            return nil
+        }
+
+        start = t
+    }
+
+    ui.set_start(start)
+
+    log.Printf("user %s started at %v", ui.UserName, start)
+
+    return &start
+}
+
+/* moment user left start geofence, if it is known */
+func (ui *UserInfo) left_start(sr *StartRule,
+                               track []TrackPoint) (time.Time, bool) {
+
+    dc := geo_distance(sr.Lat, sr.Lon, ui.Pos.Lat, ui.Pos.Lon)
+
+    if dc <= sr.Radius {
+        return time.Time{}, false
+    }
+
+    if len(track) != 0 {
+        from := track[len(track) - 1]
+
+        dp := geo_distance(sr.Lat, sr.Lon, from.Lat, from.Lon)
+
+        if dp <= sr.Radius {
+            /* crossed the border somewhere on the leg */
+            f := (sr.Radius - dp) / (dc - dp)
+            t := from.Last.Add(time.Duration(f * float64(ui.Last.Sub(from.Last))))
+
+            if t.Before(sr.Time) {
+                /* warming up before start window */
+                return time.Time{}, false
+            }
+
+            return t, true
+        }
+    }
+
+    if ui.Route == nil || ui.Route.Position < StartLateDistance {
+        return time.Time{}, false
+    }
+
+    /* start was missed, the earliest we know of */
+    t := ui.Last
+    if len(track) != 0 {
+        t = track[0].Last
+    }
+
+    if t.Before(sr.Time) {
+        t = sr.Time
+    }
+
+    return t, true
+}
+
+/* time since start till finish or now, for snapshot */
+func (ui *UserInfo) elapsed(now time.Time) time.Duration {
+
+    if ui.Start == nil {
+        return 0
+    }
+
+    if ui.Finish != nil {
+        now = *ui.Finish
+    }
+
+    return now.Sub(*ui.Start)
+}
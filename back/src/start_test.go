@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "math"
+    "time"
+    "testing"
+)
+
+/* moves user along test line route and records start */
+func start_at(ui *UserInfo, rt *Route, sr *StartRule, lat float64,
+              at int64) *time.Time {
+
+    ui.UpdatePosition(&UserPosition{ Lat: lat, Lon: 37, Last: time.Unix(at, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    return ui.UpdateStart(sr)
+}
+
+func TestStartFromConfig(t *testing.T) {
+
+    rt := test_line_route()
+
+    var conf UserConfig
+
+    if sr := start_from_config(rt, &conf); sr.Staggered || !sr.Time.IsZero() {
+        t.Fatalf("wrong default start: %+v", sr)
+    }
+
+    conf.StaggeredStart = true
+    conf.CheckpointRadius = 50
+
+    sr := start_from_config(rt, &conf)
+    if !sr.Staggered || sr.Lat != 55 || sr.Lon != 37 || sr.Radius != 50 {
+        t.Fatalf("wrong start geofence: %+v", sr)
+    }
+
+    /* nowhere to start from */
+    if sr = start_from_config(nil, &conf); sr.Staggered {
+        t.Fatalf("staggered start without route: %+v", sr)
+    }
+}
+
+func TestFirstFixStart(t *testing.T) {
+
+    rt := test_line_route()
+    sr := &StartRule{}
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(100, 0) })
+
+    if s := ui.UpdateStart(sr); s == nil || !s.Equal(time.Unix(100, 0)) {
+        t.Fatalf("wrong start: %v", s)
+    }
+
+    if s := start_at(ui, rt, sr, 55.001, 200); s != nil {
+        t.Fatalf("started twice: %v", s)
+    }
+}
+
+func TestMassStart(t *testing.T) {
+
+    rt := test_line_route()
+    sr := &StartRule{ Time: time.Unix(1000, 0) }
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+
+    /* riding to the start does not count */
+    if s := start_at(ui, rt, sr, 55.001, 100); s != nil {
+        t.Fatalf("started before mass start: %v", s)
+    }
+
+    if ui.snapshot().Distance == 0 {
+        t.Fatalf("leg before start is not counted")
+    }
+
+    if s := start_at(ui, rt, sr, 55.001, 1010); s == nil || !s.Equal(sr.Time) {
+        t.Fatalf("wrong mass start: %v", s)
+    }
+
+    start_at(ui, rt, sr, 55.002, 1110)
+
+    snap := ui.snapshot()
+
+    if math.Abs(snap.Distance - 111) > 1 || snap.MovingTime != 100 {
+        t.Fatalf("wrong totals since start: %v m in %v s",
+                 snap.Distance, snap.MovingTime)
+    }
+
+    if snap.elapsed(time.Unix(1600, 0)) != 600 * time.Second {
+        t.Fatalf("wrong elapsed time: %v", snap.elapsed(time.Unix(1600, 0)))
+    }
+
+    finish := time.Unix(1300, 0)
+    snap.Finish = &finish
+
+    if snap.elapsed(time.Unix(1600, 0)) != 300 * time.Second {
+        t.Fatalf("wrong elapsed time after finish: %v",
+                 snap.elapsed(time.Unix(1600, 0)))
+    }
+}
+
+func TestStaggeredStart(t *testing.T) {
+
+    rt := test_line_route()
+
+    sr := &StartRule{ Time: time.Unix(100, 0), Staggered: true,
+                      Lat: 55, Lon: 37, Radius: 100 }
+
+    ui := createUser(nil, &UserPosition{ Lat: 55.0005, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    if s := ui.UpdateStart(sr); s != nil {
+        t.Fatalf("started in start geofence: %v", s)
+    }
+
+    /* warming up before the start window is open */
+    start_at(ui, rt, sr, 55.0015, 50)
+
+    if s := start_at(ui, rt, sr, 55.0005, 90); s != nil {
+        t.Fatalf("started before start window: %v", s)
+    }
+
+    if ui.snapshot().Start != nil {
+        t.Fatalf("start is recorded too early")
+    }
+
+    /* border is crossed at 2/5 of the leg */
+    s := start_at(ui, rt, sr, 55.0015, 290)
+    if s == nil || math.Abs(s.Sub(time.Unix(170, 0)).Seconds()) > 1 {
+        t.Fatalf("wrong personal start: %v", s)
+    }
+
+    if d := ui.snapshot().Distance; d != 0 {
+        t.Fatalf("totals are not reset at start: %v", d)
+    }
+}
+
+func TestMissedStart(t *testing.T) {
+
+    rt := test_brevet_route()
+
+    sr := &StartRule{ Staggered: true, Lat: 55, Lon: 37, Radius: 100 }
+
+    /* outside of start geofence, but start could be yet ahead */
+    ui := createUser(nil, &UserPosition{ Lat: 55.005, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    if s := ui.UpdateStart(sr); s != nil {
+        t.Fatalf("started near start: %v", s)
+    }
+
+    /* joined at km 3 */
+    ui = createUser(nil, &UserPosition{ Lat: 55.03, Lon: 37, Last: time.Unix(0, 0) })
+    ui.UpdateRoutePosition(rt)
+
+    if s := ui.UpdateStart(sr); s == nil || !s.Equal(time.Unix(0, 0)) {
+        t.Fatalf("wrong late start: %v", s)
+    }
+}
+
+func TestReportedStart(t *testing.T) {
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+
+    ui.UpdatePosition(&UserPosition{ Lat: 55.001, Lon: 37, Last: time.Unix(100, 0) })
+
+    start := time.Unix(50, 0)
+
+    ui.UpdatePosition(&UserPosition{ Lat: 55.002, Lon: 37,
+                                     Last: time.Unix(200, 0), Start: &start })
+
+    snap := ui.snapshot()
+
+    if snap.Start == nil || !snap.Start.Equal(start) || snap.Distance != 0 {
+        t.Fatalf("reported start is not recorded: %v %v", snap.Start,
+                 snap.Distance)
+    }
+
+    if s := ui.UpdateStart(&StartRule{}); s != nil {
+        t.Fatalf("start is overridden: %v", s)
+    }
+}
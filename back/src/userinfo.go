@@ -24,12 +24,19 @@ import (
     "os"
     "log"
     "fmt"
+    "sync"
     "time"
     "encoding/json"
 )
 
 const TrackDepth = 64
 
+/* pace is measured over this much of recent track */
+const PaceWindow = 30 * time.Minute
+
+/* slower legs of track are stops, not counted in pace */
+const PaceMinSpeed = 1.0         /* m/s */
+
 /* must start with same prefix to match in filter */
 const STATUS_MOVING = "status_moving"
 const STATUS_PITSTOP = "status_pitstop"
@@ -39,12 +46,22 @@ const STATUS_INCIDENT = "status_incident"
 const STATUS_FINISHED = "status_finished"
 const STATUS_DNF = "status_dnf"
 
-type UserMap = map[string]*UserInfo
+type UserMap = map[int64]*UserInfo
 
-/* map with users, serialized to/from StateFile */
+/*
+ * map with users, serialized to/from StateFile;
+ * shared by concurrent bot and http handlers, all access is under mu
+ */
 type UsersDb struct {
+    mu         sync.RWMutex
     people     UserMap
     StateFile  string
+
+    /* placeholder ids for users loaded from old state files */
+    legacy_id  int64
+
+    /* serializes writers of StateFile */
+    save_mu    sync.Mutex
 }
 
 
@@ -53,13 +70,37 @@ type GeoPos struct {
     Lat      float64
 }
 
-/* all information we know about user */
+/*
+ * all information we know about user;
+ * UserID is the telegram numeric user id and never changes,
+ * UserName is only displayed and follows telegram profile.
+ * Start is the official start of user (see StartRule), Distance (meters)
+ * and MovingTime (seconds) are accumulated over legs ridden since.
+ * OffCourse is set once user is away from route since OffSince
+ * for too long (see CourseRule).
+ *
+ * Fields of a live UserInfo stored in UsersDb are protected by mu,
+ * readers outside of methods must use snapshot()
+ */
 type UserInfo struct {
+    mu           sync.Mutex
+
+    UserID       int64
     UserName     string
     Status       string
     MovingState  string
     Pos          GeoPos
     Last         time.Time
+    Accuracy     float64      `json:",omitempty"`
+    Heading      int          `json:",omitempty"`
+    Route       *RouteProgress `json:",omitempty"`
+    Start       *time.Time   `json:",omitempty"`
+    Finish      *time.Time   `json:",omitempty"`
+    Distance     float64      `json:",omitempty"`
+    MovingTime   float64      `json:",omitempty"`
+    CheckIns     []CheckIn    `json:",omitempty"`
+    OffCourse    bool         `json:",omitempty"`
+    OffSince    *time.Time    `json:",omitempty"`
     Track       *RingBuffer
 }
 
@@ -79,85 +120,192 @@ func CreateUsersDb(statefile string) (*UsersDb, error) {
     return db, nil
 }
 
-func (db *UsersDb) get(name string, create bool) (*UserInfo) {
+func (db *UsersDb) get(userid int64, name string, create bool) (*UserInfo) {
+    ui, _ := db.lookup(userid, name, create)
+    return ui
+}
+
+/* same as get(), also tells if user was just created */
+func (db *UsersDb) lookup(userid int64, name string,
+                          create bool) (*UserInfo, bool) {
+
+    ui, created, _ := db.lookup_claim(userid, name, name, create)
+    return ui, created
+}
+
+/*
+ * same as lookup(), but legacy user is claimed by first name, as bot
+ * does, while new user gets full name; also tells if user was claimed
+ */
+func (db *UsersDb) lookup_claim(userid int64, first string, name string,
+                                create bool) (*UserInfo, bool, bool) {
 
     var ok  bool
     var ui *UserInfo
 
-    ui, ok = db.people[name]
+    db.mu.RLock()
+    ui, ok = db.people[userid]
+    db.mu.RUnlock()
 
-    if (!ok) {
-        if create == true {
-            ui = createUser(nil, nil)
-            if ui == nil {
-                return nil
-            }
+    if ok {
+        return ui, false, false
+    }
 
-            db.set(name, ui)
+    db.mu.Lock()
+    defer db.mu.Unlock()
 
-        } else {
-            return nil
-        }
+    /* re-check, somebody could add it while we were unlocked */
+    ui, ok = db.people[userid]
+    if ok {
+        return ui, false, false
     }
 
-    return ui
+    ui = db.claim(userid, first)
+    if ui != nil {
+        return ui, false, true
+    }
+
+    if create == false {
+        return nil, false, false
+    }
+
+    ui = createUser(nil, nil)
+    if ui == nil {
+        return nil, false, false
+    }
+
+    ui.UserName = name
+    db.put(userid, ui)
+
+    return ui, true, false
 }
 
-func (db *UsersDb) set(userid string, ui *UserInfo) {
-    ui.UserName = userid
+func (db *UsersDb) set(userid int64, ui *UserInfo) {
+    db.mu.Lock()
+    db.put(userid, ui)
+    db.mu.Unlock()
+}
+
+/* must be called with db.mu locked */
+func (db *UsersDb) put(userid int64, ui *UserInfo) {
+    ui.mu.Lock()
+    ui.UserID = userid
+    ui.mu.Unlock()
+
     db.people[userid] = ui
 }
 
+/*
+ * State files written before users were identified by telegram id
+ * contain only names.  Such users are loaded with negative placeholder
+ * ids and are taken over by the first real user with the same name.
+ *
+ * must be called with db.mu locked
+ */
+func (db *UsersDb) claim(userid int64, name string) (*UserInfo) {
+
+    if userid <= 0 || len(name) == 0 {
+        return nil
+    }
+
+    for k, ui := range db.people {
+        if k >= 0 || ui.name() != name {
+            continue
+        }
+
+        delete(db.people, k)
+        db.put(userid, ui)
+
+        log.Printf("legacy user '%s' is now known by id %d", name, userid)
+
+        return ui
+    }
+
+    return nil
+}
+
+func (db *UsersDb) next_legacy_id() int64 {
+    db.legacy_id -= 1
+    return db.legacy_id
+}
+
 func (db *UsersDb) count() int {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+
     return len(db.people)
 }
 
+/* consistent copies of all users, safe to use without locking */
+func (db *UsersDb) snapshot() []*UserInfo {
 
-func (db *UsersDb) load() error {
+    db.mu.RLock()
+    defer db.mu.RUnlock()
+
+    out := make([]*UserInfo, 0, len(db.people))
+
+    for _, v := range db.people {
+        out = append(out, v.snapshot())
+    }
+
+    return out
+}
 
-    loadfrom := db.StateFile
+
+/* users saved in state file, nil if there is no file yet */
+func read_state(loadfrom string) ([]*UserInfo, error) {
 
     _, err := os.Stat(loadfrom)
     if os.IsNotExist(err) {
         log.Printf("state file not found, ignored")
-        return nil
+        return nil, nil
     }
 
     f, err := os.ReadFile(loadfrom)
     if err != nil {
         log.Printf("failed to read file '%s': %v", loadfrom, err)
-        return err
+        return nil, err
     }
 
-    var users []UserInfo
+    var users []*UserInfo
 
     err = json.Unmarshal(f, &users)
     if err != nil {
         log.Printf("failed to parse file '%s': %v", loadfrom, err)
+        return nil, err
+    }
+
+    return users, nil
+}
+
+func (db *UsersDb) load() error {
+
+    users, err := read_state(db.StateFile)
+    if err != nil {
         return err
     }
 
+    db.mu.Lock()
+    defer db.mu.Unlock()
+
     var i = 0
 
     for _, v := range users {
 
         ui := createUser(nil, nil);
 
-        ui.UserName = v.UserName
-        ui.Status = v.Status
+        ui.restore(v)
 
-        if len(v.MovingState) == 0 {
-            ui.MovingState = STATUS_MOVING
-        } else {
-            ui.MovingState = v.MovingState
-        }
+        if ui.UserID == 0 {
+            /* old state file: no telegram id stored */
+            ui.UserID = db.next_legacy_id()
 
-        ui.Pos = v.Pos
-        ui.Last = v.Last
-        ui.Track = v.Track
+        } else if ui.UserID < db.legacy_id {
+            db.legacy_id = ui.UserID
+        }
 
-        db.set(v.UserName, ui)
-        log.Printf("loaded user '%v' from state", v.UserName)
+        db.put(ui.UserID, ui)
+        log.Printf("loaded user '%v' (id %d) from state", v.UserName, ui.UserID)
         i += 1
     }
 
@@ -166,9 +314,71 @@ func (db *UsersDb) load() error {
     return nil
 }
 
+/*
+ * brings users in line with state file saved by another process;
+ * file is parsed completely before anything is changed, user with
+ * newer position than in file is kept. Legacy user absent from file
+ * was claimed there and is removed. Returns changed users and number
+ * of removed ones
+ */
+func (db *UsersDb) reload() ([]*UserInfo, int, error) {
+
+    users, err := read_state(db.StateFile)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    db.mu.Lock()
+    defer db.mu.Unlock()
+
+    var changed []*UserInfo
+
+    legacy := make(map[string]bool)
+
+    for _, v := range users {
+
+        /* placeholder ids are not stable between loads */
+        if v.UserID <= 0 {
+            legacy[v.UserName] = true
+            continue
+        }
+
+        ui, ok := db.people[v.UserID]
+        if !ok {
+            ui = createUser(nil, nil)
+            ui.restore(v)
+            db.put(v.UserID, ui)
+            changed = append(changed, ui)
+            continue
+        }
+
+        /* handlers holding user see the change */
+        if ui.reconcile(v) {
+            changed = append(changed, ui)
+        }
+    }
+
+    removed := 0
+
+    for k, ui := range db.people {
+        if k >= 0 || legacy[ui.name()] {
+            continue
+        }
+
+        delete(db.people, k)
+        removed++
+
+        log.Printf("legacy user '%s' is claimed, removed", ui.name())
+    }
+
+    return changed, removed, nil
+}
 
 func (db *UsersDb) save(tmpdir string) error {
 
+    db.save_mu.Lock()
+    defer db.save_mu.Unlock()
+
     txt, err := db.exportJSON()
     if err != nil {
         return fmt.Errorf("failed to export JSON: %v", err)
@@ -180,6 +390,13 @@ func (db *UsersDb) save(tmpdir string) error {
     }
 
     _, err = f.Write([]byte(txt))
+    if err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return err
+    }
+
+    err = f.Close()
     if err != nil {
         os.Remove(f.Name())
         return err
@@ -198,17 +415,10 @@ func (db *UsersDb) save(tmpdir string) error {
 
 func (db *UsersDb) exportJSON() ([]byte, error) {
 
-    var out = make([]UserInfo, people.count())
-
-    var i = 0
-
     /* convert map to array for serializing */
-    for _, v := range people.people {
-        out[i] = *v
-        i += 1
-    }
+    out := db.snapshot()
 
-    log.Printf("export: %d user(s) serialized", i)
+    log.Printf("export: %d user(s) serialized", len(out))
 
     return json.Marshal(out)
 }
@@ -219,44 +429,302 @@ func createUser(us *UserStatus, up *UserPosition) *UserInfo{
 
     ui.Track = CreateRing(TrackDepth)
 
+    /* the same as restore() does, so saved user compares equal */
+    ui.MovingState = STATUS_MOVING
+
     if us != nil {
+        ui.UserName = us.UserName
         ui.Status = us.Status
-        ui.MovingState = us.MovingState
+
+        if len(us.MovingState) != 0 {
+            ui.MovingState = us.MovingState
+        }
     }
 
     if up != nil {
+        ui.UserName = up.UserName
         ui.Pos.Lat = up.Lat
         ui.Pos.Lon = up.Lon
         ui.Last = up.Last
+        ui.Accuracy = up.Accuracy
+        ui.Heading = up.Heading
     }
 
     return ui
 }
 
-func (ui *UserInfo) UpdatePosition(up *UserPosition) {
+/* state of user as saved, MovingState defaults to moving */
+func (ui *UserInfo) restore(v *UserInfo) {
+
+    ui.UserID = v.UserID
+    ui.UserName = v.UserName
+    ui.Status = v.Status
+
+    if len(v.MovingState) == 0 {
+        ui.MovingState = STATUS_MOVING
+    } else {
+        ui.MovingState = v.MovingState
+    }
+
+    ui.Pos = v.Pos
+    ui.Last = v.Last
+    ui.Accuracy = v.Accuracy
+    ui.Heading = v.Heading
+    ui.Route = v.Route
+    ui.Start = v.Start
+    ui.Finish = v.Finish
+    ui.Distance = v.Distance
+    ui.MovingTime = v.MovingTime
+    ui.CheckIns = v.CheckIns
+    ui.OffCourse = v.OffCourse
+    ui.OffSince = v.OffSince
+
+    if v.Track != nil {
+        ui.Track = v.Track
+    }
+}
+
+/* takes saved state unless it is older or the same; true if changed */
+func (ui *UserInfo) reconcile(v *UserInfo) bool {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    if ui.Last.After(v.Last) {
+        return false
+    }
+
+    state := v.MovingState
+    if len(state) == 0 {
+        state = STATUS_MOVING
+    }
+
+    if ui.Last.Equal(v.Last) && ui.Pos == v.Pos &&
+       ui.UserName == v.UserName && ui.Status == v.Status &&
+       ui.MovingState == state && ui.OffCourse == v.OffCourse &&
+       same_time(ui.Start, v.Start) && same_time(ui.Finish, v.Finish) &&
+       len(ui.CheckIns) == len(v.CheckIns) {
+
+        return false
+    }
+
+    ui.restore(v)
+
+    return true
+}
+
+func same_time(a *time.Time, b *time.Time) bool {
+
+    if a == nil || b == nil {
+        return a == b
+    }
+
+    return a.Equal(*b)
+}
+
+/* copy of user, detached from db and its locking */
+func (ui *UserInfo) snapshot() *UserInfo {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    out := new(UserInfo)
+
+    out.UserID = ui.UserID
+    out.UserName = ui.UserName
+    out.Status = ui.Status
+    out.MovingState = ui.MovingState
+    out.Pos = ui.Pos
+    out.Last = ui.Last
+    out.Accuracy = ui.Accuracy
+    out.Heading = ui.Heading
+    out.Route = ui.Route
+    out.Start = ui.Start
+    out.Finish = ui.Finish
+    out.Distance = ui.Distance
+    out.MovingTime = ui.MovingTime
+    out.CheckIns = append([]CheckIn(nil), ui.CheckIns...)
+    out.OffCourse = ui.OffCourse
+    out.OffSince = ui.OffSince
+    out.Track = ui.Track.clone()
+
+    return out
+}
+
+func (ui *UserInfo) name() string {
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    return ui.UserName
+}
+
+/* adds leg to new position to totals, unless user was standing */
+func (ui *UserInfo) count_leg(up *UserPosition) {
+
+    dt := up.Last.Sub(ui.Last).Seconds()
+    if dt <= 0 {
+        return
+    }
+
+    d := geo_distance(ui.Pos.Lat, ui.Pos.Lon, up.Lat, up.Lon)
+
+    /* GPS jumps are not riding either */
+    if d / dt < PaceMinSpeed || d / dt > RouteMaxSpeed {
+        return
+    }
+
+    ui.Distance += d
+    ui.MovingTime += dt
+}
+
+/* fix older than the known one is ignored, false is returned then */
+func (ui *UserInfo) UpdatePosition(up *UserPosition) bool {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    if up.Last.Before(ui.Last) {
+        return false
+    }
+
+    /* positions merged in outbox, as if they came one by one */
+    for _, tp := range up.Missed {
+        if !tp.Last.After(ui.Last) {
+            continue
+        }
+
+        /* legs after start are counted */
+        if up.Start != nil && tp.Last.After(*up.Start) {
+            ui.set_start(*up.Start)
+        }
+
+        ui.move(&UserPosition{ Lat: tp.Lat, Lon: tp.Lon, Last: tp.Last,
+                               Accuracy: tp.Accuracy, Heading: tp.Heading })
+    }
+
+    ui.move(up)
+
+    /* start reported by bot */
+    if up.Start != nil {
+        ui.set_start(*up.Start)
+    }
+
+    ui.rename(up.UserName)
+
+    log.Printf("updated position for user %s", ui.UserName)
+
+    return true
+}
+
+/* must be called with ui.mu locked */
+func (ui *UserInfo) move(up *UserPosition) {
 
     zeroed := (ui.Pos.Lat == 0 && ui.Pos.Lon == 0)
     changed := (up.Lat != ui.Pos.Lat || up.Lon != ui.Pos.Lon)
 
     /* avoid pushing initial and current states to track */
     if (changed && !zeroed) {
-        ui.Track.push(ui.Pos)
+        var tp TrackPoint
+
+        tp.Lat = ui.Pos.Lat
+        tp.Lon = ui.Pos.Lon
+        tp.Last = ui.Last
+        tp.Accuracy = ui.Accuracy
+        tp.Heading = ui.Heading
+
+        ui.Track.push(tp)
+
+        ui.count_leg(up)
     }
 
     ui.Pos.Lat = up.Lat
     ui.Pos.Lon = up.Lon
     ui.Last = up.Last
+    ui.Accuracy = up.Accuracy
+    ui.Heading = up.Heading
+}
 
-    log.Printf("updated position for user %s", ui.UserName)
+/* locate user on route, nothing is done if there is no route */
+func (ui *UserInfo) UpdateRoutePosition(rt *Route) *RouteProgress {
+
+    if rt == nil {
+        return nil
+    }
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    var from *RouteFix
+
+    prev := ui.Route
+    track := ui.Track.extract()
+
+    for _, tp := range track {
+
+        fix := &RouteFix{ Lat: tp.Lat, Lon: tp.Lon, At: tp.Last,
+                          Heading: tp.Heading }
+
+        if ui.Route == nil {
+            /* nothing known yet, follow recent history to find the pass */
+            prev = rt.locate(fix, from, prev)
+        }
+
+        from = fix
+    }
+
+    cur := &RouteFix{ Lat: ui.Pos.Lat, Lon: ui.Pos.Lon, At: ui.Last,
+                      Heading: ui.Heading }
+
+    ui.Route = rt.locate(cur, from, prev)
+
+    return ui.Route
+}
+
+/* returns true if name was actually changed */
+func (ui *UserInfo) Rename(name string) bool {
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    return ui.rename(name)
+}
+
+/* must be called with ui.mu locked */
+func (ui *UserInfo) rename(name string) bool {
+    if (len(name) != 0 && name != ui.UserName) {
+        log.Printf("user %d renamed: '%s' => '%s'", ui.UserID, ui.UserName, name)
+        ui.UserName = name
+        return true
+    }
+
+    return false
 }
 
 func (ui *UserInfo) UpdateStatus(us *UserStatus) {
+
+    ui.mu.Lock()
+    defer ui.mu.Unlock()
+
+    ui.rename(us.UserName)
+
     if (len(us.Status) != 0) {
         ui.Status = us.Status
         log.Printf("updated status for user %s", ui.UserName)
     }
 
     if (len(us.MovingState) != 0) {
+
+        if us.MovingState == STATUS_FINISHED && us.Finish != nil {
+            finish := *us.Finish
+            ui.Finish = &finish
+
+        } else if us.MovingState == STATUS_FINISHED && ui.Finish == nil {
+            now := time.Now()
+            ui.Finish = &now
+
+        } else if us.MovingState != STATUS_FINISHED {
+            ui.Finish = nil
+        }
+
         ui.MovingState = us.MovingState
         log.Printf("updated moving state for user %s", ui.UserName)
     }
@@ -264,6 +732,51 @@ func (ui *UserInfo) UpdateStatus(us *UserStatus) {
 }
 
 
+/*
+ * average moving speed (m/s) over last PaceWindow of track,
+ * zero if user was not moving or there is no track
+ */
+func (ui *UserInfo) pace() float64 {
+
+    ui.mu.Lock()
+
+    cur := TrackPoint{ Lat: ui.Pos.Lat, Lon: ui.Pos.Lon, Last: ui.Last }
+    track := ui.Track.extract()
+
+    ui.mu.Unlock()
+
+    last := cur.Last
+
+    var dist, dt float64
+
+    /* from newest to oldest */
+    for i := len(track) - 1; i >= 0; i-- {
+        tp := track[i]
+
+        if cur.Last.Sub(tp.Last) <= 0 || last.Sub(tp.Last) > PaceWindow {
+            break
+        }
+
+        d := geo_distance(tp.Lat, tp.Lon, cur.Lat, cur.Lon)
+        t := cur.Last.Sub(tp.Last).Seconds()
+
+        if d / t >= PaceMinSpeed {
+            dist += d
+            dt += t
+        }
+
+        cur = tp
+    }
+
+    if dt == 0 {
+        return 0
+    }
+
+    return dist / dt
+}
+
+
+/* only for snapshots or users not yet shared via UsersDb */
 func (u *UserInfo) MarshalJSON() ([]byte, error) {
 
     type Alias UserInfo
@@ -271,7 +784,7 @@ func (u *UserInfo) MarshalJSON() ([]byte, error) {
     positions := u.Track.extract()
 
     aux := &struct {
-        Track []GeoPos `json:"Track,omitempty"`
+        Track []TrackPoint `json:"Track,omitempty"`
         *Alias
     } {
         Track: positions,
@@ -287,7 +800,7 @@ func (ui *UserInfo) UnmarshalJSON(data []byte) error {
     type Alias UserInfo
 
     aux := &struct {
-        Track []GeoPos `json:"Track"`
+        Track []TrackPoint `json:"Track"`
         *Alias
     } {
         Alias: (*Alias)(ui),
@@ -299,6 +812,10 @@ func (ui *UserInfo) UnmarshalJSON(data []byte) error {
 
     ui.Track = CreateRing(TrackDepth)
     for _, pos := range(aux.Track) {
+        if pos.Last.IsZero() {
+            /* old state files have no time in track, best guess */
+            pos.Last = ui.Last
+        }
         ui.Track.push(pos)
     }
 
@@ -0,0 +1,571 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+
+package main
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "strings"
+    "testing"
+    "path/filepath"
+    "net/http/httptest"
+    "encoding/json"
+)
+
+func TestMain(m *testing.M) {
+    /* updates are logged verbosely, keep test output readable */
+    log.SetOutput(io.Discard)
+    os.Exit(m.Run())
+}
+
+func test_db(t *testing.T) *UsersDb {
+
+    dir := t.TempDir()
+
+    db, err := CreateUsersDb(filepath.Join(dir, "people.json"))
+    if err != nil {
+        t.Fatalf("failed to create db: %v", err)
+    }
+
+    return db
+}
+
+func TestUsersDbConcurrent(t *testing.T) {
+
+    const nusers = 50
+    const nupdates = 100
+
+    var wg sync.WaitGroup
+
+    db := test_db(t)
+    tmpdir := filepath.Dir(db.StateFile)
+
+    /* writers: positions and statuses of every user from many goroutines */
+    for u := 1; u <= nusers; u++ {
+        wg.Add(3)
+
+        go func(id int64) {
+            defer wg.Done()
+
+            for i := 0; i < nupdates; i++ {
+                var up UserPosition
+
+                up.UserID = id
+                up.UserName = fmt.Sprintf("rider %d", id)
+                up.Lat = 55 + float64(i) / 1000
+                up.Lon = 37 + float64(i) / 1000
+                up.Last = time.Now()
+
+                ui := db.get(id, up.UserName, true)
+                ui.UpdatePosition(&up)
+            }
+        }(int64(u))
+
+        go func(id int64) {
+            defer wg.Done()
+
+            for i := 0; i < nupdates; i++ {
+                var us UserStatus
+
+                us.UserID = id
+                us.Status = fmt.Sprintf("status %d", i)
+                us.MovingState = STATUS_PITSTOP
+
+                ui := db.get(id, "", true)
+                ui.UpdateStatus(&us)
+            }
+        }(int64(u))
+
+        go func(id int64) {
+            defer wg.Done()
+
+            for i := 0; i < nupdates; i++ {
+                ui := db.get(id, "", true)
+                ui.Rename(fmt.Sprintf("renamed %d", i % 3))
+                ui.name()
+            }
+        }(int64(u))
+    }
+
+    /* readers: export, save and snapshots while writers are busy */
+    for r := 0; r < 4; r++ {
+        wg.Add(1)
+
+        go func() {
+            defer wg.Done()
+
+            for i := 0; i < 20; i++ {
+                txt, err := db.exportJSON()
+                if err != nil {
+                    t.Errorf("export failed: %v", err)
+                    return
+                }
+
+                var users []*UserInfo
+
+                err = json.Unmarshal(txt, &users)
+                if err != nil {
+                    t.Errorf("exported JSON is broken: %v", err)
+                    return
+                }
+
+                for _, ui := range db.snapshot() {
+                    ui.Track.extract()
+                }
+
+                db.count()
+
+                err = db.save(tmpdir)
+                if err != nil {
+                    t.Errorf("save failed: %v", err)
+                    return
+                }
+            }
+        }()
+    }
+
+    wg.Wait()
+
+    if db.count() != nusers {
+        t.Fatalf("expected %d users, got %d", nusers, db.count())
+    }
+
+    for _, ui := range db.snapshot() {
+        if ui.MovingState != STATUS_PITSTOP {
+            t.Fatalf("user %d lost moving state", ui.UserID)
+        }
+
+        if len(ui.Track.extract()) != TrackDepth {
+            t.Fatalf("user %d: track is not full", ui.UserID)
+        }
+    }
+}
+
+func TestSnapshotDetached(t *testing.T) {
+
+    db := test_db(t)
+
+    ui := db.get(1, "rider", true)
+
+    ui.UpdatePosition(&UserPosition{UserID: 1, Lat: 1, Lon: 1})
+
+    snap := ui.snapshot()
+
+    ui.UpdatePosition(&UserPosition{UserID: 1, Lat: 2, Lon: 2})
+    ui.UpdateStatus(&UserStatus{UserID: 1, Status: "changed"})
+
+    if snap.Pos.Lat != 1 || len(snap.Status) != 0 {
+        t.Fatalf("snapshot changed after update")
+    }
+
+    if len(snap.Track.extract()) != 0 {
+        t.Fatalf("snapshot track changed after update")
+    }
+}
+
+func TestStalePosition(t *testing.T) {
+
+    ui := createUser(nil, nil)
+
+    if !ui.UpdatePosition(&UserPosition{ Lat: 2, Lon: 2,
+                                         Last: time.Unix(200, 0) }) {
+        t.Fatalf("position is not accepted")
+    }
+
+    /* fix delivered late must not move rider back */
+    if ui.UpdatePosition(&UserPosition{ Lat: 1, Lon: 1,
+                                        Last: time.Unix(100, 0) }) {
+        t.Fatalf("stale position is accepted")
+    }
+
+    snap := ui.snapshot()
+    if snap.Pos.Lat != 2 || !snap.Last.Equal(time.Unix(200, 0)) {
+        t.Fatalf("stale position is applied: %+v", snap)
+    }
+}
+
+func TestStateRoundtrip(t *testing.T) {
+
+    db := test_db(t)
+    tmpdir := filepath.Dir(db.StateFile)
+
+    ui := db.get(42, "rider", true)
+    ui.UpdatePosition(&UserPosition{UserID: 42, Lat: 1, Lon: 1})
+    ui.UpdatePosition(&UserPosition{UserID: 42, Lat: 2, Lon: 2})
+    ui.UpdateStatus(&UserStatus{UserID: 42, MovingState: STATUS_PUNCTURE})
+
+    err := db.save(tmpdir)
+    if err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+
+    db2, err := CreateUsersDb(db.StateFile)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    cp := db2.get(42, "", false)
+    if cp == nil {
+        t.Fatalf("user not loaded")
+    }
+
+    snap := cp.snapshot()
+
+    if snap.UserName != "rider" || snap.MovingState != STATUS_PUNCTURE ||
+       snap.Pos.Lat != 2 || len(snap.Track.extract()) != 1 {
+        t.Fatalf("user loaded incorrectly: %+v", snap)
+    }
+}
+
+func TestStateReload(t *testing.T) {
+
+    bot := test_db(t)
+    tmpdir := filepath.Dir(bot.StateFile)
+
+    now := time.Now()
+
+    for id := int64(1); id <= 3; id++ {
+        ui := bot.get(id, fmt.Sprintf("rider%d", id), true)
+        ui.UpdatePosition(&UserPosition{ UserID: id, Lat: 1, Lon: 1, Last: now })
+    }
+
+    bot.save(tmpdir)
+
+    webmap, err := CreateUsersDb(bot.StateFile)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    if ch, rm, err := webmap.reload(); err != nil || len(ch) != 0 || rm != 0 {
+        t.Fatalf("reload of the same state changed %d users: %v", len(ch), err)
+    }
+
+    /* the same rider got by webmap directly is not a change */
+    at := now.Add(time.Second)
+
+    for _, db := range []*UsersDb{ bot, webmap } {
+        db.get(5, "rider5", true).UpdatePosition(&UserPosition{ UserID: 5,
+                                                 Lat: 5, Lon: 5, Last: at })
+    }
+
+    bot.save(tmpdir)
+
+    if ch, _, err := webmap.reload(); err != nil || len(ch) != 0 {
+        t.Fatalf("new rider known to both is changed: %d, %v", len(ch), err)
+    }
+
+    /* missed by webmap: new status, new position and new user */
+    bot.get(1, "", false).UpdateStatus(&UserStatus{ UserID: 1, Status: "tea" })
+    bot.get(2, "", false).UpdatePosition(&UserPosition{ UserID: 2, Lat: 2, Lon: 2,
+                                                        Last: now.Add(time.Minute) })
+    bot.get(4, "rider4", true)
+
+    /* webmap has newer position of rider 3 */
+    kept := webmap.get(3, "", false)
+    kept.UpdatePosition(&UserPosition{ UserID: 3, Lat: 3, Lon: 3,
+                                       Last: now.Add(time.Hour) })
+
+    bot.save(tmpdir)
+
+    held := webmap.get(2, "", false)
+
+    changed, removed, err := webmap.reload()
+    if err != nil || len(changed) != 3 || removed != 0 {
+        t.Fatalf("reload changed %d users: %v", len(changed), err)
+    }
+
+    /* users are updated in place */
+    if held.snapshot().Pos.Lat != 2 || webmap.get(1, "", false).snapshot().Status != "tea" {
+        t.Fatalf("missed updates are not reloaded")
+    }
+
+    if kept.snapshot().Pos.Lat != 3 || webmap.get(4, "", false) == nil {
+        t.Fatalf("wrong reload: %+v", kept.snapshot())
+    }
+}
+
+func TestLegacyStateClaim(t *testing.T) {
+
+    dir := t.TempDir()
+    fn := filepath.Join(dir, "people.json")
+
+    /* state file before users got telegram ids */
+    legacy := `[{"UserName":"Alexey","Status":"","MovingState":"status_moving",
+                 "Pos":{"Lat":55,"Lon":37}},
+                {"UserName":"Boris","Status":"","MovingState":"status_moving",
+                 "Pos":{"Lat":56,"Lon":38}}]`
+
+    err := os.WriteFile(fn, []byte(legacy), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    db, err := CreateUsersDb(fn)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    webmap, err := CreateUsersDb(fn)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    if db.count() != 2 {
+        t.Fatalf("expected 2 users, got %d", db.count())
+    }
+
+    ui := db.get(1001, "Alexey", false)
+    if ui == nil {
+        t.Fatalf("legacy user not claimed")
+    }
+
+    if ui.snapshot().UserID != 1001 || ui.snapshot().Pos.Lat != 55 {
+        t.Fatalf("wrong user claimed")
+    }
+
+    /* second Alexey is a different rider */
+    if db.get(1002, "Alexey", false) != nil {
+        t.Fatalf("legacy user claimed twice")
+    }
+
+    if db.count() != 2 {
+        t.Fatalf("claim changed number of users")
+    }
+
+    /* "Boris Ivanov" was kept by first name */
+    if db.get(1003, "Boris Ivanov", false) != nil {
+        t.Fatalf("legacy user claimed by full name")
+    }
+
+    ui = db.get(1003, "Boris", false)
+    if ui == nil || ui.snapshot().Pos.Lat != 56 {
+        t.Fatalf("legacy user not claimed by first name")
+    }
+
+    ui.UpdateStatus(&UserStatus{ UserID: 1003, UserName: "Boris Ivanov" })
+
+    if db.get(1003, "Boris Ivanov", false) != ui || db.count() != 2 {
+        t.Fatalf("renamed user is duplicated")
+    }
+
+    /* webmap sees claimed users in place of legacy ones */
+    db.save(dir)
+
+    changed, removed, err := webmap.reload()
+    if err != nil || len(changed) != 2 || removed != 2 {
+        t.Fatalf("wrong reload: %d changed, %d removed, %v",
+                 len(changed), removed, err)
+    }
+
+    if webmap.count() != 2 || webmap.get(1003, "", false) == nil {
+        t.Fatalf("claimed users are not reloaded")
+    }
+}
+
+/* bot and webmap claim the same legacy user of rider with last name */
+func TestLegacyClaimBothSides(t *testing.T) {
+
+    fn := filepath.Join(t.TempDir(), "people.json")
+
+    legacy := `[{"UserName":"Boris","MovingState":"status_moving",
+                 "Pos":{"Lat":56,"Lon":38}}]`
+
+    err := os.WriteFile(fn, []byte(legacy), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    bot, err := CreateUsersDb(fn)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    people, err = CreateUsersDb(fn)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    hub = CreateHub()
+    start_rule = &StartRule{}
+
+    defer func() { people = nil; hub = nil; start_rule = nil }()
+
+    /* the same as bot does for message of "Boris Ivanov" */
+    if bot.get(1003, "Boris", false) == nil {
+        t.Fatalf("legacy user is not claimed by bot")
+    }
+
+    body := `{"UserID":1003,"UserName":"Boris Ivanov","FirstName":"Boris",
+              "Lat":56.001,"Lon":38,"Last":"2024-06-01T10:00:00Z"}`
+
+    r := httptest.NewRequest("POST", "/updatepos", strings.NewReader(body))
+
+    err = handle_position_post(httptest.NewRecorder(), r)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ui := people.get(1003, "", false)
+
+    if people.count() != 1 || ui == nil ||
+       ui.snapshot().UserName != "Boris Ivanov" {
+        t.Fatalf("webmap has %d users, claimed %v", people.count(), ui)
+    }
+}
+
+func TestTrackPoints(t *testing.T) {
+
+    db := test_db(t)
+    tmpdir := filepath.Dir(db.StateFile)
+
+    t0 := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+
+    ui := db.get(7, "rider", true)
+
+    for i := 0; i < 3; i++ {
+        var up UserPosition
+
+        up.UserID = 7
+        up.Lat = float64(i + 1)
+        up.Lon = float64(i + 1)
+        up.Last = t0.Add(time.Duration(i) * time.Minute)
+        up.Accuracy = float64(10 + i)
+        up.Heading = 90 + i
+
+        ui.UpdatePosition(&up)
+    }
+
+    err := db.save(tmpdir)
+    if err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+
+    db2, err := CreateUsersDb(db.StateFile)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    snap := db2.get(7, "", false).snapshot()
+    track := snap.Track.extract()
+
+    if len(track) != 2 {
+        t.Fatalf("expected 2 track points, got %d", len(track))
+    }
+
+    for i, tp := range track {
+        if !tp.Last.Equal(t0.Add(time.Duration(i) * time.Minute)) ||
+           tp.Accuracy != float64(10 + i) || tp.Heading != 90 + i {
+            t.Fatalf("track point %d is wrong: %+v", i, tp)
+        }
+    }
+
+    if snap.Heading != 92 || snap.Accuracy != 12 {
+        t.Fatalf("current position lost accuracy/heading: %+v", snap)
+    }
+}
+
+func TestLegacyTrack(t *testing.T) {
+
+    dir := t.TempDir()
+    fn := filepath.Join(dir, "people.json")
+
+    /* track points without time */
+    legacy := `[{"UserID":5,"UserName":"rider","MovingState":"status_moving",
+                 "Pos":{"Lat":55,"Lon":37},"Last":"2024-06-01T10:00:00Z",
+                 "Track":[{"Lon":36.9,"Lat":54.9},{"Lon":36.95,"Lat":54.95}]}]`
+
+    err := os.WriteFile(fn, []byte(legacy), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    db, err := CreateUsersDb(fn)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    snap := db.get(5, "", false).snapshot()
+    track := snap.Track.extract()
+
+    if len(track) != 2 || track[1].Lat != 54.95 {
+        t.Fatalf("legacy track loaded incorrectly: %+v", track)
+    }
+
+    if !track[0].Last.Equal(snap.Last) {
+        t.Fatalf("legacy track point has no time: %+v", track[0])
+    }
+}
+
+func TestRideTotals(t *testing.T) {
+
+    db := test_db(t)
+    tmpdir := filepath.Dir(db.StateFile)
+
+    t0 := time.Unix(1000, 0)
+
+    ui := db.get(42, "rider", true)
+
+    /* 1 km north in 200 seconds, standing 10 minutes, GPS jump */
+    fixes := []UserPosition{
+        { Lat: 55, Lon: 37, Last: t0 },
+        { Lat: 55.004497, Lon: 37, Last: t0.Add(100 * time.Second) },
+        { Lat: 55.008993, Lon: 37, Last: t0.Add(200 * time.Second) },
+        { Lat: 55.008994, Lon: 37, Last: t0.Add(800 * time.Second) },
+        { Lat: 56, Lon: 37, Last: t0.Add(810 * time.Second) },
+    }
+
+    for i := range fixes {
+        ui.UpdatePosition(&fixes[i])
+        ui.UpdateStart(&StartRule{})
+    }
+
+    snap := ui.snapshot()
+
+    if snap.Start == nil || !snap.Start.Equal(t0) {
+        t.Fatalf("wrong start: %v", snap.Start)
+    }
+
+    if snap.MovingTime != 200 || snap.Distance < 999 || snap.Distance > 1001 {
+        t.Fatalf("wrong totals: %v m in %v s", snap.Distance, snap.MovingTime)
+    }
+
+    err := db.save(tmpdir)
+    if err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+
+    db2, err := CreateUsersDb(db.StateFile)
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+
+    cp := db2.get(42, "", false).snapshot()
+
+    if cp.Start == nil || !cp.Start.Equal(t0) ||
+       cp.Distance != snap.Distance || cp.MovingTime != snap.MovingTime {
+        t.Fatalf("totals are not restored: %+v", cp)
+    }
+}
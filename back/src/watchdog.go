@@ -0,0 +1,240 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+/* how often riders are checked */
+const WatchdogPeriod = time.Minute
+
+/*
+ * defaults: rider is stalled if stays within WatchStallRadius for
+ * WatchStallTime, silent if no position comes for WatchSilenceTime;
+ * organizers are alerted if rider does not answer for WatchAnswerTime
+ */
+const WatchStallRadius = 100.0
+const WatchStallTime = 20 * time.Minute
+const WatchSilenceTime = 30 * time.Minute
+const WatchAnswerTime = 10 * time.Minute
+
+/* why rider is worried about */
+const (
+    WATCH_OK = iota
+    WATCH_STALLED
+    WATCH_SILENT
+)
+
+/* what is to be done with rider */
+const (
+    WATCH_ASK = iota
+    WATCH_ALERT
+)
+
+type WatchRule struct {
+    StallRadius    float64
+    Stall          time.Duration
+    Silence        time.Duration
+    Answer         time.Duration
+}
+
+type WatchEvent struct {
+    Action   int
+    Reason   int
+    User    *UserInfo
+}
+
+/* rider who was asked if everything is fine */
+type watchState struct {
+    reason    int
+    asked     time.Time
+    alerted   bool
+
+    /* rider answered, not asked again till then */
+    quiet     time.Time
+}
+
+/* keeps track of questions to riders, between checks */
+type Watchdog struct {
+    mu        sync.Mutex
+    rule     *WatchRule
+    users     map[int64]*watchState
+}
+
+func seconds(s float64) time.Duration {
+    return time.Duration(s * float64(time.Second))
+}
+
+func watch_rule_from_config(conf *UserConfig) *WatchRule {
+
+    wr := &WatchRule{
+        StallRadius: conf.WatchStallRadius,
+        Stall: seconds(conf.WatchStallTime),
+        Silence: seconds(conf.WatchSilenceTime),
+        Answer: seconds(conf.WatchAnswerTime),
+    }
+
+    if wr.StallRadius <= 0 {
+        wr.StallRadius = WatchStallRadius
+    }
+
+    if wr.Stall <= 0 {
+        wr.Stall = WatchStallTime
+    }
+
+    if wr.Silence <= 0 {
+        wr.Silence = WatchSilenceTime
+    }
+
+    if wr.Answer <= 0 {
+        wr.Answer = WatchAnswerTime
+    }
+
+    return wr
+}
+
+func create_watchdog(wr *WatchRule) *Watchdog {
+    return &Watchdog{ rule: wr, users: make(map[int64]*watchState) }
+}
+
+/*
+ * Checks user (snapshot): only started riders who claim to be moving
+ * are watched; stalled are those whose positions come, but stay
+ * in the same place for too long
+ */
+func (wr *WatchRule) check(ui *UserInfo, now time.Time) int {
+
+    if ui.MovingState != STATUS_MOVING || ui.Start == nil || ui.Last.IsZero() {
+        return WATCH_OK
+    }
+
+    if now.Sub(ui.Last) >= wr.Silence {
+        return WATCH_SILENT
+    }
+
+    since := now.Add(-wr.Stall)
+
+    /* not enough history to tell */
+    if ui.Start.After(since) {
+        return WATCH_OK
+    }
+
+    /*
+     * same positions are not pushed to track, the newest may be old;
+     * track is short, noise in place can fill it in minutes, so rider
+     * is stalled only if some point before stall time is seen
+     */
+    track := ui.Track.extract()
+
+    if len(track) == 0 {
+        if ui.Last.After(since) {
+            return WATCH_OK
+        }
+        return WATCH_STALLED
+    }
+
+    for i := len(track) - 1; i >= 0; i-- {
+        tp := track[i]
+
+        if geo_distance(tp.Lat, tp.Lon, ui.Pos.Lat, ui.Pos.Lon) >
+           wr.StallRadius {
+            return WATCH_OK
+        }
+
+        if !tp.Last.After(since) {
+            return WATCH_STALLED
+        }
+    }
+
+    return WATCH_OK
+}
+
+/* what has to be done with users (snapshots) now */
+func (w *Watchdog) check(users []*UserInfo, now time.Time) []WatchEvent {
+
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    var out []WatchEvent
+
+    seen := make(map[int64]bool)
+
+    for _, ui := range users {
+
+        reason := w.rule.check(ui, now)
+
+        if reason == WATCH_OK {
+            continue
+        }
+
+        seen[ui.UserID] = true
+
+        st := w.users[ui.UserID]
+
+        switch {
+        case st == nil || (!st.quiet.IsZero() && now.After(st.quiet)):
+            w.users[ui.UserID] = &watchState{ reason: reason, asked: now }
+            out = append(out, WatchEvent{ WATCH_ASK, reason, ui })
+
+            log.Printf("asking user %s if everything is ok (%d)",
+                       ui.UserName, reason)
+
+        case st.quiet.IsZero() && !st.alerted &&
+             now.Sub(st.asked) >= w.rule.Answer:
+            st.alerted = true
+            out = append(out, WatchEvent{ WATCH_ALERT, st.reason, ui })
+
+            log.Printf("user %s did not answer, alerting organizers",
+                       ui.UserName)
+        }
+    }
+
+    /* everything is fine with the rest */
+    for id := range w.users {
+        if !seen[id] {
+            delete(w.users, id)
+        }
+    }
+
+    return out
+}
+
+/*
+ * user answered that everything is fine: not asked again for a while;
+ * tells if user was asked at all
+ */
+func (w *Watchdog) answered(id int64, now time.Time) bool {
+
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    st := w.users[id]
+    if st == nil {
+        return false
+    }
+
+    st.quiet = now.Add(w.rule.Stall)
+
+    return true
+}
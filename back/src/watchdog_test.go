@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+func test_watch_rule() *WatchRule {
+    return &WatchRule{ StallRadius: 100, Stall: 20 * time.Minute,
+                       Silence: 30 * time.Minute, Answer: 10 * time.Minute }
+}
+
+/* started rider, positions every minute along the way */
+func test_watched(lats []float64) *UserInfo {
+
+    ui := createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+    ui.MovingState = STATUS_MOVING
+    ui.UpdateStart(&StartRule{})
+
+    for i, lat := range lats {
+        ui.UpdatePosition(&UserPosition{ Lat: lat, Lon: 37,
+                                         Last: time.Unix(int64(i + 1) * 60, 0) })
+    }
+
+    return ui.snapshot()
+}
+
+func TestWatchRule(t *testing.T) {
+
+    var conf UserConfig
+
+    wr := watch_rule_from_config(&conf)
+    if wr.StallRadius != WatchStallRadius || wr.Stall != WatchStallTime ||
+       wr.Silence != WatchSilenceTime || wr.Answer != WatchAnswerTime {
+        t.Fatalf("wrong default rule: %+v", wr)
+    }
+
+    conf.WatchStallTime = 600
+
+    if wr = watch_rule_from_config(&conf); wr.Stall != 10 * time.Minute {
+        t.Fatalf("wrong stall time: %+v", wr)
+    }
+}
+
+func TestWatchCheck(t *testing.T) {
+
+    wr := test_watch_rule()
+
+    /* riding for 30 minutes, 100 m per minute */
+    var lats []float64
+    for i := 1; i <= 30; i++ {
+        lats = append(lats, 55 + float64(i) * 0.0009)
+    }
+
+    ui := test_watched(lats)
+    now := time.Unix(31 * 60, 0)
+
+    if r := wr.check(ui, now); r != WATCH_OK {
+        t.Fatalf("moving rider is stalled: %v", r)
+    }
+
+    /* then standing for 25 minutes, with GPS noise */
+    for i := 0; i < 25; i++ {
+        lats = append(lats, 55.027 + float64(i % 2) * 0.0003)
+    }
+
+    ui = test_watched(lats)
+    now = time.Unix(56 * 60, 0)
+
+    if r := wr.check(ui, now); r != WATCH_STALLED {
+        t.Fatalf("standing rider is not stalled: %v", r)
+    }
+
+    /* the same, but positions are not sent */
+    if r := wr.check(ui, now.Add(30 * time.Minute)); r != WATCH_SILENT {
+        t.Fatalf("silent rider is not noticed: %v", r)
+    }
+
+    ui.MovingState = STATUS_PITSTOP
+
+    if r := wr.check(ui, now); r != WATCH_OK {
+        t.Fatalf("rider on pitstop is stalled: %v", r)
+    }
+
+    /* nothing is known about riders who did not start */
+    ui = test_watched(nil)
+    ui.Start = nil
+
+    if r := wr.check(ui, time.Unix(3600, 0)); r != WATCH_OK {
+        t.Fatalf("rider is watched before start: %v", r)
+    }
+
+    /* standing for 15 minutes, noise every 10 s fills the track */
+    ui = createUser(nil, &UserPosition{ Lat: 55, Lon: 37, Last: time.Unix(0, 0) })
+    ui.MovingState = STATUS_MOVING
+    ui.UpdateStart(&StartRule{})
+    ui.UpdatePosition(&UserPosition{ Lat: 54.99, Lon: 37, Last: time.Unix(300, 0) })
+
+    for i := 0; i < 90; i++ {
+        ui.UpdatePosition(&UserPosition{ Lat: 55 + float64(i % 2) * 0.0003,
+                                         Lon: 37,
+                                         Last: time.Unix(600 + int64(i) * 10, 0) })
+    }
+
+    ui = ui.snapshot()
+
+    if r := wr.check(ui, ui.Last.Add(time.Second)); r != WATCH_OK {
+        t.Fatalf("rider is stalled before stall time: %v", r)
+    }
+
+    /* never moved since start */
+    ui = test_watched(nil)
+
+    if r := wr.check(ui, time.Unix(25 * 60, 0)); r != WATCH_STALLED {
+        t.Fatalf("rider who never moved is not stalled: %v", r)
+    }
+}
+
+func TestWatchdog(t *testing.T) {
+
+    w := create_watchdog(test_watch_rule())
+
+    ui := test_watched(nil)
+    ui.UserID = 42
+
+    users := []*UserInfo{ ui }
+    t0 := time.Unix(25 * 60, 0)
+
+    evs := w.check(users, t0)
+    if len(evs) != 1 || evs[0].Action != WATCH_ASK ||
+       evs[0].Reason != WATCH_STALLED {
+        t.Fatalf("rider is not asked: %+v", evs)
+    }
+
+    if evs = w.check(users, t0.Add(5 * time.Minute)); len(evs) != 0 {
+        t.Fatalf("asked twice: %+v", evs)
+    }
+
+    evs = w.check(users, t0.Add(10 * time.Minute))
+    if len(evs) != 1 || evs[0].Action != WATCH_ALERT {
+        t.Fatalf("organizers are not alerted: %+v", evs)
+    }
+
+    if evs = w.check(users, t0.Add(11 * time.Minute)); len(evs) != 0 {
+        t.Fatalf("alerted twice: %+v", evs)
+    }
+
+    /* rider moved on, asked anew when stalled again */
+    w.check(nil, t0.Add(12 * time.Minute))
+
+    evs = w.check(users, t0.Add(13 * time.Minute))
+    if len(evs) != 1 || evs[0].Action != WATCH_ASK {
+        t.Fatalf("rider is not asked again: %+v", evs)
+    }
+
+    /* answered: no alert, asked again after a while */
+    if !w.answered(42, t0.Add(14 * time.Minute)) {
+        t.Fatalf("answer is lost")
+    }
+
+    if evs = w.check(users, t0.Add(30 * time.Minute)); len(evs) != 0 {
+        t.Fatalf("rider who answered is bothered: %+v", evs)
+    }
+
+    evs = w.check(users, t0.Add(35 * time.Minute))
+    if len(evs) != 1 || evs[0].Action != WATCH_ASK {
+        t.Fatalf("rider is not asked after quiet period: %+v", evs)
+    }
+
+    if w.answered(43, t0) {
+        t.Fatalf("answer of rider who was not asked")
+    }
+}
@@ -21,15 +21,17 @@
 package main
 
 import (
-    "os"
+    "io"
     "fmt"
+    "bytes"
     "log"
+    "sync"
     "time"
     "errors"
+    "strconv"
     "syscall"
     "net/http"
     "encoding/json"
-    "container/list"
 )
 
 type WebErrorMessage struct {
@@ -37,25 +39,48 @@ type WebErrorMessage struct {
     Error    string  `json: error`
 }
 
+/* shared with bot running in the same process */
 var people *UsersDb
+var route *Route
 
-type Client struct {
-    id      string
-    realip  string
-    queue   list.List
-}
+var hub *Hub
+
+/* seconds per meter of climbing in ETA, from config */
+var climb_penalty float64
+
+/* nil unless event is a brevet */
+var brevet *Brevet
+
+var start_rule *StartRule
+
+/* incidents reported by bot */
+var incidents *IncidentDb
 
-var clients map[string]*Client
+/* POST requests are checked if keys are set */
+var keyring *Keyring
 
+/* downstream webmaps, accepted updates are passed to them */
+var relays []*Sink
 
-func fatal_error(w http.ResponseWriter, r *http.Request, e error, sent bool) {
+/* idempotency keys of applied updates */
+var updates_seen = CreateKeyCache(IdempotencyKeys)
+
+/* delay between change of state file and its reload */
+const ReloadDelay = time.Second
+
+/* keeps standings computed by concurrent handlers in order */
+var standings_mu sync.Mutex
+
+
+func fatal_error(w http.ResponseWriter, r *http.Request, e error, sent bool,
+                 status int) {
 
     var errmsg WebErrorMessage
 
     if sent == false {
-        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteHeader(status)
 
-        errmsg.Code = 502
+        errmsg.Code = status
         errmsg.Error = e.Error()
 
         txt, err := json.Marshal(errmsg)
@@ -74,43 +99,108 @@ func request_handler(w http.ResponseWriter, r *http.Request) {
 
     var err error
     sent := false
+    status := http.StatusInternalServerError
 
     switch r.Method {
 
     case "POST":
 
+        var body []byte
+
+        body, err = read_update(r)
+        if err != nil {
+            break
+        }
+
+        if keyring.enabled() {
+            err = keyring.verify(r, body, time.Now())
+            if err != nil {
+                w.Header().Set("WWW-Authenticate", "HMAC-SHA256")
+                status = http.StatusUnauthorized
+                break
+            }
+        }
+
+        /* bot retries updates until they are accepted */
+        key := r.Header.Get(IdempotencyHeader)
+        if key != "" && updates_seen.has(key) {
+            log.Printf("duplicate update %s ignored", key)
+            return
+        }
+
+        /* failed update is malformed and must not be retried */
+        status = http.StatusBadRequest
+
+        var kind int
+
         switch r.URL.Path {
         case "/updatepos":
-            err = handle_position_update(w, r)
+            kind = UPDATE_POSITION
+            err = handle_position_post(w, r)
 
         case "/updatestatus":
-            err = handle_status_update(w, r)
+            kind = UPDATE_STATUS
+            err = handle_status_post(w, r)
+
+        case "/updateincident":
+            kind = UPDATE_INCIDENT
+            err = handle_incident_post(w, r)
 
         default:
             err = errors.New("unsupported endpoint requested")
         }
 
+        if err != nil {
+            break
+        }
+
+        /* update relayed back must be recognized as well */
+        if key == "" {
+            key = update_key()
+        }
+
+        updates_seen.add(key)
+
+        if len(relays) != 0 {
+            relay_update(kind, key, body)
+        }
+
     case "GET":
 
         switch r.URL.Path {
         case "/bootstrap":
             err, sent = bootstrap(w, r)
 
+        case "/standings":
+            err, sent = standings_export(w, r)
+
+        case "/eta":
+            err, sent = eta_export(w, r)
+
+        case "/card":
+            err, sent = card_export(w, r)
+
+        case "/incidents":
+            err, sent = incidents_export(w, r)
+
         case "/people":
 
             var cln *Client
+            var mode int
 
-            cln = new(Client)
+            /* full UserInfo objects unless client asks for deltas */
+            delta := r.URL.Query().Get("format") == "delta"
 
-            cln.realip = r.Header.Get("X-Forwarded-For")
-            cln.id = r.RemoteAddr
-            clients[cln.id] = cln
+            cln, mode = hub.subscribe(r.RemoteAddr,
+                                      r.Header.Get("X-Forwarded-For"),
+                                      r.Header.Get("Last-Event-ID"),
+                                      delta)
 
             log.Printf("Client %v connected", r.RemoteAddr)
 
-            err, sent = people_event_source(w, r, cln)
+            err, sent = people_event_source(w, r, cln, mode)
 
-            delete(clients, r.RemoteAddr)
+            hub.unsubscribe(cln)
             log.Printf("Client: %v done", r.RemoteAddr)
 
         default:
@@ -127,13 +217,62 @@ func request_handler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        fatal_error(w, r, err, sent)
+        fatal_error(w, r, err, sent, status)
+        return
+    }
+}
+
+
+/* body is kept for handler */
+func read_update(r *http.Request) ([]byte, error) {
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, MaxUpdateSize))
+    if err != nil {
+        return nil, err
+    }
+
+    r.Body = io.NopCloser(bytes.NewReader(body))
+
+    return body, nil
+}
+
+/*
+ * accepted update goes to downstream webmaps with the same key,
+ * so updates looping back or coming twice are dropped
+ */
+func relay_update(kind int, key string, body []byte) {
+
+    var upd struct {
+        UserID    int64
+        CheckIns  []json.RawMessage
+    }
+
+    err := json.Unmarshal(body, &upd)
+    if err != nil {
+        log.Printf("failed to relay update: %v", err)
         return
     }
+
+    /* the same as bot does */
+    replaceable := kind == UPDATE_POSITION && len(upd.CheckIns) == 0
+
+    err = push_update(relays, kind, key, upd.UserID, body, replaceable)
+    if err != nil {
+        log.Printf("failed to relay update: %v", err)
+    }
 }
 
+/* legacy users are claimed by first name, older bots do not send it */
+func claim_name(first string, name string) string {
 
-func handle_position_update(w http.ResponseWriter, r *http.Request) error {
+    if len(first) == 0 {
+        return name
+    }
+
+    return first
+}
+
+func handle_position_post(w http.ResponseWriter, r *http.Request) error {
 
     decoder := json.NewDecoder(r.Body)
 
@@ -145,25 +284,72 @@ func handle_position_update(w http.ResponseWriter, r *http.Request) error {
         return err
     }
 
-    ui = people.get(up.UserName, true)
+    if up.UserID == 0 {
+        return fmt.Errorf("no user id in update for '%v'", up.UserName)
+    }
+
+    ui, created, claimed := people.lookup_claim(up.UserID,
+                                                claim_name(up.FirstName,
+                                                           up.UserName),
+                                                up.UserName, true)
     if ui == nil {
-        return fmt.Errorf("failed to get user %v", up.UserName)
+        return fmt.Errorf("failed to get user %v", up.UserID)
+    }
+
+    /* clients know claimed user by placeholder id */
+    if claimed {
+        defer hub.resync()
+    }
+
+    /* replayed update, newer position is already known */
+    if !ui.UpdatePosition(&up) {
+        log.Printf("stale position of %s ignored: %v", up.UserName, up.Last)
+        return nil
     }
 
-    ui.UpdatePosition(&up)
+    progress := ui.UpdateRoutePosition(route)
+
+    /* bot does not report start of riders until it is recorded */
+    ui.UpdateStart(start_rule)
+
+    ui.set_off_course(up.OffCourse)
+
+    var checkins []CheckIn
+
+    if len(up.CheckIns) != 0 {
+        checkins = ui.AddCheckIns(up.CheckIns)
+    }
 
     log.Printf("position update for %s: [lat:%2f, lon:%2f]\n",
                up.UserName, up.Lat, up.Lon)
 
-    for _, client := range clients {
-        client.queue.PushBack(ui)
+    var delta *UserDelta
+
+    if !created {
+        delta = new(UserDelta)
+
+        delta.UserID = up.UserID
+        delta.Pos = &GeoPos{ Lat: up.Lat, Lon: up.Lon }
+        delta.Last = &up.Last
+        delta.Route = progress
+        delta.CheckIns = checkins
+
+        snap := ui.snapshot()
+
+        delta.Start = snap.Start
+        delta.Distance = snap.Distance
+        delta.MovingTime = snap.MovingTime
+        delta.OffCourse = &snap.OffCourse
     }
 
+    hub.publish(ui, delta)
+    update_standings()
+
     return nil
 }
 
 
-func handle_status_update(w http.ResponseWriter, r *http.Request) error {
+func handle_status_post(w http.ResponseWriter, r *http.Request) error {
 
     decoder := json.NewDecoder(r.Body)
 
@@ -175,22 +361,180 @@ func handle_status_update(w http.ResponseWriter, r *http.Request) error {
         return err
     }
 
-    ui = people.get(us.UserName, true)
+    if us.UserID == 0 {
+        return fmt.Errorf("no user id in update for '%v'", us.UserName)
+    }
+
+    ui, created, claimed := people.lookup_claim(us.UserID,
+                                                claim_name(us.FirstName,
+                                                           us.UserName),
+                                                us.UserName, true)
     if ui == nil {
-        return fmt.Errorf("failed to get user %v", us.UserName)
+        return fmt.Errorf("failed to get user %v", us.UserID)
+    }
+
+    if claimed {
+        defer hub.resync()
     }
 
     ui.UpdateStatus(&us)
 
     log.Printf("status update for %s: '%s'\n", us.UserName, us.Status)
 
-    for _, client := range clients {
-        client.queue.PushBack(ui)
+    var delta *UserDelta
+
+    if !created {
+        delta = new(UserDelta)
+
+        delta.UserID = us.UserID
+        delta.UserName = us.UserName
+        delta.Status = us.Status
+        delta.MovingState = us.MovingState
+        delta.Finish = ui.snapshot().Finish
+    }
+
+    hub.publish(ui, delta)
+    update_standings()
+
+    return nil
+}
+
+func handle_incident_post(w http.ResponseWriter, r *http.Request) error {
+
+    decoder := json.NewDecoder(r.Body)
+
+    var inc Incident
+
+    err := decoder.Decode(&inc)
+    if err != nil {
+        return err
+    }
+
+    if inc.ID == 0 || inc.UserID == 0 {
+        return fmt.Errorf("no incident or user id in incident update")
     }
 
+    incidents.put(inc)
+
+    log.Printf("incident %d of %s: %s", inc.ID, inc.UserName, inc.State)
+
     return nil
 }
 
+/*
+ * bot in the same process has already updated shared users and
+ * incidents, clients only have to learn about it
+ */
+func follow_bot(updates <-chan BusMessage) {
+
+    for m := range updates {
+
+        var id int64
+
+        switch {
+        case m.Position != nil:
+            id = m.Position.UserID
+
+        case m.Status != nil:
+            id = m.Status.UserID
+
+        case m.Incident != nil:
+            log.Printf("incident %d of %s: %s", m.Incident.ID,
+                       m.Incident.UserName, m.Incident.State)
+            continue
+        }
+
+        ui, _ := people.lookup(id, "", false)
+        if ui == nil {
+            continue
+        }
+
+        hub.publish(ui, nil)
+        update_standings()
+    }
+}
+
+/*
+ * bot in another process saves state file after changes; webmap
+ * reloads it to catch up with updates it has missed
+ */
+func follow_state(file string) {
+
+    changes := make(chan struct{}, 1)
+
+    go func() {
+        err := watch_file(file, func() {
+            select {
+            case changes <- struct{}{}:
+            default:
+            }
+        })
+
+        log.Printf("state file '%s' is not watched: %v", file, err)
+    }()
+
+    for range changes {
+        /* bot saves after every message, let them settle */
+        time.Sleep(ReloadDelay)
+
+        select {
+        case <-changes:
+        default:
+        }
+
+        resync_state()
+    }
+}
+
+func resync_state() {
+
+    changed, removed, err := people.reload()
+    if err != nil {
+        log.Printf("failed to reload state: %v", err)
+        return
+    }
+
+    if len(changed) == 0 && removed == 0 {
+        return
+    }
+
+    log.Printf("state file reloaded, %d users changed, %d removed",
+               len(changed), removed)
+
+    /* clients cannot drop user by update, they start over */
+    if removed != 0 {
+        hub.resync()
+
+    } else {
+        for _, ui := range changed {
+            hub.publish(ui, nil)
+        }
+    }
+
+    update_standings()
+}
+
+/* all incidents, or only not resolved: /incidents?active=1 */
+func incidents_export(w http.ResponseWriter, r *http.Request) (error, bool) {
+
+    active := len(r.URL.Query().Get("active")) != 0
+
+    w.Header().Set("Content-Type", "application/json");
+    w.Header().Set("Cache-Control", "no-cache");
+
+    txt, err := json.Marshal(incidents.snapshot(active))
+    if err != nil {
+        return err, false
+    }
+
+    _, err = w.Write(txt)
+    if (err != nil) {
+        return err, false
+    }
+
+    return nil, true
+}
+
 func bootstrap(w http.ResponseWriter, r *http.Request) (error, bool) {
 
     w.Header().Set("Content-Type", "application/json");
@@ -212,11 +556,139 @@ func bootstrap(w http.ResponseWriter, r *http.Request) (error, bool) {
     return nil, true
 }
 
-func send_event(w http.ResponseWriter, txt string, headers_sent *bool) (error) {
+/* let event source clients know if order of riders has changed */
+func update_standings() {
+
+    standings_mu.Lock()
+    defer standings_mu.Unlock()
+
+    st := make_standings(people.snapshot(), route, time.Now())
+
+    if hub.publish_standings(st) && len(st) != 0 {
+        log.Printf("standings changed, leader: %s", st[0].UserName)
+    }
+}
+
+func standings_export(w http.ResponseWriter, r *http.Request) (error, bool) {
+
+    w.Header().Set("Content-Type", "application/json");
+    w.Header().Set("Cache-Control", "no-cache");
+
+    st := make_standings(people.snapshot(), route, time.Now())
+
+    txt, err := json.Marshal(st)
+    if err != nil {
+        return err, false
+    }
+
+    _, err = w.Write(txt)
+    if (err != nil) {
+        return err, false
+    }
+
+    return nil, true
+}
+
+/*
+ * ETA of rider (id or name) to finish, checkpoints and
+ * given kilometres of route: /eta?rider=<rider>&km=<km>&km=...;
+ * without rider, all riders are reported
+ */
+func eta_export(w http.ResponseWriter, r *http.Request) (error, bool) {
+
+    q := r.URL.Query()
+
+    var offsets []float64
+
+    for _, km := range q["km"] {
+        v, err := strconv.ParseFloat(km, 64)
+        if err != nil {
+            return fmt.Errorf("bad route kilometre '%s'", km), false
+        }
+
+        offsets = append(offsets, v * 1000)
+    }
+
+    users := people.snapshot()
+
+    if rider := q.Get("rider"); len(rider) != 0 {
+        ui, err := find_rider(users, rider)
+        if err != nil {
+            return err, false
+        }
+
+        users = []*UserInfo{ ui }
+    }
+
+    out := make([]*RiderEta, 0, len(users))
+
+    for _, ui := range users {
+        out = append(out, make_eta(ui, route, offsets, climb_penalty))
+    }
+
+    w.Header().Set("Content-Type", "application/json");
+    w.Header().Set("Cache-Control", "no-cache");
+
+    txt, err := json.Marshal(out)
+    if err != nil {
+        return err, false
+    }
+
+    _, err = w.Write(txt)
+    if (err != nil) {
+        return err, false
+    }
+
+    return nil, true
+}
+
+/* brevet control card of rider (id or name): /card?rider=<rider> */
+func card_export(w http.ResponseWriter, r *http.Request) (error, bool) {
+
+    if brevet == nil {
+        return errors.New("event is not a brevet"), false
+    }
+
+    ui, err := find_rider(people.snapshot(), r.URL.Query().Get("rider"))
+    if err != nil {
+        return err, false
+    }
+
+    w.Header().Set("Content-Type", "application/json");
+    w.Header().Set("Cache-Control", "no-cache");
+
+    txt, err := json.Marshal(brevet.card(ui, route, time.Now()))
+    if err != nil {
+        return err, false
+    }
+
+    _, err = w.Write(txt)
+    if (err != nil) {
+        return err, false
+    }
+
+    return nil, true
+}
+
+/*
+ * event with empty id does not change client's Last-Event-ID;
+ * event with empty name only sets it, nothing is dispatched
+ */
+func send_event(w http.ResponseWriter, event string, id string, txt string,
+                headers_sent *bool) (error) {
 
     var err error
+    var msg string
+
+    if len(id) != 0 {
+        msg = "id: " + id + "\n"
+    }
+
+    if len(event) != 0 {
+        msg += fmt.Sprintf("event: %s\ndata: %s\n", event, txt)
+    }
 
-    msg := fmt.Sprintf("event: posupdate\ndata: %s\n\n", txt)
+    msg += "\n"
 
     _, err = w.Write([]byte(msg))
     if (err != nil) {
@@ -233,7 +705,8 @@ func send_event(w http.ResponseWriter, txt string, headers_sent *bool) (error) {
 }
 
 
-func people_event_source(w http.ResponseWriter, r *http.Request, client *Client) (error, bool) {
+func people_event_source(w http.ResponseWriter, r *http.Request, client *Client,
+                         mode int) (error, bool) {
 
     w.Header().Set("Content-Type", "text/event-stream");
     w.Header().Set("Cache-Control", "no-cache");
@@ -242,80 +715,133 @@ func people_event_source(w http.ResponseWriter, r *http.Request, client *Client)
      * To avoid closing keepalive connection without activity,
      * send something once in interval
      */
-    var quiet = 0
-    const interval = 30
+    const interval = 30 * time.Second
+
+    keepalive := time.NewTimer(interval)
+    defer keepalive.Stop()
 
     var headers_sent = false
+    var err error
+
+    /* let client know stream is open without waiting for first event */
+    switch mode {
+    case SUB_NEW:
+        /* client bootstraps now; later resume starts from here */
+        err = send_event(w, "", client.start, "", &headers_sent)
+
+    case SUB_RESYNC:
+        var rr ResyncRequest
+        rr.Resync = true
+
+        txt, _ := json.Marshal(rr)
+
+        log.Printf("client %s(%s) is too far behind, resync requested",
+                   client.id, client.realip)
+
+        err = send_event(w, "resync", client.start, string(txt), &headers_sent)
+
+    default:
+        /* missed updates, if any, are already queued */
+        err = send_event(w, "", "", "", &headers_sent)
+    }
+
+    if err != nil {
+        return err, headers_sent
+    }
 
     log.Printf("entering event source loop...")
 
     for {
-        qlen := client.queue.Len()
+        select {
+        case <-r.Context().Done():
+            /* client went away */
+            return nil, headers_sent
 
-        if (qlen == 0) {
-            time.Sleep(1 * time.Second)
-            quiet += 1
-
-            if quiet < interval {
-                continue
-            }
+        case <-keepalive.C:
 
             /* we have no real updates, send small keepalive message */
 
             var ka KeepalivePing
             ka.Alive = true
 
-            var txt []byte
-            var err error
-
-            txt, err = json.Marshal(ka)
+            txt, err := json.Marshal(ka)
+            if err != nil {
+                return err, headers_sent
+            }
 
-            err = send_event(w, string(txt), &headers_sent)
+            err = send_event(w, "posupdate", "", string(txt), &headers_sent)
             if err != nil {
                 return err, headers_sent
             }
 
-            quiet = 0
-            continue
-        }
+            keepalive.Reset(interval)
 
-        var out = make([]UserInfo, qlen)
+        case <-client.notify:
 
-        var i = 0
-        for qlen > 0 {
-            elem := client.queue.Front()
+            if rs := client.drain_resync(); rs != 0 {
+                var rr ResyncRequest
+                rr.Resync = true
 
-            v := elem.Value.(*UserInfo)
-            out[i] = *v
-            i += 1
+                txt, _ := json.Marshal(rr)
 
-            client.queue.Remove(elem)
-            qlen -= 1
-        }
+                log.Printf("users reloaded, resync requested from client %s(%s)",
+                           client.id, client.realip)
 
-        var txt []byte
-        var err error
+                err = send_event(w, "resync", hub.event_id(rs), string(txt),
+                                 &headers_sent)
+                if err != nil {
+                    return err, headers_sent
+                }
+            }
 
-        txt, err = json.Marshal(out)
-        if err != nil {
-            return err, headers_sent
-        }
+            out, seq := client.drain()
+            st := client.drain_standings()
 
-        // TODO: check if connection closed by client
-        err = send_event(w, string(txt), &headers_sent)
-        if err != nil {
-            return err, headers_sent
-        }
+            if len(out) == 0 && st == nil {
+                continue
+            }
 
-        quiet = 0
+            var txt []byte
 
-        log.Printf("pushed events to client %s(%s): %s, total clients: %d",
-                   client.id, client.realip, string(txt), len(clients))
+            if len(out) != 0 {
+                txt, err = json.Marshal(out)
+                if err != nil {
+                    return err, headers_sent
+                }
+
+                event := "posupdate"
+                if client.delta {
+                    event = "delta"
+                }
+
+                err = send_event(w, event, hub.event_id(seq), string(txt),
+                                 &headers_sent)
+                if err != nil {
+                    return err, headers_sent
+                }
+            }
 
-        time.Sleep(1 * time.Second)
-    }
+            if st != nil {
+                txt, err = json.Marshal(st)
+                if err != nil {
+                    return err, headers_sent
+                }
+
+                err = send_event(w, "standings", "", string(txt), &headers_sent)
+                if err != nil {
+                    return err, headers_sent
+                }
+            }
+
+            if !keepalive.Stop() {
+                <-keepalive.C
+            }
+            keepalive.Reset(interval)
 
-    return nil, headers_sent
+            log.Printf("pushed events to client %s(%s): %s, total clients: %d",
+                       client.id, client.realip, string(txt), hub.count())
+        }
+    }
 }
 
 func logRequest(handler http.Handler) http.Handler {
@@ -330,46 +856,27 @@ func logRequest(handler http.Handler) http.Handler {
 }
 
 
+/*
+ * serves map till server fails; bot running in the same process
+ * passes its updates, otherwise they are received over HTTP
+ */
+func webmap_serve(conf *UserConfig, updates <-chan BusMessage) error {
 
+    climb_penalty = conf.ClimbPenalty
 
-func main() {
-
-    if len(os.Args) < 2 {
-        log.Printf("Usage: " + os.Args[0] + ": <conf.json>\n" );
-        os.Exit(1);
-    }
-
-    conf, err := ConfigLoad(os.Args[1])
-    if err != nil {
-        log.Println("config load failed: " + err.Error())
-        os.Exit(1)
-    }
-
-    var dcfg DaemonConfig
-
-    dcfg.AppID = "webmap"
-    dcfg.LogFile = conf.WebmapLog
-    dcfg.Syslog = conf.Syslog
-    dcfg.Stderr = conf.Stderr
-
-    err = init_daemon(&dcfg)
-    if err != nil {
-        log.Println("daemon init failed: " + err.Error())
-        os.Exit(1)
-    }
+    hub = CreateHub()
+    update_standings()
 
-    /* webmap only reads state file, shared with bot */
-    people, err = CreateUsersDb(conf.StateFile)
-    if err != nil {
-        log.Println("failed to load users: " + err.Error())
-        os.Exit(1)
+    if updates != nil {
+        go follow_bot(updates)
+    } else {
+        go follow_state(people.StateFile)
     }
 
-    clients = make(map[string]*Client)
-
-
     log.Printf("webmap server is listening at %s", conf.WebmapListen)
 
     http.HandleFunc("/", request_handler)
-    log.Fatal(http.ListenAndServe(conf.WebmapListen, logRequest(http.DefaultServeMux)))
+
+    return http.ListenAndServe(conf.WebmapListen,
+                               logRequest(http.DefaultServeMux))
 }
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2024 Vladimir Homutov
+ */
+
+/*
+ * This file is part of Rieman.
+ *
+ * Rieman is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Rieman is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ */
+
+package main
+
+import (
+    "os"
+    "log"
+    "context"
+    "path/filepath"
+)
+
+/* webmap shares directory of state file with bot, outbox names differ */
+func relay_file(conf *UserConfig) string {
+    return filepath.Join(filepath.Dir(conf.StateFile), "relay.json")
+}
+
+func main() {
+
+    if len(os.Args) < 2 {
+        log.Printf("Usage: " + os.Args[0] + ": <conf.json>\n" );
+        os.Exit(1);
+    }
+
+    conf, err := ConfigLoad(os.Args[1])
+    if err != nil {
+        log.Println("config load failed: " + err.Error())
+        os.Exit(1)
+    }
+
+    var dcfg DaemonConfig
+
+    dcfg.AppID = "webmap"
+    dcfg.LogFile = conf.WebmapLog
+    dcfg.Syslog = conf.Syslog
+    dcfg.Stderr = conf.Stderr
+
+    err = init_daemon(&dcfg)
+    if err != nil {
+        log.Println("daemon init failed: " + err.Error())
+        os.Exit(1)
+    }
+
+    /* webmap only reads state file, shared with bot */
+    people, err = CreateUsersDb(conf.StateFile)
+    if err != nil {
+        log.Println("failed to load users: " + err.Error())
+        os.Exit(1)
+    }
+
+    /* incidents file is written by bot too */
+    incidents, err = CreateIncidentDb(incident_file(&conf))
+    if err != nil {
+        log.Println("failed to load incidents: " + err.Error())
+        os.Exit(1)
+    }
+
+    if len(conf.RouteFile) != 0 {
+        route, err = LoadRoute(conf.RouteFile)
+        if err != nil {
+            log.Println("failed to load route: " + err.Error())
+            os.Exit(1)
+        }
+
+        log.Printf("route '%s' loaded, %.1f km", route.Name, route.Length / 1000)
+    }
+
+    setup_checkpoints(route, &conf)
+
+    brevet = brevet_from_config(&conf)
+    start_rule = start_from_config(route, &conf)
+
+    keyring = CreateKeyring(conf.UpdateKeys)
+    if !keyring.enabled() {
+        log.Printf("no UpdateKeys configured, updates are not authenticated")
+    }
+
+    go reload_keys(keyring, os.Args[1])
+
+    relays, err = create_sinks(conf.RelayTo, relay_file(&conf), "relay",
+                               conf.TmpDir, keyring)
+    if err != nil {
+        log.Println("failed to load relay outbox: " + err.Error())
+        os.Exit(1)
+    }
+
+    for _, s := range relays {
+        go s.run(context.Background())
+    }
+
+    /* updates come from bot over HTTP */
+    log.Fatal(webmap_serve(&conf, nil))
+}
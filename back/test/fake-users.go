@@ -28,30 +28,25 @@ import (
     "net/http"
     "math/rand"
     "encoding/json"
-    "github.com/tkrajina/gpxgo/gpx"
     rn "github.com/random-names/go"
 )
 
 type FakeUser struct {
     index      int
+    id         int64
     name       string
     pos        UserPosition
     status     UserStatus
     next_move  time.Time
 }
 
-type SimplePoint struct {
-    Lat      float64
-    Lon      float64
-}
-
 const NUsers = 20
 
 var NPoints = 0
 
 
 var users [NUsers]FakeUser
-var points []SimplePoint
+var points []RoutePoint
 
 func getNames() {
 
@@ -72,6 +67,7 @@ func getNames() {
     }
 
     for i := 0; i < NUsers; i++ {
+        users[i].id = int64(i + 1)
         users[i].name = fns[i] + " " + lns[i]
         users[i].next_move = time.Now()
 
@@ -137,11 +133,13 @@ func move_user(u *FakeUser) {
         }
     }
 
+    u.pos.UserID = u.id
     u.pos.UserName = u.name
     u.pos.Lat = point.Lat + delta
     u.pos.Lon = point.Lon + delta
     u.pos.Last = time.Now()
 
+    u.status.UserID = u.id
     u.status.UserName = u.name
     u.status.MovingState = statuses[sindex]
 
@@ -158,30 +156,14 @@ func main() {
 
     getNames()
 
-    bytes, err := os.ReadFile("./track.gpx")
-    if err != nil {
-        os.Stderr.WriteString("failed to load GPX: " + err.Error() + "\n")
-        os.Exit(1)
-    }
-
-    gpxFile, err := gpx.ParseBytes(bytes)
+    /* all tracks and segments, same as bot and webmap see them */
+    rt, err := LoadRoute("./track.gpx")
     if err != nil {
-        os.Stderr.WriteString("failed to parse GPX: " + err.Error() + "\n")
+        os.Stderr.WriteString("failed to load route: " + err.Error() + "\n")
         os.Exit(1)
     }
 
-    track := gpxFile.Tracks[0]
-
-    for _, segment := range track.Segments {
-        for _, point := range segment.Points {
-            var p SimplePoint
-
-            p.Lat = point.Point.Latitude
-            p.Lon = point.Point.Longitude
-
-            points = append(points, p)
-        }
-    }
+    points = rt.points
 
     NPoints = len(points)
 
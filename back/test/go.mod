@@ -2,10 +2,4 @@ module inspert.ru/livemogt-test
 
 go 1.20
 
-require (
-	github.com/random-names/go v0.0.0-20190609025437-4cca751ffd3b // indirect
-	github.com/random-names/names v0.0.0-20190601153910-592b8341554e // indirect
-	github.com/tkrajina/gpxgo v1.3.1 // indirect
-	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
-	golang.org/x/text v0.3.6 // indirect
-)
+require github.com/random-names/go v0.0.0-20190609025437-4cca751ffd3b
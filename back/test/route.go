@@ -0,0 +1 @@
+../src/route.go
\ No newline at end of file
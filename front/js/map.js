@@ -65,9 +65,14 @@ const lang_db = {
         tracking_time: 'Tracking time',
         route_status: 'Route status',
         route_position: 'Route position',
+        checkpoints: 'Checkpoints',
+        finish_time: 'Finish time',
+        elapsed_time: 'Elapsed time',
+        moving_time: 'Moving time',
         lost: 'lost',
         on_track: 'on track',
         off_track: 'off',
+        off_course: 'Off course',
         ride_status: 'Ride status',
         position_updated: 'Position updated',
         ago: 'ago',
@@ -101,9 +106,14 @@ const lang_db = {
         tracking_time: 'Время отслеживания',
         route_status: 'Статус маршрута',
         route_position: 'Позиция на маршруте',
+        checkpoints: 'Контрольные пункты',
+        finish_time: 'Время финиша',
+        elapsed_time: 'Время в пути',
+        moving_time: 'Время в движении',
         lost: 'утерян',
         on_track: 'на трассе',
         off_track: 'отклонение',
+        off_course: 'Сбился с маршрута',
         ride_status: 'Статус поездки',
         position_updated: 'Позиция обновлена',
         ago: 'тому назад',
@@ -452,52 +462,56 @@ function palette_color(index)
 }
 
 
-function start_events()
+function getJSON(url, callback)
 {
-    let eSource = new EventSource("/people");
-    eSource.addEventListener("posupdate", source_event_handler);
-
-    let getJSON = function(url, callback) {
-        let xhr = new XMLHttpRequest();
-        xhr.open('GET', url, true);
-        xhr.responseType = 'json';
+    let xhr = new XMLHttpRequest();
+    xhr.open('GET', url, true);
+    xhr.responseType = 'json';
 
-        xhr.onload = function() {
-            let status = xhr.status;
+    xhr.onload = function() {
+        let status = xhr.status;
 
-            if (status === 200) {
-              callback(null, xhr.response);
+        if (status === 200) {
+          callback(null, xhr.response);
 
-            } else {
-              callback(status, xhr.response);
-            }
-        };
-        xhr.send();
+        } else {
+          callback(status, xhr.response);
+        }
     };
+    xhr.send();
+}
 
+
+function bootstrap()
+{
     getJSON('/bootstrap', function(err, data) {
         if (err !== null) {
             console.log("oops")
             return
         }
 
-        for (let i = 0; i < data.length; i++) {
-            const u = data[i]
-            const key = u['UserName']
+        if (debug != 0) {
+            console.log('boostrap data:', data)
+        }
 
-            if (debug != 0) {
-                console.log('boostrap data:', u)
-            }
+        apply_updates(data)
+    });
+}
 
-            let person = person_from_update(u)
-            people.set(key, person)
 
-            mark_new_person(person)
-        }
-
-        update_gui()
+function start_events()
+{
+    /* only changed fields are sent, applied on top of bootstrap */
+    let eSource = new EventSource("/people?format=delta");
+    eSource.addEventListener("delta", source_event_handler);
+
+    /* server could not replay what we missed while disconnected */
+    eSource.addEventListener("resync", function(event) {
+        console.log('resync requested')
+        bootstrap()
     });
 
+    bootstrap()
 }
 
 
@@ -798,7 +812,8 @@ function calc_person_average_speed_on_track(person)
     let prev = getPointCoords(person.pos)
     let prev_time = person.last
 
-    for (let i = 0; i < person.track.length; i++) {
+    /* track is stored oldest first, walk back from current position */
+    for (let i = person.track.length - 1; i >= 0; i--) {
         let curr = getPointCoords(person.track[i].pos)
         let curr_time = person.track[i].last
 
@@ -894,12 +909,49 @@ function panel_expand(person)
         }
     }
 
+    /* reported by backend once rider is away from route for long */
+    if (person.off_course) {
+        diverge += '<br/><b>⚠️ ' + i18n['off_course'] + '</b>'
+    }
+
+    if (person.checkins.length) {
+        diverge += '<br/>' + i18n['checkpoints'] + ':'
+
+        for (let i = 0; i < person.checkins.length; i++) {
+            const ci = person.checkins[i]
+            const t = new Date(ci['Time'])
+
+            diverge += '<br/>' + ci['Name'] + ' - '
+                       + fmtime(t.getHours()) + ':' + fmtime(t.getMinutes())
+        }
+    }
+
     let ms = moving_state_to_text(person)
 
     if (ms.length) {
         diverge += '<br/>'+ i18n['ride_status']+': <i>' + ms + '</i>'
     }
 
+    if (person.MovingState == 'status_finished' && person.finish) {
+        const t = new Date(person.finish)
+
+        diverge += '<br/>' + i18n['finish_time'] + ': '
+                   + fmtime(t.getHours()) + ':' + fmtime(t.getMinutes())
+    }
+
+    if (person.start) {
+        let end = Date.now()
+
+        if (person.MovingState == 'status_finished' && person.finish) {
+            end = new Date(person.finish).getTime()
+        }
+
+        const elapsed = (end - new Date(person.start).getTime()) / 1000
+
+        diverge += '<br/>' + i18n['elapsed_time'] + ': ' + fmt_hm(elapsed)
+        diverge += '<br/>' + i18n['moving_time'] + ': ' + fmt_hm(person.moving_time)
+    }
+
     let debugmsg = ''
     if (debug != 0) {
         debugmsg += '<br/><pre>'
@@ -1221,6 +1273,14 @@ function fmtime(n)
     return String(n).padStart(2, 0);
 }
 
+/* seconds as H:MM */
+function fmt_hm(sec)
+{
+    const m = Math.max(0, Math.floor(sec / 60))
+
+    return Math.floor(m / 60) + ':' + fmtime(m % 60)
+}
+
 
 function draw_trail_markers(person)
 {
@@ -1265,7 +1325,7 @@ function draw_trail_lines(person)
         let s = segments[i]
 
         const ftrack = new olFeature({ geometry: new olGeom.LineString(s) });
-        ftrack.set("pkey", person.name)
+        ftrack.set("pkey", person.id)
 
         person.track_line.push(ftrack)
         layer.addFeature(ftrack);
@@ -1287,6 +1347,13 @@ function remove_trail_lines(person)
 
 function update_person_route_position(person)
 {
+    /* server knows the route, use its numbers */
+    if (person.route) {
+        person.route_position = person.route["Position"]
+        person.route_diverge = person.route["Diverge"]
+        return
+    }
+
     const coords = getPointCoords(person.pos)
 
     /* do not calculate route position again if coordinates did not change */
@@ -1434,7 +1501,7 @@ function mark_new_person(person)
         marker.set("text", shorten(person.name, 10))
     }
 
-    marker.set("key", person.name)
+    marker.set("key", person.id)
     person.marker = marker
     people_layer.getSource().addFeature(marker)
 
@@ -1448,11 +1515,18 @@ function person_from_update(u)
     let person = new Object();
 
     person.index = people.size
+    person.id = u['UserID']
     person.name = u['UserName']
     person.pos = [ u["Pos"]["Lon"], u["Pos"]["Lat"] ]
-    person.Status = u["Status"]
-    person.MovingState = u["MovingState"]
+    person.Status = u["Status"] ?? ''
+    person.MovingState = u["MovingState"] ?? ''
     person.last = u["Last"]
+    person.route = u["Route"]
+    person.checkins = u["CheckIns"] ?? []
+    person.finish = u["Finish"] ?? null
+    person.start = u["Start"] ?? null
+    person.moving_time = u["MovingTime"] ?? 0
+    person.off_course = u["OffCourse"] ?? false
     person.distance_tracked = 0
     person.track_line = []
     update_person_route_position(person);
@@ -1470,7 +1544,7 @@ function person_from_update(u)
             const pos = ut[i]
 
             p.pos = [pos["Lon"], pos["Lat"]]
-            p.last = u["Last"]
+            p.last = pos["Last"] ?? u["Last"]
             p.marker = create_marker(p.pos)
             person.track.push(p)
         }
@@ -1515,7 +1589,7 @@ function create_person_stats_row(person)
     td3.setAttribute('class', 'name')
 
     td3.addEventListener('click', function() {
-        person_click_on_panel(person.name);
+        person_click_on_panel(person.id);
     }, false)
 
     cells.push(td3)
@@ -1539,7 +1613,8 @@ function create_person_stats_row(person)
 function create_user_entry_on_panel(person)
 {
     let item = document.createElement('tr')
-    item.id = person.name
+    item.id = person.id
+    item.setAttribute('name', person.name)
     item.setAttribute('distance', 0)
 
     let cells = create_person_stats_row(person)
@@ -1575,8 +1650,8 @@ function sort_users_panel()
         let bv = b.getAttribute('distance')
 
         if (av == bv || av == null || bv == null || av == '' || bv == '') {
-            av = a.id
-            bv = b.id
+            av = a.getAttribute('name')
+            bv = b.getAttribute('name')
 
         } else {
             av = Number(av)
@@ -1610,6 +1685,12 @@ function source_event_handler(event)
         return
     }
 
+    apply_updates(updates)
+}
+
+
+function apply_updates(updates)
+{
     for (let i = 0; i < updates.length; i++) {
         const u = updates[i]
 
@@ -1617,12 +1698,18 @@ function source_event_handler(event)
             print_r('remote update', u)
         }
 
-        const key = u['UserName']
+        const key = u['UserID']
 
         let person = people.get(key)
 
         if (person == undefined) {
 
+            if (u["Pos"] == undefined) {
+                /* delta for somebody we do not know yet */
+                bootstrap()
+                continue
+            }
+
             person = person_from_update(u)
 
             people.set(key, person)
@@ -1658,6 +1745,33 @@ function source_event_handler(event)
                 }
             }
 
+            if (u["Route"] != undefined) {
+                person.route = u["Route"]
+            }
+
+            if (u["CheckIns"] != undefined) {
+                person.checkins = u["CheckIns"]
+            }
+
+            if (u["Start"] != undefined) {
+                person.start = u["Start"]
+            }
+
+            if (u["Pos"] != undefined) {
+                person.moving_time = u["MovingTime"] ?? 0
+                person.off_course = u["OffCourse"] ?? false
+            }
+
+            /* finish time is only sent while rider is finished */
+            if (u["Finish"] != undefined) {
+                person.finish = u["Finish"]
+            }
+
+            if (u["UserName"] != undefined && person.name != u["UserName"]) {
+                person.name = u["UserName"]
+                person.panel.setAttribute('name', person.name)
+            }
+
             if (u["Status"] != undefined && person.Status != u["Status"]) {
                 person.Status = u["Status"]
                 if (debug != 0) {